@@ -9,12 +9,19 @@ import (
 	"os"
 	"fmt"
 	"flag"
+	"path"
+	"time"
+	"context"
+	"syscall"
+	"os/signal"
+	"encoding/json"
 	"strings"
 
 	"potano.layercake/fs"
 	"potano.layercake/fns"
 	"potano.layercake/config"
 	"potano.layercake/manage"
+	"potano.layercake/daemon"
 	"potano.layercake/defaults"
 )
 
@@ -25,9 +32,19 @@ Usage:
 These commands are available
   init             Establish the layer system in configured directory
   status [layer]   Display the status of the build root or a single layer
+                   Add -v to show the layer's chroot environment
   list [-v]        Display list of layers showing status
                    Add -v for a more verbose listing
   add <layer> [base]  Add a layer and indicate layer it derives
+  bootstrap <layer> <stage3> [-digests file]  Populate a base layer's empty
+                  build root from a stage3 tarball after verifying its digests
+  export-tar <layer> -o <file>  Write a layer's configuration and files
+                  to a tarball, compressed according to the file extension
+  import-tar <file> [name] [-base parent]  Reconstruct a layer from a
+                  tarball made by export-tar
+  apply [manifest]  Create, rename, rebase, reconfigure, or retire layers
+                  to match a site manifest; use -p to show the plan only
+  manifest dump [-o file]  Write a site manifest describing the layers
   rename <layer> <newname>  Rename a layer
   rebase <layer> [newbase]  Change a layer's base layer
   remove <layer> [-files]   Remove a layer; use -files to remove files and
@@ -42,7 +59,30 @@ These commands are available
   shake           Remount all current overlayfs mounts to ensure that
                   changes in lower layers propagate upward to mounted
 		  layers
-  chroot <layer>  Starts a chroot using named layer
+  update-all [-- emerge-args]  Run the configured update command in each
+                  layer, parents first, remounting layers whose base changed
+  reap -idle <duration>  Unmount layers which have had no users for the
+                  given time (e.g. 2h), along with bases left idle; for cron
+  chroot <layer> [-user <user>] [-login] [-readonly]  Starts a chroot using
+                  named layer, optionally as a user of the layer and with a
+                  login shell; -readonly keeps derived layers' views current
+  exec <layer> [-user <user>] [-login] [-readonly] -- <command> [args]  Runs
+                  a command in a chroot using the named layer
+  logs <layer> [log] [-follow]  List the layer's chroot and exec session
+                  logs, or show the named or, with -follow, the latest log
+  coverage <layer> <vdb>  Check a target's installed packages (copy of its
+                  /var/db/pkg as a directory or tarball) against the
+                  layer's binary packages and installed packages
+  rebuild-plan <layer>  List packages of the base layer which the derived
+                  layer must rebuild because of differing USE settings
+  doctor [layer] [-fix]  Check layers for problems such as stale duplicate
+                  package-database entries; use -fix to repair them
+  compare <layerA> <layerB> [-json]  Show differences between the packages
+                  installed in two layers; -json gives JSON output
+  history [layer]  Show the actions layercake carried out, optionally only
+                  those affecting the named layer
+  daemon [-socket path] [-group name]  Serve list, status, mount, unmount,
+                  exec, and lock requests from local clients on a Unix socket
 
 Main options
   --config <file> Specify/override configuration-file location
@@ -53,6 +93,10 @@ Global options (may be specified anywhere in the command line)
   -p              Pretend to carry out actions
   -force          Force action
   -debug          Show debugging output
+  -script         Instead of carrying out actions, write equivalent shell
+                  commands to standard output; implies -p
+  -wait <duration>  Wait up to the given time (e.g. 30s, 5m) for another
+                  state-changing layercake command to finish
 `
 
 const argumentHintMessage = `
@@ -93,24 +137,30 @@ func main() {
 	if err != nil {
 		fatal(err.Error())
 	}
+	manage.StartAuditLog(cfg)
 
 	args := flag.Args()
+	command := defaults.DefaultCommand
+	if len(args) > 0 {
+		command = args[0]
+	}
+
 	cmdinfo := commandInfo{
 		cfg: cfg,
 		isDefaultCommand: len(args) == 0,
 		cab: cab,
 	}
 
-	command := defaults.DefaultCommand
-	if len(args) > 0 {
-		command = args[0]
-	}
-
 	fn := map[string]func(commandInfo){
 		"init": initCommand,
 		"status": statusCommand,
 		"list": listCommand,
 		"add": addCommand,
+		"bootstrap": bootstrapCommand,
+		"export-tar": exportTarCommand,
+		"apply": applyCommand,
+		"manifest": manifestCommand,
+		"import-tar": importTarCommand,
 		"remove": removeCommand,
 		"rename": renameCommand,
 		"rebase": rebaseCommand,
@@ -120,7 +170,17 @@ func main() {
 		"unmount": unmountCommand,
 		"umount": unmountCommand,
 		"chroot": chrootCommand,
+		"exec": execCommand,
+		"logs": logsCommand,
 		"shake": shakeCommand,
+		"reap": reapCommand,
+		"update-all": updateAllCommand,
+		"coverage": coverageCommand,
+		"rebuild-plan": rebuildPlanCommand,
+		"compare": compareCommand,
+		"doctor": doctorCommand,
+		"history": historyCommand,
+		"daemon": daemonCommand,
 	}[command]
 
 	if fn == nil {
@@ -138,7 +198,26 @@ type commandInfo struct {
 
 
 func (ci commandInfo) getArgs(minNeeded, maxNeeded int) []string {
-	args := ci.cab.ParseArgsSetFlags(flag.Args())
+	return ci.parseArgs(flag.Args(), minNeeded, maxNeeded)
+}
+
+
+// Like getArgs, but returns separately any arguments following "--" without parsing them
+func (ci commandInfo) getArgsAndTrailer(minNeeded, maxNeeded int) ([]string, []string) {
+	args := flag.Args()
+	var trailer []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, trailer = args[:i], args[i+1:]
+			break
+		}
+	}
+	return ci.parseArgs(args, minNeeded, maxNeeded), trailer
+}
+
+
+func (ci commandInfo) parseArgs(args []string, minNeeded, maxNeeded int) []string {
+	args = ci.cab.ParseArgsSetFlags(args)
 	if len(args) < minNeeded {
 		fatal("Not enough command-line arguments (need %d)", minNeeded)
 	}
@@ -148,7 +227,17 @@ func (ci commandInfo) getArgs(minNeeded, maxNeeded int) []string {
 	for len(args) < maxNeeded {
 		args = append(args, "")
 	}
+	if ci.cab.Opts.Script && fs.ScriptWriter == nil {
+		ci.cab.Opts.Pretend = true
+		fs.MessageWriter = os.Stderr
+		fs.StartScript(os.Stdout)
+	}
 	fs.WriteOK = fs.MakePretender(ci.cab.Opts.Pretend, ci.cab.Opts.Debug, debugPrintf)
+	if ci.cab.Opts.Pretend {
+		if err := fs.SimulateMounts(); nil != err {
+			fatal("%s reading mount table", err)
+		}
+	}
 	return args
 }
 
@@ -162,27 +251,18 @@ func (ci commandInfo) failOnMissingBaseSetup() {
 }
 
 
-func (ci commandInfo) getLayers() (*manage.Layerdefs, fs.InUseLayerMap) {
-	ci.failOnMissingBaseSetup()
-	layers, err := manage.FindLayers(ci.cfg, ci.cab.Opts)
-	if nil != err {
-		fatal(err.Error())
-	}
-	inuse, err := fs.FindLayerUsers(ci.cfg.Layerdirs)
-	if nil != err {
-		fatal("%s finding users in buildroot", err)
-	}
-	err = layers.ProbeAllLayerstate(inuse)
-	if nil != err {
-		fatal("%s probing layers", err)
-	}
-	return layers, inuse
+// Returns a manager using the messaging and pretending set up by getArgs.  Commands work on
+// layers through its methods, which take the lock for those which change layers.  The chroot
+// and exec commands take the lock only while mounting, and the shell command not at all, since
+// their sessions may last indefinitely.
+func (ci commandInfo) manager() *manage.Manager {
+	mgr := manage.NewManager(ci.cfg, ci.cab.Opts)
+	mgr.Logger = fs.MessageWriter
+	mgr.Pretender = fs.WriteOK
+	return mgr
 }
 
 
-
-
-
 func initCommand(cmdinfo commandInfo) {
 	cmdinfo.getArgs(0, 0)
 	err := manage.InitLayercakeBase(cmdinfo.cfg)
@@ -205,45 +285,113 @@ func statusCommand(cmdinfo commandInfo) {
 	warnIfNotRoot()
 
 	name := args[0]
-	layers, inuse := cmdinfo.getLayers()
-	layer := layers.Layer(name)
-	if layer == nil {
-		fatal("Layer %s not found", name)
+	err := cmdinfo.manager().View(context.Background(), func (layers *manage.Layerdefs) error {
+		return showStatus(cmdinfo, layers, name)
+	})
+	if nil != err {
+		fatal(err.Error())
+	}
+}
+
+
+// Reports on the named layer for the status command
+func showStatus(cmdinfo commandInfo, layers *manage.Layerdefs, name string) error {
+	status, err := layers.Status(name)
+	if nil != err {
+		return err
 	}
-	if len(layer.Base) > 0 {
-		fmt.Printf("Layer: %s\nParent layer: %s\n", name, layer.Base)
+	if len(status.Base) > 0 {
+		fmt.Printf("Layer: %s\nParent layer: %s\n", name, status.Base)
 	} else {
 		fmt.Printf("Base layer: %s\n", name)
 	}
-	info := layers.DescribeMounts(layer, true)
-	fmt.Printf("State: %s\n", info[0])
-	fmt.Println("Usage: " + layer.DescribeUsage())
+	fmt.Printf("State: %s\n", status.StateDescription)
+	fmt.Println("Usage: " + status.Usage)
+	if status.Stale {
+		fmt.Println("Stale: a lower layer changed since this layer was mounted; run shake")
+	}
+	if len(status.Namespaces) > 0 || len(status.Hostname) > 0 {
+		isolation := []string{}
+		if len(status.Namespaces) > 0 {
+			isolation = append(isolation, "namespaces " + strings.Join(status.Namespaces, ", "))
+		}
+		if len(status.Hostname) > 0 {
+			isolation = append(isolation, "hostname " + status.Hostname)
+		}
+		fmt.Println("Isolation: " + strings.Join(isolation, "; "))
+	}
+	if len(status.Personality) > 0 {
+		fmt.Println("Personality: " + status.Personality)
+	}
+	if len(status.EmulatedArch) > 0 {
+		fmt.Printf("Emulation: %s programs run by %s\n", status.EmulatedArch,
+			status.Interpreter)
+	}
 
-	if len(info) > 1 {
+	mounts := describeMounts(status)
+	if len(status.Messages) > 0 || len(mounts) > 0 {
 		fmt.Println("")
-		for _, line := range info[1:] {
+		for _, line := range status.Messages {
 			fmt.Println(line)
 		}
+		if len(mounts) > 0 {
+			fmt.Println("Current mounts:")
+			fmt.Println(strings.Join(mounts, "\n"))
+		}
+	}
+	if cmdinfo.cab.Opts.Verbose {
+		env, err := layers.ChrootEnvironment(name)
+		if nil != err {
+			return err
+		}
+		fmt.Println("\nChroot environment:")
+		for _, setting := range env {
+			fmt.Println("  " + setting)
+		}
 	}
-	if procs := inuse[name]; procs != nil {
+	if len(status.Users) > 0 {
 		fmt.Println("\nProcesses active in this layer")
 		tbl := fns.NewAdaptiveTable(" l    l")
 		tbl.SetLabels("Command (PID)", "Details")
-		layers.DescribeUsers(procs, tbl)
+		layers.DescribeUsers(status.Users, tbl)
 		tbl.Flush()
 	}
+	dups, err := layers.FindVdbDuplicates(name)
+	if nil != err {
+		return err
+	}
+	if len(dups) > 0 {
+		numStale := 0
+		fmt.Println("\nPackages with more than one entry in a slot")
+		tbl := fns.NewAdaptiveTable(" l   l   l   l")
+		tbl.SetLabels("Package", "Slot", "Installed", "Stale")
+		for _, dup := range dups {
+			numStale += len(dup.Stale)
+			tbl.Print(dup.Package, dup.Slot, strings.Join(dup.Versions, " "),
+				strings.Join(dup.Stale, " "))
+		}
+		tbl.Flush()
+		if numStale > 0 {
+			fmt.Printf("Use 'doctor %s -fix' to remove %d stale entries\n", name, numStale)
+		}
+	}
+	return nil
 }
 
 
 func listCommand(cmdinfo commandInfo) {
 	cmdinfo.getArgs(0, 0)
-	layers, _ := cmdinfo.getLayers()
-	llist := layers.Layers()
+	cmdinfo.failOnMissingBaseSetup()
+	llist, err := cmdinfo.manager().List(context.Background())
+	if nil != err {
+		fatal(err.Error())
+	}
 	if len(llist) < 1 {
 		fmt.Println("No layers found")
 		return
 	}
 	warnIfNotRoot()
+	verbose := cmdinfo.cab.Opts.Verbose
 	tbl := fns.NewAdaptiveTable("   l    l   c   l")
 	tbl.SetLabels("Layer", "Parent", "Usage", "Setup State")
 	for _, layer := range llist {
@@ -259,19 +407,121 @@ func listCommand(cmdinfo commandInfo) {
 		} else if layer.MountBusy || layer.NonMountBusy || layer.Overlain {
 			more = append(more, "busy")
 		}
-		tbl.Print(layer.Name, basespec, strings.Join(more, ", "),
-			layers.DescribeMounts(layer, cmdinfo.cab.Opts.Verbose))
+		if layer.Stale {
+			more = append(more, "stale")
+		}
+		state := []string{layer.StateDescription}
+		if verbose {
+			state = append(state, layer.Messages...)
+			mounts := describeMounts(layer)
+			if len(mounts) > 0 {
+				state = append(append(state, "Current mounts:"), mounts...)
+			}
+		}
+		tbl.Print(layer.Name, basespec, strings.Join(more, ", "), state)
 	}
 	tbl.Flush()
 }
 
 
+func describeMounts(status *manage.LayerStatus) []string {
+	out := []string{}
+	if len(status.RequiredMounts) > 0 {
+		out = append(out, "  required: " + strings.Join(status.RequiredMounts, ", "))
+	}
+	if status.Overlayfs {
+		out = append(out, "  overlayfs")
+	}
+	for _, mnt := range status.OtherMounts {
+		out = append(out, "  " + mnt)
+	}
+	return out
+}
+
+
 func addCommand(cmdinfo commandInfo) {
 	var configFile string
 	cmdinfo.cab.AddSwitch("configfile", &configFile)
 	args := cmdinfo.getArgs(1, 2)
-	layers, _ := cmdinfo.getLayers()
-	err := layers.AddLayer(args[0], args[1], configFile)
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().Add(context.Background(), args[0], args[1], configFile)
+	if nil != err {
+		fatal(err.Error())
+	}
+}
+
+
+func bootstrapCommand(cmdinfo commandInfo) {
+	var digestsFile string
+	cmdinfo.cab.AddSwitch("digests", &digestsFile)
+	args := cmdinfo.getArgs(2, 2)
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().Bootstrap(context.Background(), args[0], args[1], digestsFile)
+	if nil != err {
+		fatal(err.Error())
+	}
+}
+
+
+func exportTarCommand(cmdinfo commandInfo) {
+	var outputFile string
+	cmdinfo.cab.AddSwitch("o", &outputFile)
+	args := cmdinfo.getArgs(1, 1)
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().ExportLayer(context.Background(), args[0], outputFile)
+	if nil != err {
+		fatal(err.Error())
+	}
+}
+
+
+func importTarCommand(cmdinfo commandInfo) {
+	var base string
+	cmdinfo.cab.AddSwitch("base", &base)
+	args := cmdinfo.getArgs(1, 2)
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().ImportLayer(context.Background(), args[0], args[1], base)
+	if nil != err {
+		fatal(err.Error())
+	}
+}
+
+
+func applyCommand(cmdinfo commandInfo) {
+	args := cmdinfo.getArgs(0, 1)
+	cmdinfo.failOnMissingBaseSetup()
+	filename := args[0]
+	if len(filename) == 0 {
+		filename = path.Join(cmdinfo.cfg.Basepath, defaults.SiteManifestFile)
+	}
+	steps, err := cmdinfo.manager().ApplyManifest(context.Background(), filename)
+	if len(steps) == 0 && nil == err {
+		fmt.Println("Layers match the manifest")
+		return
+	}
+	if len(steps) > 0 {
+		tbl := fns.NewAdaptiveTable("l   l   l")
+		tbl.SetLabels("Action", "Layer", "Details")
+		for _, step := range steps {
+			tbl.Print(step.Description(), step.Layer, step.Details)
+		}
+		tbl.Flush()
+	}
+	if nil != err {
+		fatal(err.Error())
+	}
+}
+
+
+func manifestCommand(cmdinfo commandInfo) {
+	var outputFile string
+	cmdinfo.cab.AddSwitch("o", &outputFile)
+	args := cmdinfo.getArgs(1, 1)
+	if args[0] != "dump" {
+		fatal("Unknown manifest subcommand %s", args[0])
+	}
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().WriteManifest(context.Background(), outputFile)
 	if nil != err {
 		fatal(err.Error())
 	}
@@ -282,8 +532,8 @@ func removeCommand(cmdinfo commandInfo) {
 	var removeFiles bool
 	cmdinfo.cab.AddSwitch("files", &removeFiles)
 	args := cmdinfo.getArgs(1, 1)
-	layers, _ := cmdinfo.getLayers()
-	err := layers.RemoveLayer(args[0], removeFiles)
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().Remove(context.Background(), args[0], removeFiles)
 	if nil != err {
 		fatal(err.Error())
 	}
@@ -292,8 +542,8 @@ func removeCommand(cmdinfo commandInfo) {
 
 func renameCommand(cmdinfo commandInfo) {
 	args := cmdinfo.getArgs(2, 2)
-	layers, _ := cmdinfo.getLayers()
-	err := layers.RenameLayer(args[0], args[1])
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().Rename(context.Background(), args[0], args[1])
 	if nil != err {
 		fatal(err.Error())
 	}
@@ -302,8 +552,8 @@ func renameCommand(cmdinfo commandInfo) {
 
 func rebaseCommand(cmdinfo commandInfo) {
 	args := cmdinfo.getArgs(1, 2)
-	layers, _ := cmdinfo.getLayers()
-	err := layers.RebaseLayer(args[0], args[1])
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().Rebase(context.Background(), args[0], args[1])
 	if nil != err {
 		fatal(err.Error())
 	}
@@ -312,8 +562,8 @@ func rebaseCommand(cmdinfo commandInfo) {
 
 func shellCommand(cmdinfo commandInfo) {
 	args := cmdinfo.getArgs(1, 1)
-	layers, _ := cmdinfo.getLayers()
-	err := layers.Shell(args[0])
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().Shell(context.Background(), args[0])
 	if nil != err {
 		fatal(err.Error())
 	}
@@ -322,8 +572,8 @@ func shellCommand(cmdinfo commandInfo) {
 
 func mkdirsCommand(cmdinfo commandInfo) {
 	args := cmdinfo.getArgs(1, 1)
-	layers, _ := cmdinfo.getLayers()
-	err := layers.Makedirs(args[0])
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().Makedirs(context.Background(), args[0])
 	if nil != err {
 		fatal(err.Error())
 	}
@@ -332,8 +582,8 @@ func mkdirsCommand(cmdinfo commandInfo) {
 
 func mountCommand(cmdinfo commandInfo) {
 	args := cmdinfo.getArgs(1, 1)
-	layers, _ := cmdinfo.getLayers()
-	err := layers.Mount(args[0])
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().Mount(context.Background(), args[0])
 	if nil != err {
 		fatal(err.Error())
 	}
@@ -344,8 +594,14 @@ func unmountCommand(cmdinfo commandInfo) {
 	var all bool
 	cmdinfo.cab.AddSwitch("all", &all)
 	args := cmdinfo.getArgs(0, 1)
-	layers, _ := cmdinfo.getLayers()
-	err := layers.Unmount(args[0], all)
+	if len(args[0]) > 0 && all {
+		fatal("Cannot specify unmount of a specific layer and also all layers")
+	}
+	if len(args[0]) == 0 && !all {
+		fatal("Must specify a layer to unmount or -all switch")
+	}
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().Unmount(context.Background(), args[0])
 	if nil != err {
 		fatal(err.Error())
 	}
@@ -353,26 +609,315 @@ func unmountCommand(cmdinfo commandInfo) {
 
 
 func chrootCommand(cmdinfo commandInfo) {
+	var session manage.Session
+	cmdinfo.cab.AddSwitch("user", &session.User)
+	cmdinfo.cab.AddSwitch("login", &session.Login)
+	cmdinfo.cab.AddSwitch("readonly", &session.ReadOnly)
 	args := cmdinfo.getArgs(1, 1)
-	layers, _ := cmdinfo.getLayers()
-	err := layers.Chroot(args[0])
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().Chroot(context.Background(), args[0], session)
 	if nil != err {
 		fatal(err.Error())
 	}
 }
 
 
+func execCommand(cmdinfo commandInfo) {
+	var session manage.Session
+	cmdinfo.cab.AddSwitch("user", &session.User)
+	cmdinfo.cab.AddSwitch("login", &session.Login)
+	cmdinfo.cab.AddSwitch("readonly", &session.ReadOnly)
+	args, command := cmdinfo.getArgsAndTrailer(1, 1)
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().Exec(context.Background(), args[0], command, session)
+	if nil != err {
+		fatal(err.Error())
+	}
+}
+
+
+func logsCommand(cmdinfo commandInfo) {
+	var follow bool
+	cmdinfo.cab.AddSwitch("follow", &follow)
+	args := cmdinfo.getArgs(1, 2)
+	cmdinfo.failOnMissingBaseSetup()
+	mgr := cmdinfo.manager()
+	if len(args[1]) > 0 || follow {
+		err := mgr.ShowSessionLog(context.Background(), args[0], args[1], follow, os.Stdout)
+		if nil != err {
+			fatal(err.Error())
+		}
+		return
+	}
+	logs, err := mgr.SessionLogs(context.Background(), args[0])
+	if nil != err {
+		fatal(err.Error())
+	}
+	if len(logs) == 0 {
+		fmt.Printf("Layer %s has no session logs\n", args[0])
+		return
+	}
+	tbl := fns.NewAdaptiveTable(" l   r   l   l")
+	tbl.SetLabels("Log", "Size", "Outcome", "Command")
+	for _, log := range logs {
+		tbl.Print(strings.TrimSuffix(log.Name, ".log"), log.Size, log.Outcome, log.Command)
+	}
+	tbl.Flush()
+}
+
+
 func shakeCommand(cmdinfo commandInfo) {
-	layers, _ := cmdinfo.getLayers()
-	err := layers.Shake()
+	cmdinfo.getArgs(0, 0)
+	cmdinfo.failOnMissingBaseSetup()
+	err := cmdinfo.manager().Shake(context.Background())
 	if nil != err {
 		fatal(err.Error())
 	}
 }
 
 
+func updateAllCommand(cmdinfo commandInfo) {
+	_, extra := cmdinfo.getArgsAndTrailer(0, 0)
+	cmdinfo.failOnMissingBaseSetup()
+	command := append(strings.Fields(cmdinfo.cfg.UpdateCommand), extra...)
+	if len(command) == 0 {
+		fatal("No update command configured")
+	}
+	results, err := cmdinfo.manager().UpdateAll(context.Background(), command)
+	if nil != err {
+		fatal(err.Error())
+	}
+	if len(results) == 0 {
+		fmt.Println("No layers found")
+		return
+	}
+	failed := false
+	fmt.Println()
+	tbl := fns.NewAdaptiveTable("   l   l   r   l")
+	tbl.SetLabels("Layer", "Result", "Time", "Details")
+	for _, result := range results {
+		var elapsed, details string
+		if result.Result != manage.Update_skipped {
+			elapsed = result.Elapsed.String()
+		}
+		if result.Err != nil {
+			details = result.Err.Error()
+		}
+		failed = failed || result.Result == manage.Update_failed
+		tbl.Print(result.Layer, result.Description(), elapsed, details)
+	}
+	tbl.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
 
 
+func reapCommand(cmdinfo commandInfo) {
+	var idle time.Duration
+	cmdinfo.cab.AddSwitch("idle", &idle)
+	cmdinfo.getArgs(0, 0)
+	if idle <= 0 {
+		fatal("Must specify a positive -idle time, such as 2h")
+	}
+	cmdinfo.failOnMissingBaseSetup()
+	_, err := cmdinfo.manager().Reap(context.Background(), idle)
+	if nil != err {
+		fatal(err.Error())
+	}
+}
+
+
+func coverageCommand(cmdinfo commandInfo) {
+	args := cmdinfo.getArgs(2, 2)
+	cmdinfo.failOnMissingBaseSetup()
+	problems, err := cmdinfo.manager().CheckCoverage(context.Background(), args[0], args[1])
+	if nil != err {
+		fatal(err.Error())
+	}
+	if len(problems) == 0 {
+		fmt.Printf("Layer %s covers all installed packages of target\n", args[0])
+		return
+	}
+	tbl := fns.NewAdaptiveTable("l   l   l")
+	tbl.SetLabels("Package", "Problem", "Details")
+	for _, problem := range problems {
+		tbl.Print(problem.Package, problem.Description(), problem.Details)
+	}
+	tbl.Flush()
+	fatal("%d problem(s) found", len(problems))
+}
+
+
+func rebuildPlanCommand(cmdinfo commandInfo) {
+	args := cmdinfo.getArgs(1, 1)
+	cmdinfo.failOnMissingBaseSetup()
+	items, err := cmdinfo.manager().PlanRebuild(context.Background(), args[0])
+	if nil != err {
+		fatal(err.Error())
+	}
+	if len(items) == 0 {
+		fmt.Printf("Layer %s needs no rebuilds\n", args[0])
+		return
+	}
+	numPending := 0
+	tbl := fns.NewAdaptiveTable("l   l   l")
+	tbl.SetLabels("Package", "USE changes", "Status")
+	for _, item := range items {
+		status := "rebuild"
+		if item.Rebuilt {
+			status = "already rebuilt"
+		} else {
+			numPending++
+		}
+		tbl.Print(item.Package, item.Changes, status)
+	}
+	tbl.Flush()
+	fmt.Printf("%d of %d package(s) still to rebuild\n", numPending, len(items))
+}
+
+
+func doctorCommand(cmdinfo commandInfo) {
+	var fix bool
+	cmdinfo.cab.AddSwitch("fix", &fix)
+	args := cmdinfo.getArgs(0, 1)
+	cmdinfo.failOnMissingBaseSetup()
+	warnIfNotRoot()
+	mgr := cmdinfo.manager()
+	problems, err := mgr.Diagnose(context.Background(), args[0])
+	if nil != err {
+		fatal(err.Error())
+	}
+	if len(problems) == 0 {
+		fmt.Println("No problems found")
+		return
+	}
+	numFixable := 0
+	tbl := fns.NewAdaptiveTable("l   l   l")
+	tbl.SetLabels("Layer", "Problem", "Details")
+	for _, problem := range problems {
+		if problem.Fixable {
+			numFixable++
+		}
+		tbl.Print(problem.Layer, problem.Problem, problem.Details)
+	}
+	tbl.Flush()
+	if numFixable == 0 {
+		fatal("%d problem(s) found", len(problems))
+	}
+	if !fix {
+		fatal("%d problem(s) found; use -fix to repair %d of them", len(problems), numFixable)
+	}
+	repaired, err := mgr.Repair(context.Background(), args[0])
+	if nil != err {
+		fatal(err.Error())
+	}
+	fmt.Printf("%d repair(s) made\n", repaired)
+	if numFixable < len(problems) {
+		fatal("%d problem(s) not repairable", len(problems) - numFixable)
+	}
+}
+
+
+func compareCommand(cmdinfo commandInfo) {
+	var asJSON bool
+	cmdinfo.cab.AddSwitch("json", &asJSON)
+	args := cmdinfo.getArgs(2, 2)
+	cmdinfo.failOnMissingBaseSetup()
+	diffs, err := cmdinfo.manager().CompareLayers(context.Background(), args[0],
+		args[1])
+	if nil != err {
+		fatal(err.Error())
+	}
+	if asJSON {
+		type jsonDifference struct {
+			Package string `json:"package"`
+			Slot string `json:"slot"`
+			Difference string `json:"difference"`
+			A string `json:"a,omitempty"`
+			B string `json:"b,omitempty"`
+			UseChanges []string `json:"use_changes,omitempty"`
+		}
+		out := []jsonDifference{}
+		for _, diff := range diffs {
+			out = append(out, jsonDifference{diff.Package, diff.Slot, diff.Description(),
+				diff.A, diff.B, diff.UseChanges})
+		}
+		blob, err := json.MarshalIndent(out, "", "  ")
+		if nil != err {
+			fatal(err.Error())
+		}
+		fmt.Println(string(blob))
+		return
+	}
+	if len(diffs) == 0 {
+		fmt.Printf("Layers %s and %s have the same installed packages\n", args[0], args[1])
+		return
+	}
+	tbl := fns.NewAdaptiveTable("l   l   l   l   l")
+	tbl.SetLabels("Package", "Slot", args[0], args[1], "Difference")
+	for _, diff := range diffs {
+		description := diff.Description()
+		if diff.Kind == manage.Difference_use {
+			description = strings.Join(diff.UseChanges, " ")
+		}
+		tbl.Print(diff.Package, diff.Slot, diff.A, diff.B, description)
+	}
+	tbl.Flush()
+}
+
+
+func historyCommand(cmdinfo commandInfo) {
+	args := cmdinfo.getArgs(0, 1)
+	cmdinfo.failOnMissingBaseSetup()
+	entries, err := manage.ReadAuditLog(cmdinfo.cfg, args[0])
+	if nil != err {
+		fatal(err.Error())
+	}
+	if len(entries) == 0 {
+		fmt.Println("No actions recorded")
+		return
+	}
+	var last manage.AuditEntry
+	for _, entry := range entries {
+		if entry.Pid != last.Pid || entry.Command != last.Command {
+			fmt.Printf("%s  %s  %s\n", entry.Time.Format("2006-01-02 15:04:05"), entry.User,
+				entry.Command)
+		}
+		result := ""
+		if entry.Result != "ok" {
+			result = "  FAILED: " + entry.Result
+		}
+		fmt.Printf("    %s%s\n", entry.Action, result)
+		last = entry
+	}
+}
+
+
+
+
+
+func daemonCommand(cmdinfo commandInfo) {
+	socket, group := cmdinfo.cfg.DaemonSocket, cmdinfo.cfg.DaemonGroup
+	cmdinfo.cab.AddSwitch("socket", &socket)
+	cmdinfo.cab.AddSwitch("group", &group)
+	cmdinfo.getArgs(0, 0)
+	cmdinfo.failOnMissingBaseSetup()
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func () {
+		<-signals
+		cancel()
+	}()
+	server := daemon.NewServer(cmdinfo.manager(), socket, group)
+	fmt.Fprintf(os.Stderr, "Listening on %s\n", socket)
+	err := server.ListenAndServe(ctx)
+	if nil != err {
+		fatal(err.Error())
+	}
+}
+
 
 func warnIfNotRoot() {
 	if !fs.UserIsRoot() {
@@ -389,6 +934,5 @@ func fatal(base string, params...interface{}) {
 
 
 func debugPrintf(base string, params...interface{}) {
-	fmt.Printf(base + "\n", params...)
+	fs.Printf(base + "\n", params...)
 }
-
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"path"
 	"strings"
+	"strconv"
 
 	"potano.layercake/fs"
 	"potano.layercake/defaults"
@@ -28,6 +29,11 @@ type ConfigType struct {
 	ExportGeneratedir string
 	LayerExportDirs map[string]string
 	ChrootExec string
+	DaemonSocket string
+	DaemonGroup string
+	UpdateCommand string
+	LogRetention int
+	EnvAllow string
 }
 
 
@@ -52,6 +58,11 @@ const (
 	cfKey_exportpkgdir
 	cfKey_exportgendir
 	cfKey_chrootexec
+	cfKey_daemonsocket
+	cfKey_daemongroup
+	cfKey_updatecommand
+	cfKey_logretention
+	cfKey_envallow
 )
 
 
@@ -78,6 +89,11 @@ var settingSetup = []cfsetup {
 	cfsetup{cfKey_exportpkgdir, ss_value, 0, defaults.Pkgdir, "EXPORT_BINPKGS"},
 	cfsetup{cfKey_exportgendir, ss_value, 0, defaults.Generateddir, "EXPORT_GENERATED_FILES"},
 	cfsetup{cfKey_chrootexec, ss_file, 0, defaults.ChrootExec, "CHROOT_EXEC"},
+	cfsetup{cfKey_daemonsocket, ss_file, cfKey_basepath, defaults.DaemonSocket, "DAEMON_SOCKET"},
+	cfsetup{cfKey_daemongroup, ss_value, 0, defaults.DaemonGroup, "DAEMON_GROUP"},
+	cfsetup{cfKey_updatecommand, ss_value, 0, defaults.UpdateCommand, "UPDATE_COMMAND"},
+	cfsetup{cfKey_logretention, ss_value, 0, defaults.LogRetention, "LOG_RETENTION"},
+	cfsetup{cfKey_envallow, ss_value, 0, defaults.ChrootEnvAllow, "ENV_ALLOW"},
 }
 
 
@@ -175,6 +191,11 @@ func Load(configfile string, basepath string) (*ConfigType, error) {
 	if err := patchPaths(setup); err != nil {
 		return nil, err
 	}
+	logRetention, err := strconv.Atoi(setup[cfKey_logretention])
+	if err != nil || logRetention < 0 {
+		return nil, fmt.Errorf("LOG_RETENTION must be a number of logs, not '%s'",
+			setup[cfKey_logretention])
+	}
 
 	cfg := &ConfigType{
 		Basepath: setup[cfKey_basepath],
@@ -188,6 +209,11 @@ func Load(configfile string, basepath string) (*ConfigType, error) {
 		ExportBinPkgdir: setup[cfKey_exportpkgdir],
 		ExportGeneratedir: setup[cfKey_exportgendir],
 		ChrootExec: setup[cfKey_chrootexec],
+		DaemonSocket: setup[cfKey_daemonsocket],
+		DaemonGroup: setup[cfKey_daemongroup],
+		UpdateCommand: setup[cfKey_updatecommand],
+		LogRetention: logRetention,
+		EnvAllow: setup[cfKey_envallow],
 	}
 	return cfg, nil
 }
@@ -5,11 +5,13 @@ package config
 
 import (
 	"flag"
+	"time"
 )
 
 
 type Opts struct {
-	Verbose, Pretend, Debug, Force bool
+	Verbose, Pretend, Debug, Force, Script bool
+	Wait time.Duration
 }
 
 
@@ -32,6 +34,8 @@ func NewCommandArgBuilder() *CommandArgBuilder {
 	cab.AddSwitch("p", &cab.Opts.Pretend)
 	cab.AddSwitch("debug", &cab.Opts.Debug)
 	cab.AddSwitch("force", &cab.Opts.Force)
+	cab.AddSwitch("script", &cab.Opts.Script)
+	cab.AddSwitch("wait", &cab.Opts.Wait)
 	return cab
 }
 
@@ -50,6 +54,9 @@ func (cab *CommandArgBuilder) AddFlagsToFlagset(flgs *flag.FlagSet) {
 		case *string:
 			sp := sw.pt.(*string)
 			flgs.StringVar(sp, sw.name, *sp, "")
+		case *time.Duration:
+			dp := sw.pt.(*time.Duration)
+			flgs.DurationVar(dp, sw.name, *dp, "")
 		}
 	}
 	if cab.Usage != nil {
@@ -9,6 +9,7 @@ import (
 	"path"
 	"errors"
 	"strings"
+	"strconv"
 	"io/ioutil"
 	"potano.layercake/fns"
 	"potano.layercake/defaults"
@@ -195,6 +196,25 @@ func compareConfigType(expt, have *ConfigType) error {
 		return fmt.Errorf("expected ChrootExec=%s, got %s", expt.ChrootExec,
 			have.ChrootExec)
 	}
+	if expt.DaemonSocket != have.DaemonSocket {
+		return fmt.Errorf("expected DaemonSocket=%s, got %s", expt.DaemonSocket,
+			have.DaemonSocket)
+	}
+	if expt.DaemonGroup != have.DaemonGroup {
+		return fmt.Errorf("expected DaemonGroup=%s, got %s", expt.DaemonGroup,
+			have.DaemonGroup)
+	}
+	if expt.UpdateCommand != have.UpdateCommand {
+		return fmt.Errorf("expected UpdateCommand=%s, got %s", expt.UpdateCommand,
+			have.UpdateCommand)
+	}
+	if expt.LogRetention != have.LogRetention {
+		return fmt.Errorf("expected LogRetention=%d, got %d", expt.LogRetention,
+			have.LogRetention)
+	}
+	if expt.EnvAllow != have.EnvAllow {
+		return fmt.Errorf("expected EnvAllow=%s, got %s", expt.EnvAllow, have.EnvAllow)
+	}
 	return nil
 }
 
@@ -250,6 +270,11 @@ func makeConfigTypeObj(m confTypeMap) *ConfigType {
 		LayerExportDirs: map[string]string{"builds": "builds", "generated": "generated",
 			"packages": "packages"},
 		ChrootExec: defaults.ChrootExec,
+		DaemonSocket: defaults.DaemonSocket,
+		DaemonGroup: defaults.DaemonGroup,
+		UpdateCommand: defaults.UpdateCommand,
+		LogRetention: 20,
+		EnvAllow: defaults.ChrootEnvAllow,
 	}
 	if m != nil {
 		for key, value := range m {
@@ -277,6 +302,16 @@ func makeConfigTypeObj(m confTypeMap) *ConfigType {
 				obj.ExportGeneratedir = stringVal
 			case cfKey_chrootexec:
 				obj.ChrootExec = stringVal
+			case cfKey_daemonsocket:
+				obj.DaemonSocket = stringVal
+			case cfKey_daemongroup:
+				obj.DaemonGroup = stringVal
+			case cfKey_updatecommand:
+				obj.UpdateCommand = stringVal
+			case cfKey_logretention:
+				obj.LogRetention, _ = strconv.Atoi(stringVal)
+			case cfKey_envallow:
+				obj.EnvAllow = stringVal
 			}
 		}
 	}
@@ -0,0 +1,492 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+// Package daemon serves layer operations to local clients over a Unix socket.  Requests and
+// responses are JSON over HTTP:
+//
+//   GET  /layers                 list of layer statuses
+//   GET  /layers/<name>          status of one layer
+//   POST /layers/<name>/mount    mount the layer
+//   POST /layers/<name>/unmount  unmount the layer
+//   POST /layers/<name>/exec     run {"command": [...]} in the layer; returns its output
+//   POST /lock[?wait=<duration>][&lease=<duration>]
+//                                take the base-directory lock for a series of requests
+//   POST /unlock                 release it
+//
+// While a client holds the lock, state-changing requests must carry the token returned by
+// /lock in the X-Layercake-Lock header.  The lock is released if the lease runs out before the
+// client makes another request with the token, so that a client which goes away without
+// unlocking does not keep the lock.
+package daemon
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"net"
+	"time"
+	"sync"
+	"bytes"
+	"errors"
+	"context"
+	"strings"
+	"os/exec"
+	"net/http"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+
+	"potano.layercake/manage"
+)
+
+
+const LockHeader = "X-Layercake-Lock"
+
+const DefaultLockLease = 5 * time.Minute
+
+
+type Server struct {
+	Manager *manage.Manager
+	Socket string
+	Group string
+	Log io.Writer
+
+	// Decides whether a client may make requests; by default root and members of Group
+	Authorize func (cred *Credentials) error
+
+	// How long a client's lock lasts after its latest request unless the client asks for
+	// another lease; DefaultLockLease if zero
+	LockLease time.Duration
+
+	lockMutex sync.Mutex
+	lockToken string
+	lockOwner uint32
+	lockLease time.Duration
+	lockTimer *time.Timer
+	lockSerial uint64
+}
+
+
+func NewServer(mgr *manage.Manager, socket, group string) *Server {
+	s := &Server{Manager: mgr, Socket: socket, Group: group, Log: os.Stderr}
+	s.Authorize = func (cred *Credentials) error {
+		return authorizeGroupMember(cred, s.Group)
+	}
+	return s
+}
+
+
+// Listens on the socket until the context is cancelled
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	listener, err := s.listen()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(s.Socket)
+	return s.Serve(ctx, listener)
+}
+
+
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	srv := &http.Server{
+		Handler: s.Handler(),
+		ConnContext: func (ctx context.Context, conn net.Conn) context.Context {
+			cred, err := peerCredentials(conn)
+			return context.WithValue(ctx, credentialsKey{}, credentialsResult{cred, err})
+		},
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func () {
+		select {
+		case <-ctx.Done():
+			srv.Close()
+		case <-done:
+		}
+	}()
+	err := srv.Serve(listener)
+	s.releaseLock()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+
+func (s *Server) listen() (net.Listener, error) {
+	if fi, err := os.Lstat(s.Socket); err == nil {
+		if fi.Mode() & os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", s.Socket)
+		}
+		if conn, err := net.Dial("unix", s.Socket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("a daemon is already listening on %s", s.Socket)
+		}
+		if err = os.Remove(s.Socket); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", s.Socket)
+	if err != nil {
+		return nil, err
+	}
+	err = setSocketGroup(s.Socket, s.Group)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/layers", s.handleLayers)
+	mux.HandleFunc("/layers/", s.handleLayers)
+	mux.HandleFunc("/lock", s.handleLock)
+	mux.HandleFunc("/unlock", s.handleUnlock)
+	return s.authorized(mux)
+}
+
+
+type credentialsKey struct{}
+
+type credentialsResult struct {
+	cred *Credentials
+	err error
+}
+
+
+func requestCredentials(r *http.Request) (*Credentials, error) {
+	res, ok := r.Context().Value(credentialsKey{}).(credentialsResult)
+	if !ok {
+		return nil, errors.New("peer credentials not available")
+	}
+	return res.cred, res.err
+}
+
+
+func (s *Server) authorized(next http.Handler) http.Handler {
+	return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+		cred, err := requestCredentials(r)
+		if err == nil {
+			err = s.Authorize(cred)
+		}
+		if err != nil {
+			s.logf(cred, r, http.StatusForbidden)
+			writeError(w, http.StatusForbidden, "forbidden", err.Error())
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		s.logf(cred, r, rec.status)
+	})
+}
+
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+
+func (s *Server) logf(cred *Credentials, r *http.Request, status int) {
+	if s.Log == nil {
+		return
+	}
+	who := "unknown"
+	if cred != nil {
+		who = fmt.Sprintf("uid=%d pid=%d", cred.Uid, cred.Pid)
+	}
+	fmt.Fprintf(s.Log, "%s %s %s %s %d\n", time.Now().Format(time.RFC3339), who, r.Method,
+		r.URL.Path, status)
+}
+
+
+type execRequest struct {
+	Command []string `json:"command"`
+	User string `json:"user,omitempty"`
+	Login bool `json:"login,omitempty"`
+	ReadOnly bool `json:"readonly,omitempty"`
+}
+
+type execResponse struct {
+	Output string `json:"output"`
+	ExitStatus int `json:"exit_status"`
+	Messages []string `json:"messages,omitempty"`
+}
+
+type resultResponse struct {
+	Messages []string `json:"messages,omitempty"`
+}
+
+type lockResponse struct {
+	Token string `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Kind string `json:"kind"`
+}
+
+
+func (s *Server) handleLayers(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/layers"), "/"), "/")
+	if len(parts[0]) == 0 {
+		parts = nil
+	}
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		list, err := s.Manager.List(r.Context())
+		if err != nil {
+			writeLayerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		status, err := s.Manager.Status(r.Context(), parts[0])
+		if err != nil {
+			writeLayerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		if !s.checkLockToken(w, r) {
+			return
+		}
+		s.handleLayerAction(w, r, parts[0], parts[1])
+	case len(parts) <= 2:
+		writeError(w, http.StatusMethodNotAllowed, "bad_request",
+			r.Method + " not allowed on " + r.URL.Path)
+	default:
+		writeError(w, http.StatusNotFound, "bad_request", "no such resource " + r.URL.Path)
+	}
+}
+
+
+func (s *Server) handleLayerAction(w http.ResponseWriter, r *http.Request, name, action string) {
+	var messages bytes.Buffer
+	mgr := *s.Manager
+	mgr.Logger = &messages
+	var err error
+	switch action {
+	case "mount":
+		err = mgr.Mount(r.Context(), name)
+	case "unmount":
+		err = mgr.Unmount(r.Context(), name)
+	case "exec":
+		var req execRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Command) == 0 {
+			writeError(w, http.StatusBadRequest, "bad_request",
+				"request body must be {\"command\": [...]} with a non-empty command")
+			return
+		}
+		var output []byte
+		output, err = mgr.ExecOutput(r.Context(), name, req.Command,
+			manage.Session{User: req.User, Login: req.Login, ReadOnly: req.ReadOnly})
+		resp := execResponse{Output: string(output), Messages: splitMessages(&messages)}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			resp.ExitStatus = exitErr.ExitCode()
+			err = nil
+		}
+		if err == nil {
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+	default:
+		writeError(w, http.StatusNotFound, "bad_request", "unknown action " + action)
+		return
+	}
+	if err != nil {
+		writeLayerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resultResponse{Messages: splitMessages(&messages)})
+}
+
+
+func (s *Server) handleLock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "bad_request", "use POST to take the lock")
+		return
+	}
+	wait, lease := time.Duration(0), s.LockLease
+	if lease <= 0 {
+		lease = DefaultLockLease
+	}
+	for _, param := range []struct {name string; value *time.Duration} {
+		{"wait", &wait}, {"lease", &lease},
+	} {
+		if str := r.URL.Query().Get(param.name); len(str) > 0 {
+			var err error
+			if *param.value, err = time.ParseDuration(str); err != nil {
+				writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+				return
+			}
+		}
+	}
+	if lease <= 0 {
+		writeError(w, http.StatusBadRequest, "bad_request", "lease must be positive")
+		return
+	}
+	cred, _ := requestCredentials(r)
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+	if len(s.lockToken) > 0 {
+		writeError(w, http.StatusConflict, "locked",
+			fmt.Sprintf("lock is already held by a client with uid %d", s.lockOwner))
+		return
+	}
+	if err := s.Manager.Hold(r.Context(), wait); err != nil {
+		writeError(w, http.StatusConflict, "locked", err.Error())
+		return
+	}
+	s.lockToken = newToken()
+	s.lockOwner = cred.Uid
+	s.lockLease = lease
+	s.renewLease()
+	writeJSON(w, http.StatusOK, lockResponse{s.lockToken, time.Now().Add(lease)})
+}
+
+
+func (s *Server) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "bad_request", "use POST to release the lock")
+		return
+	}
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+	if len(s.lockToken) == 0 || r.Header.Get(LockHeader) != s.lockToken {
+		writeError(w, http.StatusConflict, "locked", "request does not hold the lock")
+		return
+	}
+	s.endLease()
+	if err := s.Manager.Release(); err != nil {
+		writeError(w, http.StatusInternalServerError, "error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, resultResponse{})
+}
+
+
+// Refuses a state-changing request when another client holds the lock.  A request carrying the
+// token renews the holder's lease.
+func (s *Server) checkLockToken(w http.ResponseWriter, r *http.Request) bool {
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+	if len(s.lockToken) == 0 {
+		return true
+	}
+	if r.Header.Get(LockHeader) != s.lockToken {
+		writeError(w, http.StatusLocked, "locked",
+			fmt.Sprintf("layers are locked by a client with uid %d", s.lockOwner))
+		return false
+	}
+	s.renewLease()
+	return true
+}
+
+
+func (s *Server) releaseLock() {
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+	if len(s.lockToken) > 0 {
+		s.endLease()
+		s.Manager.Release()
+	}
+}
+
+
+// Starts the lease of the lock anew; call with lockMutex held
+func (s *Server) renewLease() {
+	if s.lockTimer != nil {
+		s.lockTimer.Stop()
+	}
+	s.lockSerial++
+	serial := s.lockSerial
+	s.lockTimer = time.AfterFunc(s.lockLease, func () {
+		s.expireLease(serial)
+	})
+}
+
+
+// Forgets the lock's token and lease; call with lockMutex held
+func (s *Server) endLease() {
+	if s.lockTimer != nil {
+		s.lockTimer.Stop()
+		s.lockTimer = nil
+	}
+	s.lockSerial++
+	s.lockToken = ""
+}
+
+
+// Releases the lock when its lease runs out, unless the lease was renewed or ended meanwhile
+func (s *Server) expireLease(serial uint64) {
+	s.lockMutex.Lock()
+	defer s.lockMutex.Unlock()
+	if serial != s.lockSerial || len(s.lockToken) == 0 {
+		return
+	}
+	if s.Log != nil {
+		fmt.Fprintf(s.Log, "%s lease of lock held by uid=%d ran out\n",
+			time.Now().Format(time.RFC3339), s.lockOwner)
+	}
+	s.endLease()
+	s.Manager.Release()
+}
+
+
+func newToken() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+
+func splitMessages(buf *bytes.Buffer) []string {
+	text := strings.TrimSpace(buf.String())
+	if len(text) == 0 {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+
+func writeError(w http.ResponseWriter, status int, kind, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg, Kind: kind})
+}
+
+
+func writeLayerError(w http.ResponseWriter, err error) {
+	for _, mapping := range []struct {
+		kind error
+		name string
+		status int
+	} {
+		{manage.ErrNotFound, "not_found", http.StatusNotFound},
+		{manage.ErrLayerBusy, "busy", http.StatusConflict},
+		{manage.ErrCycle, "cycle", http.StatusConflict},
+		{manage.ErrNotMountable, "not_mountable", http.StatusConflict},
+	} {
+		if errors.Is(err, mapping.kind) {
+			writeError(w, mapping.status, mapping.name, err.Error())
+			return
+		}
+	}
+	writeError(w, http.StatusInternalServerError, "error", err.Error())
+}
@@ -0,0 +1,193 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package daemon
+
+import (
+	"io"
+	"os"
+	"net"
+	"path"
+	"errors"
+	"time"
+	"context"
+	"sync/atomic"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+
+	"testing"
+	"potano.layercake/config"
+	"potano.layercake/fs"
+	"potano.layercake/manage"
+	"potano.layercake/defaults"
+)
+
+
+type testClient struct {
+	t *testing.T
+	http.Client
+}
+
+
+func newTestClient(t *testing.T, socket string) *testClient {
+	return &testClient{t, http.Client{
+		Transport: &http.Transport{
+			DialContext: func (ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}}
+}
+
+
+func (c *testClient) do(method, path, token, body string, want int, result interface{}) {
+	var reader io.Reader
+	if len(body) > 0 {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, "http://layercake" + path, reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if len(token) > 0 {
+		req.Header.Set(LockHeader, token)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %s", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != want {
+		c.t.Fatalf("%s %s: expected status %d, got %d: %s", method, path, want,
+			resp.StatusCode, data)
+	}
+	if result != nil {
+		if err = json.Unmarshal(data, result); err != nil {
+			c.t.Fatalf("%s %s: %s decoding %s", method, path, err, data)
+		}
+	}
+}
+
+
+func TestDaemon(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "layercake_daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	cfg, err := config.Load("/dev/null", path.Join(tmpdir, "/var/lib/layercake"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = manage.InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	mgr := manage.NewManager(cfg, &config.Opts{})
+	for _, def := range []struct {name, base string} {
+		{"base", ""}, {"derived", "base"},
+	} {
+		if err = mgr.Add(ctx, def.name, def.base, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	socket := path.Join(tmpdir, "layercake.sock")
+	server := NewServer(mgr, socket, "nosuchgroup")
+	server.Log = nil
+	var refuse int32
+	server.Authorize = func (cred *Credentials) error {
+		if cred.Pid != int32(os.Getpid()) {
+			return errors.New("unexpected peer")
+		}
+		if atomic.LoadInt32(&refuse) != 0 {
+			return errors.New("refused")
+		}
+		return nil
+	}
+	served := make(chan error)
+	listener, err := server.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func () {
+		served <- server.Serve(ctx, listener)
+	}()
+	client := newTestClient(t, socket)
+
+	var list []manage.LayerStatus
+	client.do("GET", "/layers", "", "", http.StatusOK, &list)
+	if len(list) != 2 || list[1].Name != "derived" || list[1].Base != "base" {
+		t.Fatalf("unexpected layer list %#v", list)
+	}
+	var status manage.LayerStatus
+	client.do("GET", "/layers/derived", "", "", http.StatusOK, &status)
+	if status.Name != "derived" || status.Usage != "idle" {
+		t.Fatalf("unexpected status %#v", status)
+	}
+
+	var failure errorResponse
+	client.do("GET", "/layers/nosuch", "", "", http.StatusNotFound, &failure)
+	if failure.Kind != "not_found" {
+		t.Errorf("expected not_found, got %#v", failure)
+	}
+	client.do("POST", "/layers/derived/mount", "", "", http.StatusConflict, &failure)
+	if failure.Kind != "not_mountable" {
+		t.Errorf("expected not_mountable, got %#v", failure)
+	}
+	client.do("POST", "/layers/derived/exec", "", "{}", http.StatusBadRequest, nil)
+	client.do("POST", "/layers/derived/rename", "", "", http.StatusNotFound, nil)
+
+	var lock lockResponse
+	client.do("POST", "/lock", "", "", http.StatusOK, &lock)
+	if len(lock.Token) == 0 {
+		t.Fatal("no lock token returned")
+	}
+	client.do("POST", "/lock", "", "", http.StatusConflict, nil)
+	if _, err = fs.LockFile(path.Join(cfg.Basepath, defaults.LockFile), 0); err == nil {
+		t.Fatal("base directory not locked while daemon client holds lock")
+	}
+	client.do("POST", "/layers/derived/unmount", "", "", http.StatusLocked, nil)
+	client.do("POST", "/layers/derived/unmount", lock.Token, "", http.StatusInternalServerError,
+		&failure)
+	if failure.Error != "Layer derived was not mounted" {
+		t.Errorf("unexpected failure %#v", failure)
+	}
+	client.do("POST", "/unlock", "wrong", "", http.StatusConflict, nil)
+	client.do("POST", "/unlock", lock.Token, "", http.StatusOK, nil)
+	client.do("POST", "/layers/derived/unmount", "", "", http.StatusInternalServerError, nil)
+
+	// A client which goes away without unlocking loses the lock when its lease runs out
+	client.do("POST", "/lock?lease=300ms", "", "", http.StatusOK, &lock)
+	time.Sleep(200 * time.Millisecond)
+	client.do("POST", "/layers/derived/unmount", lock.Token, "", http.StatusInternalServerError,
+		nil)
+	time.Sleep(200 * time.Millisecond)
+	client.do("POST", "/layers/derived/unmount", "", "", http.StatusLocked, nil)
+	time.Sleep(300 * time.Millisecond)
+	client.do("POST", "/layers/derived/unmount", "", "", http.StatusInternalServerError, nil)
+	heldLock, err := fs.LockFile(path.Join(cfg.Basepath, defaults.LockFile), 0)
+	if err != nil {
+		t.Fatalf("base directory still locked after lease ran out: %s", err)
+	}
+	heldLock.Unlock()
+	client.do("POST", "/lock?lease=0s", "", "", http.StatusBadRequest, nil)
+
+	atomic.StoreInt32(&refuse, 1)
+	client.do("GET", "/layers", "", "", http.StatusForbidden, &failure)
+	if failure.Kind != "forbidden" {
+		t.Errorf("expected forbidden, got %#v", failure)
+	}
+
+	cancel()
+	if err = <-served; err != nil {
+		t.Errorf("Serve returned %s", err)
+	}
+	if _, err = server.listen(); err != nil {
+		t.Errorf("could not listen on socket left by previous server: %s", err)
+	}
+	os.Remove(socket)
+}
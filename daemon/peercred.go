@@ -0,0 +1,117 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package daemon
+
+import (
+	"os"
+	"fmt"
+	"net"
+	"strings"
+	"strconv"
+	"io/ioutil"
+	"syscall"
+	"os/user"
+)
+
+
+// Identity of the process at the other end of a connection
+type Credentials struct {
+	Pid int32
+	Uid, Gid uint32
+}
+
+
+func peerCredentials(conn net.Conn) (*Credentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("connection is not on a Unix socket")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func (fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET,
+			syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Credentials{Pid: ucred.Pid, Uid: ucred.Uid, Gid: ucred.Gid}, nil
+}
+
+
+// Admits root and members, primary or supplementary, of the named group
+func authorizeGroupMember(cred *Credentials, group string) error {
+	if cred.Uid == 0 {
+		return nil
+	}
+	grp, err := user.LookupGroup(group)
+	if err != nil {
+		return fmt.Errorf("uid %d refused: %s", cred.Uid, err)
+	}
+	if strconv.FormatUint(uint64(cred.Gid), 10) == grp.Gid {
+		return nil
+	}
+	usr, err := user.LookupId(strconv.FormatUint(uint64(cred.Uid), 10))
+	if err != nil {
+		return fmt.Errorf("uid %d refused: %s", cred.Uid, err)
+	}
+	gids, err := usr.GroupIds()
+	if err == nil {
+		for _, gid := range gids {
+			if gid == grp.Gid {
+				return nil
+			}
+		}
+	} else if listedInGroupFile("/etc/group", group, usr.Username) {
+		return nil
+	}
+	return fmt.Errorf("user %s is not a member of group %s", usr.Username, group)
+}
+
+
+// Without cgo, older Go releases cannot list a user's supplementary groups, so fall back to
+// looking at the member list in the group file
+func listedInGroupFile(filename, group, username string) bool {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) == 4 && fields[0] == group {
+			for _, member := range strings.Split(fields[3], ",") {
+				if member == username {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+
+// Lets members of the group connect to the socket.  A group which does not exist leaves the
+// socket usable by root only.
+func setSocketGroup(socket, group string) error {
+	err := os.Chmod(socket, 0660)
+	if err != nil {
+		return err
+	}
+	grp, err := user.LookupGroup(group)
+	if err != nil {
+		return nil
+	}
+	gid, err := strconv.Atoi(grp.Gid)
+	if err != nil {
+		return err
+	}
+	return os.Chown(socket, -1, gid)
+}
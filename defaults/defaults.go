@@ -17,13 +17,35 @@ const Upperdir = "overlayfs/upperdir"
 const Generateddir = "generated"
 const Exportdirs = "export"
 const ChrootExec = "/usr/bin/chroot"
+const DaemonSocket = "/run/layercake.sock"
+const DaemonGroup = "layercake"
+const UpdateCommand = "emerge --update --deep --newuse @world"
+const LogRetention = "20"
+const ChrootEnvAllow = "TERM COLORTERM TZ"
+const ChrootEnvironment = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin " +
+	"HOME=/root SHELL=/bin/bash USER=root LOGNAME=root"
+const TarExecutable = "tar"
+const B2sumExecutable = "b2sum"
+const HostResolvConf = "/etc/resolv.conf"
 
 const MountinfoPath = "/proc/self/mountinfo"
+const BinfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+const CpuinfoPath = "/proc/cpuinfo"
 const ShadowingFsTypes = "devtmpfs sysfs"
 
 const LayerconfigFile = "layerconfig"
+const GenerationFile = "generation"
+const LowerGenerationFile = "lower-generation"
+const ActivityFile = "activity"
+const EmulationPlaceholderFile = "emulation-placeholder"
+const SessionLogDir = "logs"
 const SkeletonLayerconfigFile = "default_layerconfig.skel"
 const SkeletonLayerconfigFileExt = ".skel"
+const SiteManifestFile = "manifest"
+const JournalFile = "journal"
+const LockFile = "lock"
+const AuditLogFile = "audit.log"
+const NewFileSuffix = "~new"
 const SkeletonLayerconfig =
 `import rbind /dev /dev
 import proc /proc /proc
@@ -32,9 +54,19 @@ import rbind /var/db/repos /var/db/repos
 import rbind /var/cache/distfiles /var/cache/distfiles
 import rbind $$base/{pkgdir} /var/cache/binpkgs`
 
+const PortageBinpkgDir = "/var/cache/binpkgs"
+const PortageDistDir = "/var/cache/distfiles"
+const PortageMakeGlobals = "/usr/share/portage/config/make.globals"
+const PortageMakeConf = "/etc/portage/make.conf"
+const PortageMakeProfile = "/etc/portage/make.profile"
+const PortagePackageUse = "/etc/portage/package.use"
+const PortageReposConf = "/etc/portage/repos.conf"
+const PortageDefaultReposConf = "/usr/share/portage/config/repos.conf"
+
 const MinimalBuildDirs = "bin etc lib opt root sbin usr"
 
 const RemovedLayerSuffix = "~removed"
+const ImportingLayerSuffix = "~importing"
 
 const ExportIndexHtmlName = "index.html"
 const ExportIndexHtml = `<!DOCTYPE html>
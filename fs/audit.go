@@ -0,0 +1,40 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package fs
+
+import (
+	"os"
+	"fmt"
+)
+
+
+// Receives each action carried out after WriteOK approves it, along with its outcome
+type AuditFn func (action string, err error)
+
+
+var Audit AuditFn
+
+
+func audited(err error, msg string, parms...interface{}) error {
+	if Audit != nil {
+		Audit(fmt.Sprintf(msg, parms...), err)
+	}
+	return err
+}
+
+
+// Appends text to a file, creating it if needed.  Not subject to WriteOK or Audit; meant for
+// recording actions rather than carrying them out.
+func AppendTextFile(filename, text string) error {
+	fh, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fh.WriteString(text)
+	closeErr := fh.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package fs
+
+import (
+	"os"
+	"fmt"
+)
+
+
+// Registers an interpreter for a binary format by writing its rule to binfmt_misc's register
+// file
+func RegisterBinfmt(registerFile, rule string) error {
+	if ScriptWriter != nil {
+		fmt.Fprintf(ScriptWriter, "printf '%%s\\n' %s > %s\n", ShellQuote(rule),
+			ShellQuote(registerFile))
+	}
+	if !WriteOK("register binfmt %s", rule) {
+		return nil
+	}
+	file, err := os.OpenFile(registerFile, os.O_WRONLY, 0)
+	if nil == err {
+		_, err = file.Write([]byte(rule))
+		if closeErr := file.Close(); nil == err {
+			err = closeErr
+		}
+	}
+	if nil != err {
+		err = fmt.Errorf("%s registering interpreter with binfmt_misc", err)
+	}
+	return audited(err, "register binfmt %s", rule)
+}
@@ -0,0 +1,150 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package fs
+
+import (
+	"io"
+	"fmt"
+	"os"
+	"os/exec"
+	"io/ioutil"
+	"strings"
+
+	"potano.layercake/defaults"
+)
+
+
+type decompressingReader struct {
+	io.Reader
+	fh *os.File
+	cmd *exec.Cmd
+}
+
+
+// Opens a possibly-compressed file for reading.  The filename extension selects the external
+// decompressor; files with unrecognized extensions are read as-is.
+func OpenDecompressed(filename string) (io.ReadCloser, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	command := DecompressorFor(filename)
+	if len(command) == 0 {
+		return fh, nil
+	}
+	cmd := exec.Command(command, "-dc")
+	cmd.Stdin = fh
+	cmd.Stderr = os.Stderr
+	pipe, err := cmd.StdoutPipe()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return &decompressingReader{pipe, fh, cmd}, nil
+}
+
+
+func (dr *decompressingReader) Close() error {
+	io.Copy(ioutil.Discard, dr.Reader)
+	err := dr.cmd.Wait()
+	dr.fh.Close()
+	return err
+}
+
+
+func DecompressorFor(filename string) string {
+	for _, tst := range []struct {command, exts string} {
+		{defaults.GzipExecutable, defaults.GzipExtensions},
+		{defaults.BzipExecutable, defaults.BzipExtensions},
+		{defaults.XzExecutable, defaults.XzExtensions},
+	} {
+		for _, ext := range strings.Fields(tst.exts) {
+			if strings.HasSuffix(filename, ext) {
+				return tst.command
+			}
+		}
+	}
+	return ""
+}
+
+
+/*
+  Extracts a possibly-compressed tarball into a directory using the external tar program.
+  Preserves permissions, numeric ownership, and extended attributes.  Device nodes and hard
+  links are restored when running as root.
+*/
+func ExtractTarball(filename, dirname string) error {
+	script(defaults.TarExecutable, "-C", dirname, "-xpf", filename, "--numeric-owner",
+		"--xattrs", "--xattrs-include=*.*")
+	if !WriteOK("extract %s into %s", filename, dirname) {
+		return nil
+	}
+	reader, err := OpenDecompressed(filename)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(defaults.TarExecutable, "-C", dirname, "-xpf", "-", "--numeric-owner",
+		"--xattrs", "--xattrs-include=*.*")
+	cmd.Stdin = reader
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	closeErr := reader.Close()
+	if err != nil {
+		err = fmt.Errorf("%s extracting %s", err, filename)
+	} else if closeErr != nil {
+		err = fmt.Errorf("%s decompressing %s", closeErr, filename)
+	}
+	return audited(err, "extract %s into %s", filename, dirname)
+}
+
+
+type compressingWriter struct {
+	io.WriteCloser
+	fh *os.File
+	cmd *exec.Cmd
+}
+
+
+// Creates a file for writing, compressed according to its filename extension as for
+// OpenDecompressed
+func CreateCompressed(filename string) (io.WriteCloser, error) {
+	fh, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	command := DecompressorFor(filename)
+	if len(command) == 0 {
+		return fh, nil
+	}
+	cmd := exec.Command(command, "-c")
+	cmd.Stdout = fh
+	cmd.Stderr = os.Stderr
+	pipe, err := cmd.StdinPipe()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return &compressingWriter{pipe, fh, cmd}, nil
+}
+
+
+func (cw *compressingWriter) Close() error {
+	err := cw.WriteCloser.Close()
+	if waitErr := cw.cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	if closeErr := cw.fh.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -5,32 +5,50 @@ package fs
 
 import (
 	"os"
+	"time"
 	"syscall"
 	"path/filepath"
 )
 
 
 func Mkdir(dir string) error {
+	script("mkdir", "-p", dir)
 	if WriteOK("mkdir %s", dir) {
-		err := os.MkdirAll(dir, 0755)
-		if nil != err {
-			return err
-		}
+		return audited(os.MkdirAll(dir, 0755), "mkdir %s", dir)
 	}
 	return nil
 }
 
 
 func WriteTextFile(filename, contents string) error {
+	scriptFile(filename, contents)
 	if !WriteOK("write text file %s", filename) {
 		return nil
 	}
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
-	if nil != err {
-		return err
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if nil == err {
+		_, err = file.Write([]byte(contents))
+		file.Close()
+	}
+	return audited(err, "write text file %s", filename)
+}
+
+
+// Sets a file's modification time to the present, creating the file if needed.  Meant for
+// bookkeeping, so not recorded by Audit or written to a script.
+func Touch(filename string) error {
+	if !WriteOK("touch %s", filename) {
+		return nil
+	}
+	now := time.Now()
+	err := os.Chtimes(filename, now, now)
+	if os.IsNotExist(err) {
+		var file *os.File
+		file, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
+		if nil == err {
+			err = file.Close()
+		}
 	}
-	defer file.Close()
-	_, err = file.Write([]byte(contents))
 	return err
 }
 
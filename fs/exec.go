@@ -4,8 +4,13 @@
 package fs
 
 import (
+	"io"
 	"os"
 	"fmt"
+	"path"
+	"strings"
+	"runtime"
+	"syscall"
 	"os/exec"
 )
 
@@ -26,7 +31,30 @@ func Shell(dirname string) error {
 	return cmd.Run()
 }
 
-func Chroot(dirname, exe string, env []string, fds []*os.File) error {
+
+// How to set up the process of a chroot session
+type ChrootSetup struct {
+	// CLONE_NEW* flags of namespaces to run the session in apart from the host
+	Cloneflags uintptr
+
+	// Host name of the session, which gets a UTS namespace of its own if set
+	Hostname string
+
+	// Execution domain, as for personality(2), if not the default
+	Personality uintptr
+
+	// Closing this channel kills the session's process
+	Done <-chan struct{}
+}
+
+
+// Runs a program in a chroot with the given environment, not layercake's own.  With a nil
+// writer the program uses layercake's standard input and output; otherwise its output goes to
+// the writer and its input is empty.  Unless nil, the
+// transcript receives a copy of the output.  When the standard input is a terminal, the
+// program gets a pseudoterminal so that it behaves as it would interactively.
+func Chroot(dirname, exe string, args, env []string, fds []*os.File, setup ChrootSetup,
+	out, transcript io.Writer) error {
 	if len(exe) < 1 {
 		var err error
 		exe, err = exec.LookPath("chroot")
@@ -34,18 +62,153 @@ func Chroot(dirname, exe string, env []string, fds []*os.File) error {
 			return fmt.Errorf("%s looking up chroot executable", err)
 		}
 	}
-	cmd := exec.Command(exe, dirname)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if len(env) > 0 {
-		e := os.Environ()
-		e = append(e, env...)
-		cmd.Env = e
-	}
+	cmd := exec.Command(exe, append([]string{dirname}, args...)...)
+	cmd.Env = append([]string{}, env...)
 	if len(fds) > 0 {
 		cmd.ExtraFiles = fds
 	}
-	return cmd.Run()
+	return runChrooted(cmd, setup, out, transcript)
 }
 
+
+// Runs a program in a chroot as the given user.  Rather than running the chroot executable,
+// layercake's child process enters the chroot and drops privileges itself before starting the
+// program.  The first argument names the program, which is looked up in the PATH of the given
+// environment when it has no slash.  The working directory is relative to the chroot.
+func ChrootAs(dirname string, argv, env []string, cred *syscall.Credential, workdir string,
+	setup ChrootSetup, out, transcript io.Writer) error {
+	exe, err := lookPathIn(dirname, argv[0], env)
+	if nil != err {
+		return err
+	}
+	cmd := exec.Command(exe, argv[1:]...)
+	cmd.Args[0] = argv[0]
+	cmd.Env = append([]string{}, env...)
+	cmd.Dir = workdir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: dirname, Credential: cred}
+	return runChrooted(cmd, setup, out, transcript)
+}
+
+
+// Finds a program in the directories of the chroot named by the environment's PATH setting
+func lookPathIn(dirname, file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	var searchPath string
+	for _, setting := range env {
+		if strings.HasPrefix(setting, "PATH=") {
+			searchPath = setting[len("PATH="):]
+		}
+	}
+	for _, dir := range strings.Split(searchPath, ":") {
+		candidate := path.Join("/", dir, file)
+		info, err := os.Lstat(path.Join(dirname, candidate))
+		if err == nil && (info.Mode() & os.ModeSymlink != 0 ||
+			(info.Mode().IsRegular() && info.Mode() & 0111 != 0)) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in the PATH of chroot %s", file, dirname)
+}
+
+
+func runChrooted(cmd *exec.Cmd, setup ChrootSetup, out, transcript io.Writer) error {
+	if setup.Cloneflags != 0 {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Cloneflags = setup.Cloneflags
+		if len(setup.Hostname) > 0 {
+			cmd.SysProcAttr.Cloneflags &^= syscall.CLONE_NEWUTS
+		}
+	}
+	if out == nil && transcript != nil && IsTerminal(os.Stdin) && IsTerminal(os.Stdout) {
+		return runOnPty(cmd, setup, transcript)
+	}
+	if out == nil {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	} else {
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if setup.Done != nil {
+			// Give the command a process group of its own so that killing it also kills
+			// children which would otherwise keep the output open
+			if cmd.SysProcAttr == nil {
+				cmd.SysProcAttr = &syscall.SysProcAttr{}
+			}
+			cmd.SysProcAttr.Setpgid = true
+		}
+	}
+	if transcript != nil {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, transcript)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, transcript)
+	}
+	if err := startCommand(cmd, setup); nil != err {
+		return err
+	}
+	defer killOnDone(cmd, setup.Done)()
+	return cmd.Wait()
+}
+
+
+// Kills a started command, along with its process group if it leads one, if the done channel
+// is closed before the returned function is called
+func killOnDone(cmd *exec.Cmd, done <-chan struct{}) func () {
+	if done == nil {
+		return func () {}
+	}
+	finished := make(chan struct{})
+	go func () {
+		select {
+		case <-done:
+			pid := cmd.Process.Pid
+			if attr := cmd.SysProcAttr; attr != nil && (attr.Setpgid || attr.Setsid) {
+				pid = -pid
+			}
+			syscall.Kill(pid, syscall.SIGKILL)
+		case <-finished:
+		}
+	}()
+	return func () {
+		close(finished)
+	}
+}
+
+
+// Starts a command, giving it a UTS namespace with the host name and the personality if these
+// are set.  The process inherits these from the thread which starts it, so they are set up in
+// a thread of its own, which exits with the goroutine rather than returning to service.
+func startCommand(cmd *exec.Cmd, setup ChrootSetup) error {
+	if len(setup.Hostname) == 0 && setup.Personality == 0 {
+		return cmd.Start()
+	}
+	result := make(chan error)
+	go func () {
+		runtime.LockOSThread()
+		result <- setUpThread(setup, cmd.Start)
+	}()
+	return <-result
+}
+
+
+func setUpThread(setup ChrootSetup, start func () error) error {
+	if len(setup.Hostname) > 0 {
+		err := syscall.Unshare(syscall.CLONE_NEWUTS)
+		if err == nil {
+			err = syscall.Sethostname([]byte(setup.Hostname))
+		}
+		if err != nil {
+			return fmt.Errorf("%s setting host name %s", err, setup.Hostname)
+		}
+	}
+	if setup.Personality != 0 {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PERSONALITY, setup.Personality, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("%s setting personality", errno)
+		}
+	}
+	return start()
+}
@@ -0,0 +1,78 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package fs
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+
+const lockPollInterval = 100 * time.Millisecond
+
+
+// Advisory lock held on an open file; released when unlocked or when the process exits
+type FileLock struct {
+	fh *os.File
+}
+
+
+// Takes an exclusive lock on the named file, creating it if needed.  Waits up to the given
+// duration for another holder to release the lock.  Records the holder's process ID in the file.
+func LockFile(filename string, wait time.Duration) (*FileLock, error) {
+	fh, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		err = syscall.Flock(int(fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK || !time.Now().Before(deadline) {
+			fh.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, fmt.Errorf("%s is locked%s", filename, lockHolder(filename))
+			}
+			return nil, fmt.Errorf("%s locking %s", err, filename)
+		}
+		time.Sleep(lockPollInterval)
+	}
+	if err = fh.Truncate(0); err == nil {
+		_, err = fh.WriteAt([]byte(strconv.Itoa(os.Getpid()) + "\n"), 0)
+	}
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return &FileLock{fh}, nil
+}
+
+
+func lockHolder(filename string) string {
+	text, exists, err := ReadFileIfExists(filename)
+	if err != nil || !exists {
+		return ""
+	}
+	pid := strings.TrimSpace(text)
+	if len(pid) == 0 {
+		return ""
+	}
+	return " by process " + pid
+}
+
+
+func (fl *FileLock) Unlock() error {
+	if fl == nil || fl.fh == nil {
+		return nil
+	}
+	err := fl.fh.Close()
+	fl.fh = nil
+	return err
+}
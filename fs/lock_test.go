@@ -0,0 +1,54 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package fs
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+	"io/ioutil"
+
+	"testing"
+)
+
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layercake_lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "lock")
+
+	first, err := LockFile(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LockFile(filename, 0)
+	if err == nil || !strings.Contains(err.Error(), "is locked by process") {
+		t.Fatalf("expected lock to be held, got %v", err)
+	}
+
+	start := time.Now()
+	_, err = LockFile(filename, 250 * time.Millisecond)
+	if err == nil {
+		t.Fatalf("expected wait for lock to time out")
+	}
+	if time.Since(start) < 250 * time.Millisecond {
+		t.Fatalf("gave up waiting too soon")
+	}
+
+	go func () {
+		time.Sleep(150 * time.Millisecond)
+		first.Unlock()
+	}()
+	second, err := LockFile(filename, 5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = second.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
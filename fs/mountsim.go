@@ -0,0 +1,231 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package fs
+
+import (
+	"fmt"
+	"path"
+	"errors"
+	"strings"
+	"syscall"
+
+	"potano.layercake/defaults"
+)
+
+
+/*
+  In pretend mode, the mounts layercake would make are applied to an in-memory copy of the
+  mount table instead of the kernel's so that later steps of a multi-step operation see the
+  effects of earlier ones.  The copy starts from the real mount table and stands behind
+  SyscallMount, SyscallUnmount, and GetAlternateProbeMountsCursor.
+*/
+type simulatedMount struct {
+	id, parent int
+	st_dev, root, mountpoint, mountOptions, fstype, source, options string
+}
+
+
+type mountSimulator struct {
+	mounts []simulatedMount
+	nextID, nextMinor int
+}
+
+
+var simulatingMounts bool
+
+
+// Switches mounting and mount probing over to a simulated mount table
+func SimulateMounts() error {
+	if simulatingMounts {
+		return nil
+	}
+	var cursor LineReader
+	var err error
+	if GetAlternateProbeMountsCursor != nil {
+		cursor = GetAlternateProbeMountsCursor()
+	} else {
+		cursor, err = NewTextInputFileCursor(defaults.MountinfoPath)
+		if err != nil {
+			return err
+		}
+	}
+	sim := &mountSimulator{nextMinor: 1000}
+	err = sim.load(cursor)
+	if err != nil {
+		return err
+	}
+	SyscallMount = sim.mount
+	SyscallUnmount = sim.unmount
+	GetAlternateProbeMountsCursor = func () LineReader {
+		return NewTextInputCursor("simulated mounts", strings.NewReader(sim.mountinfo()))
+	}
+	simulatingMounts = true
+	return nil
+}
+
+
+func (sim *mountSimulator) load(cursor LineReader) error {
+	defer cursor.Close()
+	var line string
+	for cursor.ReadLine(&line) {
+		segments := strings.Split(line, " ")
+		if len(segments) < 10 {
+			continue
+		}
+		var id, parent int
+		fmt.Sscan(segments[0], &id)
+		fmt.Sscan(segments[1], &parent)
+		i := 6
+		for ; i < len(segments) - 3 && segments[i] != "-"; i++ {}
+		sim.mounts = append(sim.mounts, simulatedMount{id, parent, segments[2],
+			unescape(segments[3]), unescape(segments[4]), segments[5], segments[i + 1],
+			unescape(segments[i + 2]), segments[i + 3]})
+		if id >= sim.nextID {
+			sim.nextID = id + 1
+		}
+	}
+	return cursor.Err()
+}
+
+
+// Returns the mount on which the named file lies
+func (sim *mountSimulator) containing(name string) *simulatedMount {
+	var found *simulatedMount
+	for i := range sim.mounts {
+		mnt := &sim.mounts[i]
+		if (found == nil || len(mnt.mountpoint) >= len(found.mountpoint)) &&
+			SameDirectoryOrDescendant(name, mnt.mountpoint) {
+			found = mnt
+		}
+	}
+	return found
+}
+
+
+func (sim *mountSimulator) mount(source, target, fstype string, flags uintptr,
+	options string) error {
+	if flags & (syscall.MS_SHARED | syscall.MS_PRIVATE | syscall.MS_SLAVE |
+		syscall.MS_UNBINDABLE) != 0 {
+		return nil
+	}
+	if flags & syscall.MS_REMOUNT != 0 {
+		for i := range sim.mounts {
+			if sim.mounts[i].mountpoint == target {
+				if len(options) > 0 {
+					sim.mounts[i].options = options
+				}
+				return nil
+			}
+		}
+		return errors.New("invalid argument")
+	}
+	parent := sim.containing(target)
+	if parent == nil {
+		return errors.New("no such file or directory")
+	}
+	mnt := simulatedMount{parent: parent.id, root: "/", mountpoint: target,
+		mountOptions: "rw", fstype: fstype, source: source, options: options}
+	if flags & syscall.MS_BIND != 0 {
+		from := sim.containing(source)
+		if from == nil {
+			return errors.New("no such file or directory")
+		}
+		mnt.st_dev, mnt.mountOptions, mnt.fstype, mnt.source, mnt.options = from.st_dev,
+			from.mountOptions, from.fstype, from.source, from.options
+		mnt.root = path.Join(from.root, strings.TrimPrefix(source, from.mountpoint))
+	} else {
+		for _, other := range sim.mounts {
+			if other.fstype == fstype && fstype != "overlay" {
+				mnt.st_dev = other.st_dev
+				break
+			}
+		}
+		if len(mnt.st_dev) == 0 {
+			mnt.st_dev = fmt.Sprintf("0:%d", sim.nextMinor)
+			sim.nextMinor++
+		}
+	}
+	mnt.id = sim.nextID
+	sim.nextID++
+	sim.mounts = append(sim.mounts, mnt)
+
+	if flags & syscall.MS_BIND != 0 && flags & syscall.MS_REC != 0 {
+		for _, sub := range sim.submountsOf(source) {
+			err := sim.mount(sub, path.Join(target, strings.TrimPrefix(sub, source)), "",
+				syscall.MS_BIND, "")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+
+// Returns mountpoints below the named directory, parents before children
+func (sim *mountSimulator) submountsOf(dir string) []string {
+	subs := []string{}
+	for _, mnt := range sim.mounts {
+		if mnt.mountpoint != dir && SameDirectoryOrDescendant(mnt.mountpoint, dir) {
+			subs = append(subs, mnt.mountpoint)
+		}
+	}
+	return subs
+}
+
+
+func (sim *mountSimulator) unmount(target string, flags int) error {
+	found := -1
+	for i := len(sim.mounts) - 1; i >= 0; i-- {
+		if sim.mounts[i].mountpoint == target {
+			found = i
+			break
+		}
+	}
+	if found < 0 {
+		return errors.New("invalid argument")
+	}
+	id := sim.mounts[found].id
+	for _, mnt := range sim.mounts {
+		if mnt.parent == id {
+			if flags & (syscall.MNT_FORCE | syscall.MNT_DETACH) == 0 {
+				return errors.New("device or resource busy")
+			}
+			sim.unmount(mnt.mountpoint, flags)
+		}
+	}
+	for i := range sim.mounts {
+		if sim.mounts[i].id == id {
+			sim.mounts = append(sim.mounts[:i], sim.mounts[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+
+func (sim *mountSimulator) mountinfo() string {
+	lines := make([]string, 0, len(sim.mounts))
+	for _, mnt := range sim.mounts {
+		lines = append(lines, fmt.Sprintf("%d %d %s %s %s %s - %s %s %s", mnt.id,
+			mnt.parent, mnt.st_dev, escape(mnt.root), escape(mnt.mountpoint),
+			mnt.mountOptions, mnt.fstype, escape(mnt.source), mnt.options))
+	}
+	return strings.Join(lines, "\n")
+}
+
+
+// Reverses unescape for the characters the kernel escapes in mountinfo
+func escape(str string) string {
+	var sb strings.Builder
+	for _, c := range []byte(str) {
+		switch c {
+		case ' ', '\t', '\n', '\\':
+			fmt.Fprintf(&sb, "\\%03o", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,89 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package fs
+
+import (
+	"strings"
+	"syscall"
+
+	"testing"
+)
+
+
+func TestSimulateMounts(t *testing.T) {
+	saveWriteOK := WriteOK
+	defer func () {
+		WriteOK = saveWriteOK
+		SyscallMount = syscall.Mount
+		SyscallUnmount = syscall.Unmount
+		GetAlternateProbeMountsCursor = nil
+		simulatingMounts = false
+	}()
+	WriteOK = MakePretender(true, false, nil)
+	GetAlternateProbeMountsCursor = func () LineReader {
+		return NewTextInputCursor("alpine", strings.NewReader(alpine_fresh))
+	}
+	if err := SimulateMounts(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkMounted := func (phase string, want map[string]bool) {
+		mounts, err := ProbeMounts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for mtpoint, mounted := range want {
+			if (mounts.GetMount(mtpoint) != nil) != mounted {
+				t.Fatalf("%s: expected mounted state of %s to be %v", phase, mtpoint,
+					mounted)
+			}
+		}
+	}
+
+	build := "/var/lib/layercake/layers/base/build"
+	if err := Mount("/dev", build + "/dev", "rbind", ""); err != nil {
+		t.Fatal(err)
+	}
+	checkMounted("rbind", map[string]bool{
+		build + "/dev": true,
+		build + "/dev/pts": true,
+		build + "/dev/shm": true,
+		build + "/dev/mqueue": true,
+		"/dev/pts": true,
+	})
+
+	overlay := "/var/lib/layercake/layers/derived/build"
+	err := Mount("overlay", overlay, "overlay", "lowerdir=" + build +
+		",upperdir=/u,workdir=/w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounts, err := ProbeMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt := mounts.GetMount(overlay)
+	if mnt == nil || mnt.Fstype != "overlay" || mnt.Source != build || mnt.Source2 != "/u" {
+		t.Fatalf("overlay mount not recorded as expected: %#v", mnt)
+	}
+
+	err = Unmount(build + "/dev", false)
+	if err == nil || !strings.Contains(err.Error(), "busy") {
+		t.Fatalf("expected unmount of parent mount to fail as busy, got %v", err)
+	}
+	for _, sub := range []string{"/dev/mqueue", "/dev/shm", "/dev/pts", "/dev"} {
+		if err = Unmount(build + sub, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkMounted("unmount", map[string]bool{
+		build + "/dev": false,
+		build + "/dev/pts": false,
+		overlay: true,
+		"/dev/pts": true,
+	})
+	if err = Unmount(build + "/dev", false); err == nil {
+		t.Fatalf("expected unmount of unmounted directory to fail")
+	}
+}
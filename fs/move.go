@@ -11,43 +11,47 @@ import (
 
 
 func Symlink(from, to string) error {
+	script("ln", "-s", to, from)
 	if WriteOK("symlink source=%s target=%s", from, to) {
 		err := os.Symlink(to, from)
 		if nil != err {
-			return fmt.Errorf("%s making symlink %s", err, from)
+			err = fmt.Errorf("%s making symlink %s", err, from)
 		}
+		return audited(err, "symlink source=%s target=%s", from, to)
 	}
 	return nil
 }
 
 func Rename(source, target string) error {
+	script("mv", source, target)
 	if WriteOK("rename %s to %s", source, target) {
-		return os.Rename(source, target)
+		return audited(os.Rename(source, target), "rename %s to %s", source, target)
 	}
 	return nil
 }
 
 func Remove(target string) error {
+	script("rm", "-rf", target)
 	if WriteOK("remove %s", target) {
-		return os.RemoveAll(target)
+		return audited(os.RemoveAll(target), "remove %s", target)
 	}
 	return nil
 }
 
 func Mount(source, target, fstype, options string) error {
+	scriptMount(source, target, fstype, options)
+	if source == "/dev" || source == "/sys" || source == "/run" {
+		script("mount", "--make-rslave", target)
+	}
 	if WriteOK("mount type=%s source=%s target=%s", fstype, source, target) {
-		var flags uintptr
-		switch fstype {
-		case "bind":
-			flags = syscall.MS_BIND
-		case "rbind":
-			flags = syscall.MS_BIND | syscall.MS_REC
-		case "remount":
-			flags = syscall.MS_REMOUNT
-		}
+		flags := mountFlags(fstype)
 		err := SyscallMount(source, target, fstype, flags, options)
 		if nil != err {
-			return fmt.Errorf("Cannot mount %s: %s", target, err)
+			err = fmt.Errorf("Cannot mount %s: %s", target, err)
+		}
+		audited(err, "mount type=%s source=%s target=%s", fstype, source, target)
+		if nil != err {
+			return err
 		}
 
 		// Vinculae daemonis systematis frangere!
@@ -55,20 +59,49 @@ func Mount(source, target, fstype, options string) error {
 			flags = syscall.MS_SLAVE | syscall.MS_REC
 			err = SyscallMount("", target, "", flags, options)
 			if err != nil {
-				return fmt.Errorf("Cannot change propagation type of mount %s: %s",
+				err = fmt.Errorf("Cannot change propagation type of mount %s: %s",
 					target, err)
 			}
+			return audited(err, "make-rslave %s", target)
+		}
+	} else if simulatingMounts {
+		err := SyscallMount(source, target, fstype, mountFlags(fstype), options)
+		if nil != err {
+			return fmt.Errorf("Cannot mount %s: %s", target, err)
 		}
 	}
 	return nil
 }
 
+func mountFlags(fstype string) uintptr {
+	switch fstype {
+	case "bind":
+		return syscall.MS_BIND
+	case "rbind":
+		return syscall.MS_BIND | syscall.MS_REC
+	case "remount":
+		return syscall.MS_REMOUNT
+	}
+	return 0
+}
+
 func Unmount(mounted string, force bool) error {
+	if force {
+		script("umount", "-f", mounted)
+	} else {
+		script("umount", mounted)
+	}
+	var flags int
+	if force {
+		flags |= syscall.MNT_FORCE
+	}
 	if WriteOK("umount directory=%s force=%v", mounted, force) {
-		var flags int
-		if force {
-			flags |= syscall.MNT_FORCE
+		err := SyscallUnmount(mounted, flags)
+		if err != nil {
+			err = fmt.Errorf("Cannot unmount %s: %s", mounted, err)
 		}
+		return audited(err, "umount directory=%s force=%v", mounted, force)
+	} else if simulatingMounts {
 		err := SyscallUnmount(mounted, flags)
 		if err != nil {
 			return fmt.Errorf("Cannot unmount %s: %s", mounted, err)
@@ -6,6 +6,7 @@ package fs
 import (
 	"os"
 	"fmt"
+	"strings"
 )
 
 
@@ -14,6 +15,7 @@ type TextOutputFileCursor struct {
 	lineno int
 	fh *os.File
 	pretend bool
+	scripted *strings.Builder
 }
 
 
@@ -24,6 +26,7 @@ func NewTextOutputFileCursor(filename string) (*TextOutputFileCursor, error) {
 		var err error
 		if len(filename) > 0 {
 			fh, err = os.OpenFile(filename, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0666)
+			audited(err, "write text file %s", filename)
 			if nil != err {
 				return nil, err
 			}
@@ -31,6 +34,9 @@ func NewTextOutputFileCursor(filename string) (*TextOutputFileCursor, error) {
 		cursor.fh = fh
 	} else {
 		cursor.pretend = true
+		if ScriptWriter != nil && len(filename) > 0 {
+			cursor.scripted = &strings.Builder{}
+		}
 	}
 	return cursor, nil
 }
@@ -40,6 +46,8 @@ func (toc *TextOutputFileCursor) Println(line string) {
 	toc.lineno++
 	if !toc.pretend {
 		fmt.Fprintln(toc.fh, line)
+	} else if toc.scripted != nil {
+		fmt.Fprintln(toc.scripted, line)
 	}
 }
 
@@ -48,6 +56,8 @@ func (toc *TextOutputFileCursor) Printf(msg string, parms...interface{}) {
 	toc.lineno++
 	if !toc.pretend {
 		fmt.Fprintf(toc.fh, msg, parms...)
+	} else if toc.scripted != nil {
+		fmt.Fprintf(toc.scripted, msg, parms...)
 	}
 }
 
@@ -55,6 +65,9 @@ func (toc *TextOutputFileCursor) Printf(msg string, parms...interface{}) {
 func (toc *TextOutputFileCursor) Close() {
 	if !toc.pretend {
 		toc.fh.Close()
+	} else if toc.scripted != nil {
+		scriptFile(toc.filename, toc.scripted.String())
+		toc.scripted = nil
 	}
 }
 
@@ -0,0 +1,180 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package fs
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"time"
+	"unsafe"
+	"syscall"
+	"os/exec"
+	"os/signal"
+)
+
+
+func ioctl(fd, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+
+func IsTerminal(file *os.File) bool {
+	var termios syscall.Termios
+	return ioctl(file.Fd(), syscall.TCGETS, unsafe.Pointer(&termios)) == nil
+}
+
+
+// Opens a pseudoterminal, returning its master and slave sides
+func openPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	var ptyNumber uint32
+	err = ioctl(master.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock))
+	if err == nil {
+		err = ioctl(master.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&ptyNumber))
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("%s setting up pseudoterminal", err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", ptyNumber),
+		os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+
+// Puts a terminal in raw mode, returning a function which restores the original mode
+func makeRaw(file *os.File) (func (), error) {
+	var saved syscall.Termios
+	err := ioctl(file.Fd(), syscall.TCGETS, unsafe.Pointer(&saved))
+	if err != nil {
+		return nil, err
+	}
+	raw := saved
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG |
+		syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	err = ioctl(file.Fd(), syscall.TCSETS, unsafe.Pointer(&raw))
+	if err != nil {
+		return nil, err
+	}
+	return func () {
+		ioctl(file.Fd(), syscall.TCSETS, unsafe.Pointer(&saved))
+	}, nil
+}
+
+
+type winsize struct {
+	rows, cols, xpixels, ypixels uint16
+}
+
+
+func copyWindowSize(from, to *os.File) {
+	var ws winsize
+	if ioctl(from.Fd(), syscall.TIOCGWINSZ, unsafe.Pointer(&ws)) == nil {
+		ioctl(to.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+	}
+}
+
+
+// Copies from a file to a writer until the done channel closes.  Waits for input with a
+// timeout so that the copying stops promptly rather than swallowing the next keystroke.
+func copyUntilDone(dst io.Writer, src *os.File, done <-chan struct{}) {
+	fd := int(src.Fd())
+	buf := make([]byte, 4096)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		var readfds syscall.FdSet
+		bitsPerWord := int(8 * unsafe.Sizeof(readfds.Bits[0]))
+		readfds.Bits[fd / bitsPerWord] |= 1 << uint(fd % bitsPerWord)
+		timeout := syscall.NsecToTimeval(int64(100 * time.Millisecond))
+		n, err := syscall.Select(fd + 1, &readfds, nil, nil, &timeout)
+		if err == syscall.EINTR || (err == nil && n == 0) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		n, err = syscall.Read(fd, buf)
+		if n <= 0 || err != nil {
+			return
+		}
+		if _, err = dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+
+// Runs a command attached to a pseudoterminal connected to the controlling terminal,
+// copying everything the command displays to the transcript
+func runOnPty(cmd *exec.Cmd, setup ChrootSetup, transcript io.Writer) error {
+	master, slave, err := openPty()
+	if err != nil {
+		return err
+	}
+	defer master.Close()
+	copyWindowSize(os.Stdin, master)
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	err = startCommand(cmd, setup)
+	slave.Close()
+	if err != nil {
+		return err
+	}
+	defer killOnDone(cmd, setup.Done)()
+
+	restore, err := makeRaw(os.Stdin)
+	if err == nil {
+		defer restore()
+	}
+	resize := make(chan os.Signal, 1)
+	signal.Notify(resize, syscall.SIGWINCH)
+	defer signal.Stop(resize)
+	done := make(chan struct{})
+	defer close(done)
+	go func () {
+		for {
+			select {
+			case <-resize:
+				copyWindowSize(os.Stdin, master)
+			case <-done:
+				return
+			}
+		}
+	}()
+	go copyUntilDone(master, os.Stdin, done)
+
+	// Reading the master fails with EIO once the command and its children close the slave
+	io.Copy(io.MultiWriter(os.Stdout, transcript), master)
+	return cmd.Wait()
+}
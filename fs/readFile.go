@@ -6,26 +6,18 @@ package fs
 import (
 	"os"
 	"errors"
+	"io/ioutil"
 )
 
 
+// Reads a whole file.  Reads to end of file rather than trusting the size reported by stat,
+// which is zero for pseudo-files such as those under /proc and binfmt_misc.
 func ReadFile(filename string) (string, error) {
-	file, err := os.Open(filename)
+	blob, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return "", err
 	}
-	defer file.Close()
-	fileinfo, err := file.Stat()
-	if err != nil {
-		return "", err
-	}
-	bufsiz := fileinfo.Size()
-	buf := make([]byte, bufsiz)
-	n, err := file.Read(buf)
-	if err != nil {
-		return "", err
-	}
-	return string(buf[:n]), nil
+	return string(blob), nil
 }
 
 
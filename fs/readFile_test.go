@@ -0,0 +1,50 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package fs
+
+import (
+	"os"
+	"path"
+	"syscall"
+	"io/ioutil"
+
+	"testing"
+)
+
+
+// Pseudo-files report size 0 yet have contents; a FIFO stands in for one
+func TestReadFileOfZeroSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layercake_readfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fifo := path.Join(dir, "fifo")
+	if err = syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	contents := "enabled\ninterpreter /usr/bin/qemu-aarch64\n"
+	go func () {
+		if fh, err := os.OpenFile(fifo, os.O_WRONLY, 0); err == nil {
+			fh.Write([]byte(contents))
+			fh.Close()
+		}
+	}()
+	have, err := ReadFile(fifo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have != contents {
+		t.Errorf("expected [%s], got [%s]", contents, have)
+	}
+
+	empty := path.Join(dir, "empty")
+	if err = ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if have, err = ReadFile(empty); err != nil || len(have) > 0 {
+		t.Errorf("empty file: got [%s], %v", have, err)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package fs
+
+import (
+	"io"
+	"fmt"
+	"strings"
+)
+
+
+// Receives a POSIX shell command for each action that would be carried out; nil unless
+// StartScript is called
+var ScriptWriter io.Writer
+
+
+const scriptHeredocMarker = "LAYERCAKE_EOF"
+
+
+// Begins a shell script equivalent to the actions of the current command.  The actions
+// themselves should be suppressed by a pretending WriteOK.
+func StartScript(w io.Writer) {
+	ScriptWriter = w
+	fmt.Fprintln(w, "#!/bin/sh")
+	fmt.Fprintln(w, "set -e")
+}
+
+
+// Writes a command line with each word quoted as needed
+func script(words...string) {
+	if ScriptWriter == nil {
+		return
+	}
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = ShellQuote(word)
+	}
+	fmt.Fprintln(ScriptWriter, strings.Join(quoted, " "))
+}
+
+
+// Writes a command which creates a file with the given contents
+func scriptFile(filename, contents string) {
+	if ScriptWriter == nil {
+		return
+	}
+	if len(contents) > 0 && !strings.HasSuffix(contents, "\n") {
+		contents += "\n"
+	}
+	fmt.Fprintf(ScriptWriter, "cat > %s <<'%s'\n%s%s\n", ShellQuote(filename),
+		scriptHeredocMarker, contents, scriptHeredocMarker)
+}
+
+
+func scriptMount(source, target, fstype, options string) {
+	switch fstype {
+	case "bind":
+		script("mount", "--bind", source, target)
+	case "rbind":
+		script("mount", "--rbind", source, target)
+	case "remount":
+		opts := "remount"
+		if len(options) > 0 {
+			opts += "," + options
+		}
+		script("mount", "-o", opts, target)
+	default:
+		words := []string{"mount", "-t", fstype}
+		if len(options) > 0 {
+			words = append(words, "-o", options)
+		}
+		script(append(words, source, target)...)
+	}
+}
+
+
+// Quotes a word for a POSIX shell unless it consists only of safe characters
+func ShellQuote(word string) string {
+	if len(word) > 0 && strings.Trim(word,
+		"abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./_-") == "" {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
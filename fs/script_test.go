@@ -0,0 +1,56 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package fs
+
+import (
+	"strings"
+
+	"testing"
+)
+
+
+func TestScript(t *testing.T) {
+	var out strings.Builder
+	saveWriteOK := WriteOK
+	defer func () {
+		WriteOK = saveWriteOK
+		ScriptWriter = nil
+	}()
+	WriteOK = MakePretender(true, false, nil)
+	StartScript(&out)
+
+	Mkdir("/lc/layers/a b")
+	Mount("/dev", "/lc/layers/a/build/dev", "rbind", "")
+	Mount("overlay", "/lc/layers/b/build", "overlay", "lowerdir=/x,upperdir=/y,workdir=/z")
+	Mount("", "/lc/layers/b/build", "remount", "lowerdir=/x")
+	Symlink("/lc/export/a", "/lc/layers/a/packages")
+	Unmount("/lc/layers/b/build", false)
+	WriteTextFile("/lc/it's", "line one\n")
+	cursor, err := NewTextOutputFileCursor("/lc/cursor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor.Printf("%s\n", "hello")
+	cursor.Close()
+
+	expected := `#!/bin/sh
+set -e
+mkdir -p '/lc/layers/a b'
+mount --rbind /dev /lc/layers/a/build/dev
+mount --make-rslave /lc/layers/a/build/dev
+mount -t overlay -o lowerdir=/x,upperdir=/y,workdir=/z overlay /lc/layers/b/build
+mount -o remount,lowerdir=/x /lc/layers/b/build
+ln -s /lc/layers/a/packages /lc/export/a
+umount /lc/layers/b/build
+cat > '/lc/it'\''s' <<'LAYERCAKE_EOF'
+line one
+LAYERCAKE_EOF
+cat > /lc/cursor <<'LAYERCAKE_EOF'
+hello
+LAYERCAKE_EOF
+`
+	if out.String() != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
@@ -4,6 +4,9 @@
 package fs
 
 import (
+	"os"
+	"os/user"
+	"strconv"
 	"syscall"
 )
 
@@ -11,3 +14,14 @@ func UserIsRoot() bool {
 	return syscall.Geteuid() == 0
 }
 
+// Returns the name of the user on whose behalf layercake runs, looking through sudo
+func InvokingUser() string {
+	if name := os.Getenv("SUDO_USER"); len(name) > 0 && UserIsRoot() {
+		return name
+	}
+	if usr, err := user.Current(); err == nil {
+		return usr.Username
+	}
+	return strconv.Itoa(syscall.Getuid())
+}
+
@@ -0,0 +1,153 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"path"
+	"time"
+	"strconv"
+	"strings"
+
+	"potano.layercake/fs"
+	"potano.layercake/config"
+	"potano.layercake/defaults"
+)
+
+
+/*
+  The audit log in the base directory receives a line for each action layercake carries out.
+  Fields are separated by tabs:
+
+    time  user  process-ID  layer  result  action  command-line
+
+  The layer field is "-" for actions outside any layer directory; the result is "ok" or the
+  error message.
+*/
+type AuditEntry struct {
+	Time time.Time
+	User string
+	Pid int
+	Layer string
+	Result string
+	Action string
+	Command string
+}
+
+
+const auditTimeFormat = time.RFC3339
+
+
+func auditLogPath(cfg *config.ConfigType) string {
+	return path.Join(cfg.Basepath, defaults.AuditLogFile)
+}
+
+
+// Arranges for each action carried out from here on to be recorded in the audit log
+func StartAuditLog(cfg *config.ConfigType) {
+	filename := auditLogPath(cfg)
+	user := fs.InvokingUser()
+	pid := strconv.Itoa(os.Getpid())
+	command := strings.Join(os.Args, " ")
+	warned := false
+	fs.Audit = func (action string, err error) {
+		result := "ok"
+		if err != nil {
+			result = err.Error()
+		}
+		fields := []string{time.Now().Format(auditTimeFormat), user, pid,
+			layerOfAction(cfg, action), result, action, command}
+		for i, field := range fields {
+			fields[i] = strings.Join(strings.Fields(field), " ")
+		}
+		err = fs.AppendTextFile(filename, strings.Join(fields, "\t") + "\n")
+		if err != nil && !warned && fs.IsDir(cfg.Basepath) {
+			fs.Printf("Warning: %s writing audit log\n", err)
+			warned = true
+		}
+	}
+}
+
+
+func StopAuditLog() {
+	fs.Audit = nil
+}
+
+
+// Returns the name of the layer whose directory the action affects
+func layerOfAction(cfg *config.ConfigType, action string) string {
+	prefix := cfg.Layerdirs + "/"
+	pos := strings.Index(action, prefix)
+	if pos < 0 {
+		return "-"
+	}
+	name := action[pos + len(prefix):]
+	if end := strings.IndexAny(name, "/ "); end >= 0 {
+		name = name[:end]
+	}
+	for _, suffix := range []string{defaults.RemovedLayerSuffix,
+		defaults.ImportingLayerSuffix} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	if len(name) == 0 || !isLegalLayerName(name) {
+		return "-"
+	}
+	return name
+}
+
+
+// Tells whether the action names the layer's directory, as does the second path of a rename
+func actionMentionsLayer(cfg *config.ConfigType, action, name string) bool {
+	dir := path.Join(cfg.Layerdirs, name)
+	for pos := strings.Index(action, dir); pos >= 0; {
+		rest := action[pos + len(dir):]
+		if len(rest) == 0 || rest[0] == '/' || rest[0] == ' ' {
+			return true
+		}
+		next := strings.Index(rest, dir)
+		if next < 0 {
+			break
+		}
+		pos += len(dir) + next
+	}
+	return false
+}
+
+
+// Reads the audit log, returning the entries for the named layer or all entries if the name
+// is empty
+func ReadAuditLog(cfg *config.ConfigType, layer string) ([]AuditEntry, error) {
+	text, exists, err := fs.ReadFileIfExists(auditLogPath(cfg))
+	if err != nil || !exists {
+		return nil, err
+	}
+	entries := []AuditEntry{}
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			continue
+		}
+		if len(layer) > 0 && fields[3] != layer && !actionMentionsLayer(cfg, fields[5], layer) {
+			continue
+		}
+		tm, err := time.Parse(auditTimeFormat, fields[0])
+		if err != nil {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, AuditEntry{
+			Time: tm,
+			User: fields[1],
+			Pid: pid,
+			Layer: fields[3],
+			Result: fields[4],
+			Action: fields[5],
+			Command: fields[6],
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,74 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"testing"
+	"potano.layercake/config"
+)
+
+
+func TestAuditLog(t *testing.T) {
+	td, err := NewTmpdir("layercake_audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	StartAuditLog(cfg)
+	defer StopAuditLog()
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, def := range []struct {name, base string} {
+		{"base", ""}, {"derived", "base"},
+	} {
+		if err = layers.AddLayer(def.name, def.base, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = layers.RenameLayer("derived", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := ReadAuditLog(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived, err := ReadAuditLog(cfg, "derived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(derived) == 0 || len(derived) >= len(all) {
+		t.Fatalf("expected a proper subset of %d entries for derived layer, got %d",
+			len(all), len(derived))
+	}
+	for _, entry := range all {
+		if entry.Result != "ok" {
+			t.Errorf("unexpected result %s for %s", entry.Result, entry.Action)
+		}
+		if entry.Pid == 0 || len(entry.User) == 0 || len(entry.Command) == 0 {
+			t.Errorf("incomplete entry %#v", entry)
+		}
+	}
+	last := derived[len(derived)-1]
+	want := "rename " + layers.layerPath("derived") + " to " + layers.layerPath("renamed")
+	if last.Action != want {
+		t.Fatalf("expected last action for derived layer %s, got %s", want, last.Action)
+	}
+	renamed, err := ReadAuditLog(cfg, "renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renamed) != 1 || renamed[0].Action != want {
+		t.Fatalf("expected rename as only entry for renamed layer, got %#v", renamed)
+	}
+}
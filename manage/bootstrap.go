@@ -0,0 +1,122 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"potano.layercake/fs"
+	"potano.layercake/defaults"
+	"potano.layercake/portage/digests"
+)
+
+
+/*
+  Populates the empty build root of a base layer from a stage3 tarball.  Verifies the tarball
+  against a Gentoo .DIGESTS file, by default the one alongside the tarball, unless -force is
+  given and there is no such file.  After extraction copies the host's resolv.conf into the
+  build root and checks that the layer is ready to be mounted.
+*/
+func (ld *Layerdefs) Bootstrap(name, tarball, digestsFile string) error {
+	err := ld.testName(nametest{name, name_need, "Layer"})
+	if nil != err {
+		return err
+	}
+	layer := ld.layermap[name]
+	err = layer.errorIfError()
+	if err != nil {
+		return err
+	}
+	if len(layer.Base) > 0 {
+		return fmt.Errorf("Layer %s is a derived layer; only base layers can be bootstrapped",
+			name)
+	}
+	err = layer.errorIfBusy("bootstrap", true)
+	if err != nil {
+		return err
+	}
+	if !fs.IsFile(tarball) {
+		return fmt.Errorf("Stage tarball %s not found", tarball)
+	}
+
+	if len(digestsFile) == 0 {
+		digestsFile = tarball + ".DIGESTS"
+	}
+	if fs.IsFile(digestsFile) {
+		verified, err := digests.Verify(tarball, digestsFile)
+		if err != nil {
+			return err
+		}
+		fs.Printf("Verified %s digest(s) of %s\n", strings.Join(verified, " and "),
+			path.Base(tarball))
+	} else if ld.opts.Force {
+		fs.Printf("Warning: no digests file %s; %s not verified\n", digestsFile, tarball)
+	} else {
+		return fmt.Errorf("Digests file %s not found; use -digests to name one or -force " +
+			"to skip verification", digestsFile)
+	}
+
+	builddir := ld.buildPath(layer)
+	if fs.IsDir(builddir) {
+		empty, err := buildRootAsAdded(builddir)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fmt.Errorf("Build root of layer %s is not empty", name)
+		}
+	} else if err = fs.Mkdir(builddir); err != nil {
+		return err
+	}
+	if err = fs.ExtractTarball(tarball, builddir); err != nil {
+		return err
+	}
+
+	resolvConf, err := fs.ReadFile(defaults.HostResolvConf)
+	if err != nil {
+		return err
+	}
+	target := path.Join(builddir, defaults.HostResolvConf)
+	if fs.Exists(target) {
+		if err = fs.Remove(target); err != nil {
+			return err
+		}
+	}
+	if err = fs.WriteTextFile(target, resolvConf); err != nil {
+		return err
+	}
+
+	if !ld.opts.Pretend && !minimalBuildDirsPresent(builddir) {
+		return fmt.Errorf("Stage tarball %s did not supply the minimal build directories %s",
+			tarball, defaults.MinimalBuildDirs)
+	}
+	return nil
+}
+
+
+// Reports whether a build root holds nothing but the root/.bashrc file written by AddLayer
+func buildRootAsAdded(builddir string) (bool, error) {
+	names, err := fs.Readdirnames(builddir)
+	if err != nil {
+		return false, err
+	}
+	if len(names) == 0 {
+		return true, nil
+	}
+	if len(names) > 1 || names[0] != "root" {
+		return false, nil
+	}
+	rootuserPath := path.Join(builddir, "root")
+	names, err = fs.Readdirnames(rootuserPath)
+	if err != nil || len(names) != 1 || names[0] != ".bashrc" {
+		return false, nil
+	}
+	bashrc, err := fs.ReadFile(path.Join(rootuserPath, ".bashrc"))
+	if err != nil {
+		return false, err
+	}
+	return bashrc == defaults.BaseLayerRootBashrc, nil
+}
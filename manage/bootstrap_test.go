@@ -0,0 +1,132 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"path"
+	"strings"
+	"archive/tar"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+
+	"testing"
+	"potano.layercake/config"
+	"potano.layercake/defaults"
+	"potano.layercake/fs"
+)
+
+
+// Writes an uncompressed stage tarball holding the minimal build directories and etc/hostname
+func writeStageTarball(t *testing.T, filename string) {
+	fh, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	tw := tar.NewWriter(fh)
+	for _, name := range strings.Split(defaults.MinimalBuildDirs, " ") {
+		err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	contents := "stage\n"
+	err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0644,
+		Size: int64(len(contents))})
+	if err == nil {
+		_, err = tw.Write([]byte(contents))
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+
+func TestBootstrap(t *testing.T) {
+	td, err := NewTmpdir("layercake_bootstrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, names := range [][2]string{{"base", ""}, {"forced", ""}, {"derived", "base"}} {
+		if err = layers.AddLayer(names[0], names[1], ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tarball := td.Path("stage3-amd64-openrc.tar")
+	writeStageTarball(t, tarball)
+	blob, err := ioutil.ReadFile(tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha512.Sum512(blob)
+	err = fs.WriteTextFile(tarball + ".DIGESTS", "# SHA512 HASH\n" + hex.EncodeToString(sum[:]) +
+		"  " + path.Base(tarball) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	missingDigests := td.Path("nonesuch.DIGESTS")
+
+	err = layers.Bootstrap("derived", tarball, "")
+	checkErrorByMessage(t, err,
+		"Layer derived is a derived layer; only base layers can be bootstrapped", "derived layer")
+
+	err = layers.Bootstrap("base", tarball, missingDigests)
+	checkErrorByMessage(t, err, "Digests file " + missingDigests + " not found; use -digests " +
+		"to name one or -force to skip verification", "missing digests")
+
+	builddir := layers.buildPath(layers.Layer("base"))
+	stray := path.Join(builddir, "stray")
+	if err = fs.WriteTextFile(stray, "left over\n"); err != nil {
+		t.Fatal(err)
+	}
+	err = layers.Bootstrap("base", tarball, "")
+	checkErrorByMessage(t, err, "Build root of layer base is not empty", "non-empty build root")
+	if fs.IsFile(path.Join(builddir, "etc/hostname")) {
+		t.Errorf("tarball extracted into non-empty build root")
+	}
+	if err = os.Remove(stray); err != nil {
+		t.Fatal(err)
+	}
+
+	checkBootstrapped := func (name, label string) {
+		builddir := layers.buildPath(layers.Layer(name))
+		for _, filename := range []string{"etc/hostname", defaults.HostResolvConf} {
+			if !fs.IsFile(path.Join(builddir, filename)) {
+				t.Errorf("%s: expected %s in build root", label, filename)
+			}
+		}
+		if !minimalBuildDirsPresent(builddir) {
+			t.Errorf("%s: minimal build directories missing", label)
+		}
+	}
+
+	if err = layers.Bootstrap("base", tarball, ""); err != nil {
+		t.Fatalf("verified bootstrap: %s", err)
+	}
+	checkBootstrapped("base", "verified bootstrap")
+
+	layers.opts.Force = true
+	if err = layers.Bootstrap("forced", tarball, missingDigests); err != nil {
+		t.Fatalf("forced bootstrap: %s", err)
+	}
+	checkBootstrapped("forced", "forced bootstrap")
+}
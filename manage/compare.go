@@ -0,0 +1,124 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"sort"
+
+	"potano.layercake/portage/atom"
+	"potano.layercake/portage/vdb"
+)
+
+
+const (
+	Difference_only_a = iota
+	Difference_only_b
+	Difference_version
+	Difference_use
+)
+
+var differenceDescriptions []string = []string{
+	"only in first",
+	"only in second",
+	"version",
+	"USE",
+}
+
+
+type PackageDifference struct {
+	Package, Slot string
+	Kind int
+	A, B string
+	UseChanges []string
+}
+
+
+func (pd PackageDifference) Description() string {
+	return differenceDescriptions[pd.Kind]
+}
+
+
+/*
+  Compares the installed packages of two layers slot by slot.  Reports packages installed in
+  only one of the layers, differing versions in the same slot, and differing USE settings of
+  the same version.  USE changes are given as +flag or -flag according to the setting in the
+  second layer.
+*/
+func (ld *Layerdefs) CompareLayers(nameA, nameB string) ([]PackageDifference, error) {
+	err := ld.testName(nametest{nameA, name_need, "Layer"},
+		nametest{nameB, name_need, "Layer"})
+	if nil != err {
+		return nil, err
+	}
+	var sets [2]*atom.AtomSet
+	for i, name := range []string{nameA, nameB} {
+		layer := ld.layermap[name]
+		if err = layer.errorIfError(); err != nil {
+			return nil, err
+		}
+		if sets[i], err = ld.installedPackages(layer); err != nil {
+			return nil, err
+		}
+	}
+
+	names := []string{}
+	for name := range sets[0].Atoms {
+		names = append(names, name)
+	}
+	for name := range sets[1].Atoms {
+		if sets[0].Atoms[name] == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diffs []PackageDifference
+	for _, name := range names {
+		slots := map[string][2]atom.Atom{}
+		slotKeys := []string{}
+		for i, set := range sets {
+			for _, atm := range set.GetByName(name) {
+				key := atm.GetSlot()
+				pair, have := slots[key]
+				if !have {
+					slotKeys = append(slotKeys, key)
+				}
+				pair[i] = atm
+				slots[key] = pair
+			}
+		}
+		sort.Strings(slotKeys)
+		for _, key := range slotKeys {
+			pair := slots[key]
+			diff := PackageDifference{Package: name}
+			for i, atm := range pair {
+				if atm == nil {
+					continue
+				}
+				diff.Slot = atm.(*vdb.AvailableVersion).SlotName
+				if i == 0 {
+					diff.A = atm.String()
+				} else {
+					diff.B = atm.String()
+				}
+			}
+			if pair[1] == nil {
+				diff.Kind = Difference_only_a
+			} else if pair[0] == nil {
+				diff.Kind = Difference_only_b
+			} else if pair[0].ComparisonString() != pair[1].ComparisonString() {
+				diff.Kind = Difference_version
+			} else {
+				diff.UseChanges = atom.DiffUseFlagMaps(pair[0].GetUseFlagMap(),
+					pair[1].GetUseFlagMap())
+				if len(diff.UseChanges) == 0 {
+					continue
+				}
+				diff.Kind = Difference_use
+			}
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs, nil
+}
@@ -0,0 +1,121 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"testing"
+	"potano.layercake/config"
+	"potano.layercake/fs"
+)
+
+
+func TestCompareLayers(t *testing.T) {
+	td, err := NewTmpdir("layercake_compare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Base layers are compared so that no overlay need be mounted to read their files
+	for _, name := range []string{"a", "b"} {
+		if err = layers.AddLayer(name, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each entry is cpv:slot or cpv:slot:IUSE:USE
+	populate := func (name string, entries []string) {
+		pkgdb := path.Join(layers.buildPath(layers.Layer(name)), "var/db/pkg")
+		if err := os.RemoveAll(pkgdb); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Mkdir(pkgdb); err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			fields := strings.Split(entry, ":")
+			dir := path.Join(pkgdb, fields[0])
+			err := fs.Mkdir(dir)
+			if err == nil {
+				err = fs.WriteTextFile(path.Join(dir, "SLOT"), fields[1] + "\n")
+			}
+			if err == nil && len(fields) > 2 {
+				err = fs.WriteTextFile(path.Join(dir, "IUSE"), fields[2] + "\n")
+				if err == nil {
+					err = fs.WriteTextFile(path.Join(dir, "USE"), fields[3] + "\n")
+				}
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		a, b []string
+		expected []string
+	}{
+		{"same packages",
+			[]string{"dev-libs/libfoo-1.0:0", "sys-apps/bar-2.1:0"},
+			[]string{"dev-libs/libfoo-1.0:0", "sys-apps/bar-2.1:0"},
+			nil},
+		{"added package",
+			[]string{"dev-libs/libfoo-1.0:0"},
+			[]string{"dev-libs/libfoo-1.0:0", "app-misc/new-3.0:0"},
+			[]string{"app-misc/new:0 only in second [] [app-misc/new-3.0]"}},
+		{"removed package",
+			[]string{"dev-libs/libfoo-1.0:0", "app-misc/old-1.2:0"},
+			[]string{"dev-libs/libfoo-1.0:0"},
+			[]string{"app-misc/old:0 only in first [app-misc/old-1.2] []"}},
+		{"changed version",
+			[]string{"dev-libs/libfoo-1.0:0"},
+			[]string{"dev-libs/libfoo-1.1:0"},
+			[]string{"dev-libs/libfoo:0 version [dev-libs/libfoo-1.0] [dev-libs/libfoo-1.1]"}},
+		{"changed USE",
+			[]string{"dev-libs/libfoo-1.0:0:ssl static-libs:ssl"},
+			[]string{"dev-libs/libfoo-1.0:0:ssl static-libs:static-libs"},
+			[]string{"dev-libs/libfoo:0 USE [dev-libs/libfoo-1.0] [dev-libs/libfoo-1.0] " +
+				"-ssl +static-libs"}},
+		{"slots compared separately",
+			[]string{"sys-devel/gcc-11.2.0:11", "sys-devel/gcc-12.1.0:12"},
+			[]string{"sys-devel/gcc-12.1.0:12", "sys-devel/gcc-13.1.0:13"},
+			[]string{"sys-devel/gcc:11 only in first [sys-devel/gcc-11.2.0] []",
+				"sys-devel/gcc:13 only in second [] [sys-devel/gcc-13.1.0]"}},
+	} {
+		populate("a", tc.a)
+		populate("b", tc.b)
+		diffs, err := layers.CompareLayers("a", "b")
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		var have []string
+		for _, diff := range diffs {
+			have = append(have, strings.TrimSpace(diff.Package + ":" + diff.Slot + " " +
+				diff.Description() + " [" + diff.A + "] [" + diff.B + "] " +
+				strings.Join(diff.UseChanges, " ")))
+		}
+		if !stringSlicesEqual(tc.expected, have) {
+			t.Errorf("%s: expected differences\n  %s\ngot\n  %s", tc.name,
+				strings.Join(tc.expected, "\n  "), strings.Join(have, "\n  "))
+		}
+	}
+
+	_, err = layers.CompareLayers("a", "nonesuch")
+	checkErrorByMessage(t, err, "Layer name 'nonesuch' does not exist", "unknown layer")
+}
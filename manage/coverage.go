@@ -0,0 +1,119 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"strings"
+
+	"potano.layercake/portage/atom"
+	"potano.layercake/portage/vdb"
+	"potano.layercake/portage/binpkg"
+)
+
+
+const (
+	Coverage_no_binary = iota
+	Coverage_no_binary_use
+	Coverage_not_installed
+	Coverage_version
+	Coverage_use
+)
+
+var coverageDescriptions []string = []string{
+	"no binary package",
+	"no binary package with target's USE",
+	"not installed in layer",
+	"version mismatch",
+	"USE mismatch",
+}
+
+
+type CoverageProblem struct {
+	Package string
+	Problem int
+	Details string
+}
+
+
+func (cp CoverageProblem) Description() string {
+	return coverageDescriptions[cp.Problem]
+}
+
+
+/*
+  Compares the installed packages of a target system against a layer.  For each package the
+  target has, reports whether the layer's binary-package directory holds a build of that
+  version with the target's USE settings, and whether the layer itself has the same version
+  installed with the same USE settings.  An 'emerge -K' on the target can succeed only for
+  packages without problems.
+*/
+func (ld *Layerdefs) CheckCoverage(name, archive string) ([]CoverageProblem, error) {
+	err := ld.testName(nametest{name, name_need, "Layer"})
+	if nil != err {
+		return nil, err
+	}
+	layer := ld.layermap[name]
+	err = layer.errorIfError()
+	if err != nil {
+		return nil, err
+	}
+	targetSet, err := vdb.GetArchivedPackageList(archive)
+	if err != nil {
+		return nil, err
+	}
+	layerSet, err := ld.installedPackages(layer)
+	if err != nil {
+		return nil, err
+	}
+	pkgdir, err := ld.binpkgPath(layer)
+	if err != nil {
+		return nil, err
+	}
+	index, err := binpkg.ReadPackagesIndex(pkgdir)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []CoverageProblem
+	for _, target := range targetSet.SortedAtoms() {
+		targetUse := target.GetUseFlagMap()
+		builds := index.GetVersions(target)
+		if len(builds) == 0 {
+			problems = append(problems, CoverageProblem{target.String(),
+				Coverage_no_binary, ""})
+		} else {
+			var nearest []string
+			for i, bp := range builds {
+				diffs := atom.DiffUseFlagMaps(bp.GetUseFlagMap(), targetUse)
+				if len(diffs) == 0 {
+					nearest = nil
+					break
+				}
+				if i == 0 || len(diffs) < len(nearest) {
+					nearest = diffs
+				}
+			}
+			if len(nearest) > 0 {
+				problems = append(problems, CoverageProblem{target.String(),
+					Coverage_no_binary_use, strings.Join(nearest, " ")})
+			}
+		}
+
+		installed := layerSet.Get(target)
+		if installed == nil {
+			problems = append(problems, CoverageProblem{target.String(),
+				Coverage_not_installed, ""})
+		} else if installed.ComparisonString() != target.ComparisonString() {
+			problems = append(problems, CoverageProblem{target.String(),
+				Coverage_version, "layer has " + installed.String()})
+		} else {
+			diffs := atom.DiffUseFlagMaps(installed.GetUseFlagMap(), targetUse)
+			if len(diffs) > 0 {
+				problems = append(problems, CoverageProblem{target.String(),
+					Coverage_use, strings.Join(diffs, " ")})
+			}
+		}
+	}
+	return problems, nil
+}
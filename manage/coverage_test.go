@@ -0,0 +1,159 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"path"
+	"strings"
+	"archive/tar"
+
+	"testing"
+	"potano.layercake/config"
+	"potano.layercake/fs"
+	"potano.layercake/portage/binpkg"
+)
+
+
+// Writes package database entries of the form cpv:IUSE:USE, all in slot 0, into pkgdb
+func writeTestPackageDatabase(t *testing.T, pkgdb string, entries []string) {
+	for _, entry := range entries {
+		fields := strings.Split(entry, ":")
+		dir := path.Join(pkgdb, fields[0])
+		err := fs.Mkdir(dir)
+		if err == nil {
+			err = fs.WriteTextFile(path.Join(dir, "SLOT"), "0\n")
+		}
+		if err == nil {
+			err = fs.WriteTextFile(path.Join(dir, "IUSE"), fields[1] + "\n")
+		}
+		if err == nil {
+			err = fs.WriteTextFile(path.Join(dir, "USE"), fields[2] + "\n")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+
+func TestCheckCoverage(t *testing.T) {
+	td, err := NewTmpdir("layercake_coverage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.AddLayer("base", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	layer := layers.Layer("base")
+
+	// Each package of the target shows one kind of problem, apart from dev-libs/a
+	target := []string{
+		"dev-libs/a-1.0:ssl:ssl",
+		"dev-libs/b-1.0:ssl:",
+		"dev-libs/c-1.0:ssl:ssl",
+		"dev-libs/d-1.0:ssl:",
+		"dev-libs/e-1.0:ssl:",
+		"dev-libs/f-1.0:ssl:ssl",
+	}
+	writeTestPackageDatabase(t, path.Join(layers.buildPath(layer), "var/db/pkg"), []string{
+		"dev-libs/a-1.0:ssl:ssl",
+		"dev-libs/b-1.0:ssl:",
+		"dev-libs/c-1.0:ssl:ssl",
+		"dev-libs/e-1.1:ssl:",
+		"dev-libs/f-1.0:ssl:",
+	})
+	pkgdir, err := layers.binpkgPath(layer)
+	if err == nil {
+		err = fs.Mkdir(pkgdir)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := "ARCH: amd64\nVERSION: 0\n"
+	for _, build := range []string{"a-1.0:ssl", "c-1.0:", "d-1.0:", "e-1.0:", "f-1.0:ssl"} {
+		fields := strings.Split(build, ":")
+		index += "\nCPV: dev-libs/" + fields[0] + "\nIUSE: ssl\nSLOT: 0\nUSE: amd64 " +
+			fields[1] + "\n"
+	}
+	err = fs.WriteTextFile(path.Join(pkgdir, binpkg.PackagesIndexFile), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vdbDir := td.Path("/target/var/db/pkg")
+	writeTestPackageDatabase(t, vdbDir, target)
+	vdbTar := td.Path("/target.tar")
+	fh, err := os.Create(vdbTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(fh)
+	for _, entry := range target {
+		fields := strings.Split(entry, ":")
+		for _, file := range [][2]string{{"SLOT", "0"}, {"IUSE", fields[1]}, {"USE", fields[2]}} {
+			contents := file[1] + "\n"
+			err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Mode: 0644,
+				Name: "var/db/pkg/" + fields[0] + "/" + file[0], Size: int64(len(contents))})
+			if err == nil {
+				_, err = tw.Write([]byte(contents))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = tw.Close(); err == nil {
+		err = fh.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"dev-libs/b-1.0: no binary package",
+		"dev-libs/c-1.0: no binary package with target's USE (+ssl)",
+		"dev-libs/d-1.0: not installed in layer",
+		"dev-libs/e-1.0: version mismatch (layer has dev-libs/e-1.1)",
+		"dev-libs/f-1.0: USE mismatch (+ssl)",
+	}
+	for _, tst := range []struct {desc, archive string} {
+		{"package database directory", vdbDir},
+		{"root directory", td.Path("/target")},
+		{"tarball", vdbTar},
+	} {
+		problems, err := layers.CheckCoverage("base", tst.archive)
+		if err != nil {
+			t.Errorf("%s: %s", tst.desc, err)
+			continue
+		}
+		var have []string
+		for _, problem := range problems {
+			line := problem.Package + ": " + problem.Description()
+			if len(problem.Details) > 0 {
+				line += " (" + problem.Details + ")"
+			}
+			have = append(have, line)
+		}
+		if !stringSlicesEqual(expected, have) {
+			t.Errorf("%s: expected problems\n  %s\ngot\n  %s", tst.desc,
+				strings.Join(expected, "\n  "), strings.Join(have, "\n  "))
+		}
+	}
+
+	_, err = layers.CheckCoverage("nonesuch", vdbDir)
+	checkErrorByMessage(t, err, "Layer name 'nonesuch' does not exist", "unknown layer")
+}
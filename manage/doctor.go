@@ -0,0 +1,101 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"strings"
+)
+
+
+type Diagnosis struct {
+	Layer, Problem, Details string
+	Fixable bool
+}
+
+
+/*
+  Runs consistency checks on the named layer or, if 'name' is empty, on all layers.  Layers
+  which must be mounted for a check to see their files are skipped for that check when not
+  mounted.
+*/
+func (ld *Layerdefs) Diagnose(name string) ([]Diagnosis, error) {
+	layers, err := ld.layersToCheck(name)
+	if err != nil {
+		return nil, err
+	}
+	var out []Diagnosis
+	for _, layer := range layers {
+		if layer.State == Layerstate_error {
+			out = append(out, Diagnosis{layer.Name, "layer in error state",
+				strings.Join(layer.Messages, "; "), false})
+			continue
+		}
+		dups, err := ld.FindVdbDuplicates(layer.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, dup := range dups {
+			details := fmt.Sprintf("%s slot %s: %s", dup.Package, dup.Slot,
+				strings.Join(dup.Versions, ", "))
+			if len(dup.Stale) > 0 {
+				details += "; stale: " + strings.Join(dup.Stale, ", ")
+			}
+			out = append(out, Diagnosis{layer.Name, "duplicate package entries",
+				details, len(dup.Stale) > 0})
+		}
+		out = append(out, ld.diagnoseEmulation(layer)...)
+		for _, problem := range ld.hostCompatibilityProblems(layer) {
+			out = append(out, Diagnosis{layer.Name, "host cannot run layer", problem, false})
+		}
+		for _, problem := range ld.portageConfigProblems(layer) {
+			out = append(out, Diagnosis{layer.Name, "Portage configuration", problem, false})
+		}
+	}
+	return out, nil
+}
+
+
+// Repairs the fixable problems Diagnose reports.  Returns the number of repairs made.
+func (ld *Layerdefs) Repair(name string) (int, error) {
+	layers, err := ld.layersToCheck(name)
+	if err != nil {
+		return 0, err
+	}
+	repaired := 0
+	for _, layer := range layers {
+		if layer.State == Layerstate_error {
+			continue
+		}
+		removed, err := ld.RemoveStaleVdbEntries(layer.Name)
+		repaired += removed
+		if err != nil {
+			return repaired, err
+		}
+		if emu := layer.ConfigEmulation; len(emu.Arch) > 0 {
+			entry, err := findBinfmtEntry(emu.Arch)
+			if err == nil && entry == nil {
+				if err = registerEmulation(emu); err == nil {
+					repaired++
+				}
+			}
+			if err != nil {
+				return repaired, err
+			}
+		}
+	}
+	return repaired, nil
+}
+
+
+func (ld *Layerdefs) layersToCheck(name string) ([]*Layerinfo, error) {
+	if len(name) == 0 {
+		return ld.Layers(), nil
+	}
+	err := ld.testName(nametest{name, name_need, "Layer"})
+	if nil != err {
+		return nil, err
+	}
+	return []*Layerinfo{ld.layermap[name]}, nil
+}
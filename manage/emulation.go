@@ -0,0 +1,270 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"strings"
+	"debug/elf"
+	"encoding/hex"
+
+	"potano.layercake/fs"
+	"potano.layercake/defaults"
+)
+
+
+// A foreign architecture whose programs run under a user-mode emulator such as qemu
+type LayerEmulation struct {
+	Arch, Interpreter string
+}
+
+
+/*
+  ELF header patterns by which binfmt_misc recognizes programs of the architectures layers may
+  emulate, in hexadecimal.  The values are those qemu uses:  the masks admit both executables
+  and shared objects and ignore the OS ABI.
+*/
+var emulatedArches = map[string]struct {magic, mask string} {
+	"aarch64": {"7f454c460201010000000000000000000200b700",
+		"ffffffffffffff00fffffffffffffffffeffffff"},
+	"arm": {"7f454c4601010100000000000000000002002800",
+		"ffffffffffffff00fffffffffffffffffeffffff"},
+	"ppc64le": {"7f454c4602010100000000000000000002001500",
+		"fffffffffffffffcfffffffffffffffffeffff00"},
+	"riscv64": {"7f454c460201010000000000000000000200f300",
+		"ffffffffffffff00fffffffffffffffffeffffff"},
+	"s390x": {"7f454c4602020100000000000000000000020016",
+		"fffffffffffffffffffffffffffffffffffeffff"},
+	"x86_64": {"7f454c4602010100000000000000000002003e00",
+		"fffffffffffefe00fffffffffffffffffeffffff"},
+}
+
+
+// Directory where binfmt_misc is mounted; a variable for the sake of testing
+var binfmtMiscDir = defaults.BinfmtMiscDir
+
+
+// Returns the emulation of the layer, which derived layers inherit from their parents
+func (ld *Layerdefs) layerEmulation(layer *Layerinfo) LayerEmulation {
+	for len(layer.ConfigEmulation.Arch) == 0 && len(layer.Base) > 0 {
+		layer = ld.layermap[layer.Base]
+	}
+	return layer.ConfigEmulation
+}
+
+
+// A binfmt_misc entry as described by its file under the binfmt_misc directory
+type binfmtEntry struct {
+	name, interpreter, flags string
+	enabled bool
+	magic, mask []byte
+}
+
+
+func readBinfmtEntry(name string) (*binfmtEntry, error) {
+	blob, err := fs.ReadFile(path.Join(binfmtMiscDir, name))
+	if err != nil {
+		return nil, err
+	}
+	entry := &binfmtEntry{name: name}
+	for _, line := range strings.Split(string(blob), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 1 && fields[0] == "enabled":
+			entry.enabled = true
+		case len(fields) == 2 && fields[0] == "interpreter":
+			entry.interpreter = fields[1]
+		case len(fields) == 2 && fields[0] == "flags:":
+			entry.flags = fields[1]
+		case len(fields) == 2 && fields[0] == "magic":
+			entry.magic, _ = hex.DecodeString(fields[1])
+		case len(fields) == 2 && fields[0] == "mask":
+			entry.mask, _ = hex.DecodeString(fields[1])
+		}
+	}
+	return entry, nil
+}
+
+
+// Reports whether the entry recognizes the same programs as the pattern
+func (entry *binfmtEntry) matches(magic, mask []byte) bool {
+	if len(entry.magic) != len(magic) || len(entry.mask) != len(mask) {
+		return false
+	}
+	for i := range magic {
+		if entry.mask[i] != mask[i] || entry.magic[i] & mask[i] != magic[i] & mask[i] {
+			return false
+		}
+	}
+	return true
+}
+
+
+// Finds the enabled binfmt_misc entry which runs programs of the architecture, if any
+func findBinfmtEntry(arch string) (*binfmtEntry, error) {
+	if !fs.Exists(path.Join(binfmtMiscDir, "register")) {
+		return nil, fmt.Errorf("binfmt_misc is not mounted at %s", binfmtMiscDir)
+	}
+	pattern := emulatedArches[arch]
+	magic, _ := hex.DecodeString(pattern.magic)
+	mask, _ := hex.DecodeString(pattern.mask)
+	names, err := fs.Readdirnames(binfmtMiscDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if name == "register" || name == "status" {
+			continue
+		}
+		entry, err := readBinfmtEntry(name)
+		if err != nil {
+			return nil, err
+		}
+		if entry.enabled && entry.matches(magic, mask) {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+
+/*
+  Registers the interpreter with binfmt_misc unless some interpreter is already registered for
+  the architecture.  The F flag makes the kernel open the interpreter now, so that it need not
+  be found in the chroot when programs run.
+*/
+func registerEmulation(emu LayerEmulation) error {
+	entry, err := findBinfmtEntry(emu.Arch)
+	if err != nil || entry != nil {
+		return err
+	}
+	if !fs.IsFile(emu.Interpreter) {
+		return fmt.Errorf("Interpreter %s for %s programs does not exist", emu.Interpreter,
+			emu.Arch)
+	}
+	pattern := emulatedArches[emu.Arch]
+	rule := fmt.Sprintf(":layercake-%s:M::%s:%s:%s:F", emu.Arch,
+		binfmtEscape(pattern.magic), binfmtEscape(pattern.mask), emu.Interpreter)
+	return fs.RegisterBinfmt(path.Join(binfmtMiscDir, "register"), rule)
+}
+
+
+// Writes each byte of a hexadecimal string in the \x form binfmt_misc rules use
+func binfmtEscape(hexString string) string {
+	var sb strings.Builder
+	for i := 0; i < len(hexString); i += 2 {
+		sb.WriteString(`\x` + hexString[i:i + 2])
+	}
+	return sb.String()
+}
+
+
+/*
+  Registers the layer's interpreter if needed and binds it to the same path in the build root.
+  Should the build root lack a file there to bind onto, an empty one is made and noted in the
+  layer directory so that unmounting removes it again; otherwise it would end up in the layer,
+  in the overlay upper directory of a derived layer.
+*/
+func (ld *Layerdefs) setUpEmulation(layer *Layerinfo) error {
+	emu := ld.layerEmulation(layer)
+	if len(emu.Arch) == 0 {
+		return nil
+	}
+	if err := registerEmulation(emu); err != nil {
+		return err
+	}
+	target := path.Join(ld.buildPath(layer), emu.Interpreter)
+	if ld.mounts.GetMount(target) != nil {
+		return nil
+	}
+	if !fs.Exists(target) {
+		if dir := path.Dir(target); !fs.IsDir(dir) {
+			if err := fs.Mkdir(dir); err != nil {
+				return err
+			}
+		}
+		if err := fs.WriteTextFile(target, ""); err != nil {
+			return err
+		}
+		err := fs.WriteTextFile(ld.emulationPlaceholderPath(layer), emu.Interpreter + "\n")
+		if err != nil {
+			return err
+		}
+	}
+	return fs.Mount(emu.Interpreter, target, "bind", "")
+}
+
+
+func (ld *Layerdefs) emulationPlaceholderPath(layer *Layerinfo) string {
+	return path.Join(layer.LayerPath, defaults.EmulationPlaceholderFile)
+}
+
+
+// Removes the file setUpEmulation made to bind the interpreter onto once the given mountpoint
+// is unmounted, if that was the binding.  The file is left alone if something wrote to it.
+func (ld *Layerdefs) removeEmulationPlaceholder(layer *Layerinfo, mountpoint string) error {
+	marker := ld.emulationPlaceholderPath(layer)
+	text, exists, err := fs.ReadFileIfExists(marker)
+	if err != nil || !exists {
+		return err
+	}
+	target := path.Join(ld.buildPath(layer), strings.TrimSpace(text))
+	if target != mountpoint {
+		return nil
+	}
+	if info, err := os.Lstat(target); err == nil && info.Mode().IsRegular() && info.Size() == 0 {
+		if err = fs.Remove(target); err != nil {
+			return err
+		}
+	}
+	return fs.Remove(marker)
+}
+
+
+// Checks that the layer's interpreter is registered and, since it runs in the chroot without
+// the host's libraries, statically linked
+func (ld *Layerdefs) diagnoseEmulation(layer *Layerinfo) []Diagnosis {
+	emu := layer.ConfigEmulation
+	if len(emu.Arch) == 0 {
+		return nil
+	}
+	var out []Diagnosis
+	entry, err := findBinfmtEntry(emu.Arch)
+	if err != nil {
+		out = append(out, Diagnosis{layer.Name, "cannot check emulation", err.Error(), false})
+	} else if entry == nil {
+		out = append(out, Diagnosis{layer.Name, "emulator not registered",
+			fmt.Sprintf("no binfmt_misc entry runs %s programs", emu.Arch), true})
+	} else if !strings.Contains(entry.flags, "F") && entry.interpreter != emu.Interpreter {
+		out = append(out, Diagnosis{layer.Name, "emulator not in chroot",
+			fmt.Sprintf("binfmt_misc entry %s runs %s, which lacks the F flag and is not " +
+				"bound into the build root; -fix does not replace another entry, so " +
+				"remove it or register it with the F flag", entry.name, entry.interpreter),
+			false})
+	}
+	if static, err := isStaticExecutable(emu.Interpreter); err != nil {
+		out = append(out, Diagnosis{layer.Name, "emulator unusable", err.Error(), false})
+	} else if !static {
+		out = append(out, Diagnosis{layer.Name, "emulator not static",
+			emu.Interpreter + " needs a dynamic loader", false})
+	}
+	return out
+}
+
+
+func isStaticExecutable(filename string) (bool, error) {
+	file, err := elf.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	for _, prog := range file.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,166 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"path"
+	"syscall"
+
+	"testing"
+	"potano.layercake/fs"
+)
+
+
+func TestEmulation(t *testing.T) {
+	td, cfg, layers, cleanup := setUpMountableLayers(t, "layercake_emulation",
+		[]struct {name, base string} {{"arm64", ""}, {"arm64-desktop", "arm64"}})
+	defer cleanup()
+	savedBinfmtMiscDir := binfmtMiscDir
+	binfmtMiscDir = td.Path("/binfmt_misc")
+	defer func () {
+		binfmtMiscDir = savedBinfmtMiscDir
+	}()
+
+	err := td.WriteFile("/layerconfig", "emulate aarch64 /usr/bin/qemu-aarch64\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configured, err := ReadLayerFile(td.Path("/layerconfig"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := LayerEmulation{"aarch64", "/usr/bin/qemu-aarch64"}
+	if configured.ConfigEmulation != want {
+		t.Fatalf("expected emulation %#v, got %#v", want, configured.ConfigEmulation)
+	}
+	err = td.WriteFile("/bad_layerconfig", "emulate vax /usr/bin/qemu-vax\n" +
+		"emulate aarch64 qemu-aarch64\nemulate aarch64\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadLayerFile(td.Path("/bad_layerconfig"), true)
+	bad := td.Path("/bad_layerconfig")
+	checkErrorByMessage(t, err, "Cannot emulate unknown architecture 'vax' in " + bad +
+		" line 1\nInterpreter path must be absolute in " + bad + " line 2\n" +
+		"Emulate directive must give an architecture and an interpreter in " + bad + " line 3",
+		"bad directives")
+
+	interpreter := td.Path("/usr/bin/qemu-aarch64")
+	if err = td.Mkdir("/usr/bin"); err == nil {
+		err = td.WriteFile("/usr/bin/qemu-aarch64", "not really qemu\n")
+	}
+	if err == nil {
+		err = td.Mkdir("/binfmt_misc")
+	}
+	if err == nil {
+		err = td.WriteFile("/binfmt_misc/register", "")
+	}
+	if err == nil {
+		err = td.WriteFile("/binfmt_misc/status", "enabled\n")
+	}
+	if err == nil {
+		err = td.WriteFile("/binfmt_misc/python3.10", "enabled\n" +
+			"interpreter /usr/bin/python3.10\nflags: \noffset 0\nmagic 6f0d0d0a\n")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := layers.Layer("arm64")
+	layer.ConfigEmulation = LayerEmulation{"aarch64", interpreter}
+	if err = layers.writeLayerFile(layer); err != nil {
+		t.Fatal(err)
+	}
+
+	layers = mountForTest(t, cfg, "arm64-desktop")
+	rule, err := td.ReadFile("/binfmt_misc/register")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRule := `:layercake-aarch64:M::` +
+		`\x7f\x45\x4c\x46\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00:` +
+		`\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff:` +
+		interpreter + `:F`
+	if rule != wantRule {
+		t.Errorf("expected registration\n%s\ngot\n%s", wantRule, rule)
+	}
+	for _, name := range []string{"arm64", "arm64-desktop"} {
+		status, err := layers.Status(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bound := false
+		for _, mount := range status.RequiredMounts {
+			bound = bound || mount == interpreter
+		}
+		if status.EmulatedArch != "aarch64" || len(status.OtherMounts) > 0 || !bound {
+			t.Errorf("layer %s: unexpected status %#v", name, status)
+		}
+	}
+
+	problems := func () map[string]bool {
+		diagnoses, err := layers.Diagnose("arm64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := map[string]bool{}
+		for _, diag := range diagnoses {
+			found[diag.Problem] = true
+		}
+		return found
+	}
+	if found := problems(); !found["emulator not registered"] || !found["emulator unusable"] {
+		t.Errorf("expected registration and interpreter problems, got %v", found)
+	}
+	err = td.WriteFile("/binfmt_misc/qemu-aarch64", "enabled\n" +
+		"interpreter /usr/bin/qemu-aarch64-static\nflags: OCF\noffset 0\n" +
+		"magic 7f454c460201010000000000000000000200b700\n" +
+		"mask ffffffffffffff00fffffffffffffffffeffffff\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := problems(); found["emulator not registered"] || found["emulator not in chroot"] {
+		t.Errorf("registered emulator not recognized: %v", found)
+	}
+
+	// Entries under binfmt_misc report size 0, as does a FIFO
+	fifo := td.Path("/binfmt_misc/qemu-aarch64-fifo")
+	if err = syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	go func () {
+		if fh, err := os.OpenFile(fifo, os.O_WRONLY, 0); err == nil {
+			fh.Write([]byte("enabled\ninterpreter /usr/bin/qemu-aarch64\nflags: F\n"))
+			fh.Close()
+		}
+	}()
+	entry, err := readBinfmtEntry(path.Base(fifo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !entry.enabled || entry.interpreter != "/usr/bin/qemu-aarch64" || entry.flags != "F" {
+		t.Errorf("zero-size entry read as %#v", entry)
+	}
+	if err = os.Remove(fifo); err != nil {
+		t.Fatal(err)
+	}
+
+	// The files made to bind the interpreter onto go away on unmounting
+	var placeholders []string
+	for _, name := range []string{"arm64", "arm64-desktop"} {
+		placeholder := path.Join(layers.buildPath(layers.Layer(name)), interpreter)
+		if !fs.IsFile(placeholder) {
+			t.Fatalf("layer %s: no file %s to bind the interpreter onto", name, placeholder)
+		}
+		placeholders = append(placeholders, placeholder)
+	}
+	if err = layers.Unmount("", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, placeholder := range placeholders {
+		if fs.Exists(placeholder) {
+			t.Errorf("placeholder %s left after unmounting", placeholder)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"fmt"
+	"strings"
+
+	"potano.layercake/fs"
+	"potano.layercake/defaults"
+)
+
+
+// Environment settings kept in the order first set, with later settings replacing earlier ones
+type environment struct {
+	keys []string
+	values map[string]string
+}
+
+
+func newEnvironment() *environment {
+	return &environment{values: map[string]string{}}
+}
+
+
+func (env *environment) set(setting string) {
+	pos := strings.IndexByte(setting, '=')
+	key, value := setting[:pos], setting[pos + 1:]
+	if _, have := env.values[key]; !have {
+		env.keys = append(env.keys, key)
+	}
+	env.values[key] = value
+}
+
+
+func (env *environment) list() []string {
+	out := make([]string, len(env.keys))
+	for i, key := range env.keys {
+		out[i] = key + "=" + env.values[key]
+	}
+	return out
+}
+
+
+func isLegalEnvSetting(setting string) bool {
+	pos := strings.IndexByte(setting, '=')
+	if pos < 1 {
+		return false
+	}
+	for i, c := range setting[:pos] {
+		if !(c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') ||
+			(i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+
+/*
+  Returns the environment of chroot and exec sessions in the named layer.  Sessions start with
+  a clean environment rather than layercake's own so that host settings do not leak into
+  builds.  In increasing order of precedence, the environment consists of a basic set of
+  variables, those describing the user of a session run as another user than root, the host
+  variables named by the allowlist configuration setting, the settings in the layer's
+  envfiles, its env settings, and LAYERCAKE_LAYER.
+*/
+func (ld *Layerdefs) ChrootEnvironment(name string) ([]string, error) {
+	err := ld.testName(nametest{name, name_need, "Layer"})
+	if nil != err {
+		return nil, err
+	}
+	return ld.chrootEnvironment(ld.layermap[name], nil)
+}
+
+
+func (ld *Layerdefs) chrootEnvironment(layer *Layerinfo, usr *sessionUser) ([]string, error) {
+	env := newEnvironment()
+	for _, setting := range strings.Fields(defaults.ChrootEnvironment) {
+		env.set(setting)
+	}
+	if usr != nil {
+		for _, setting := range usr.identity() {
+			env.set(setting)
+		}
+	}
+	for _, key := range strings.Fields(ld.cfg.EnvAllow) {
+		if value, have := os.LookupEnv(key); have {
+			env.set(key + "=" + value)
+		}
+	}
+	for _, filename := range layer.ConfigEnvFiles {
+		pathname, err := ld.expandLayerPath(layer, filename)
+		if err != nil {
+			return nil, err
+		}
+		settings, err := readEnvFile(pathname)
+		if err != nil {
+			return nil, err
+		}
+		for _, setting := range settings {
+			env.set(setting)
+		}
+	}
+	for _, setting := range layer.ConfigEnv {
+		env.set(setting)
+	}
+	env.set("LAYERCAKE_LAYER=" + layer.Name)
+	return env.list(), nil
+}
+
+
+// Resolves a host path named in a layerconfig.  Relative paths are relative to the layer
+// directory.
+func (ld *Layerdefs) expandLayerPath(layer *Layerinfo, pathname string) (string, error) {
+	return fs.AdjustPrefixedPath(pathname, layer.LayerPath,
+		func (symbol, tail string) (string, error) {
+			switch symbol {
+			case "base":
+				return ld.findLayerBase(layer).LayerPath, nil
+			case "self":
+				return layer.LayerPath, nil
+			}
+			return "", fmt.Errorf("unknown key %s", symbol)
+		})
+}
+
+
+// Reads KEY=value lines, which may start with "export" and have a quoted value
+func readEnvFile(filename string) ([]string, error) {
+	cursor, err := fs.NewTextInputFileCursor(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%s reading envfile", err)
+	}
+	defer cursor.Close()
+	settings := []string{}
+	var line string
+	for cursor.ReadNonBlankNonCommentLine(&line) {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "export ") {
+			line = strings.TrimSpace(line[len("export "):])
+		}
+		if !isLegalEnvSetting(line) {
+			cursor.LogError("Environment setting must have the form KEY=value")
+			continue
+		}
+		pos := strings.IndexByte(line, '=')
+		value := line[pos + 1:]
+		if len(value) > 1 && (value[0] == '"' || value[0] == '\'') &&
+			value[len(value) - 1] == value[0] {
+			value = value[1:len(value) - 1]
+		}
+		settings = append(settings, line[:pos + 1] + value)
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
@@ -0,0 +1,95 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"strings"
+
+	"testing"
+	"potano.layercake/config"
+)
+
+
+func TestChrootEnvironment(t *testing.T) {
+	td, err := NewTmpdir("layercake_environment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.EnvAllow = "TERM LAYERCAKE_TEST_ALLOWED"
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.AddLayer("base", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	layer := layers.Layer("base")
+
+	err = td.WriteFile("/var/lib/layercake/layers/base/build.env", `# settings for builds
+export MAKEOPTS="-j8"
+LANG='C.UTF-8'
+EDITOR=nano
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.ConfigEnvFiles = []string{"$$self/build.env"}
+	layer.ConfigEnv = []string{"EDITOR=vi", "FEATURES=-sandbox test"}
+	if err = layers.writeLayerFile(layer); err != nil {
+		t.Fatal(err)
+	}
+	reread, err := ReadLayerFile(layers.layerconfigFilePath(layer), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameStrings(reread.ConfigEnv, layer.ConfigEnv) ||
+		!sameStrings(reread.ConfigEnvFiles, layer.ConfigEnvFiles) {
+		t.Fatalf("environment directives not preserved: env %v, envfile %v",
+			reread.ConfigEnv, reread.ConfigEnvFiles)
+	}
+
+	for key, value := range map[string]string{"TERM": "xterm",
+		"LAYERCAKE_TEST_ALLOWED": "yes", "PYTHONPATH": "/opt/lib/python"} {
+		if saved, have := os.LookupEnv(key); have {
+			defer os.Setenv(key, saved)
+		} else {
+			defer os.Unsetenv(key)
+		}
+		os.Setenv(key, value)
+	}
+	env, err := layers.ChrootEnvironment("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin HOME=/root " +
+		"SHELL=/bin/bash USER=root LOGNAME=root TERM=xterm LAYERCAKE_TEST_ALLOWED=yes " +
+		"MAKEOPTS=-j8 LANG=C.UTF-8 EDITOR=vi FEATURES=-sandbox test LAYERCAKE_LAYER=base"
+	if have := strings.Join(env, " "); have != want {
+		t.Errorf("expected environment\n%s\ngot\n%s", want, have)
+	}
+
+	layer.ConfigEnvFiles = []string{"missing.env"}
+	_, err = layers.ChrootEnvironment("base")
+	if err == nil || !strings.HasSuffix(err.Error(), "reading envfile") {
+		t.Errorf("expected error reading missing envfile, got %v", err)
+	}
+
+	err = td.WriteFile("/bad_layerconfig", "env 9LIVES=yes\nenvfile\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadLayerFile(td.Path("/bad_layerconfig"), true)
+	checkErrorByMessage(t, err, "Environment setting must have the form KEY=value in " +
+		td.Path("/bad_layerconfig") + " line 1\nEnvfile directive must name one file in " +
+		td.Path("/bad_layerconfig") + " line 2", "bad directives")
+}
@@ -0,0 +1,42 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"errors"
+)
+
+
+// Kinds of failure which callers may test for with errors.Is
+var (
+	ErrNotFound = errors.New("layer not found")
+	ErrLayerBusy = errors.New("layer is busy")
+	ErrCycle = errors.New("cycle of inheritance")
+	ErrNotMountable = errors.New("layer is not mountable")
+)
+
+
+// Error concerning a particular layer.  The message is meant for people; Kind, one of the Err
+// values above, is meant for programs.
+type LayerError struct {
+	Layer string
+	Kind error
+	msg string
+}
+
+
+func (e *LayerError) Error() string {
+	return e.msg
+}
+
+
+func (e *LayerError) Unwrap() error {
+	return e.Kind
+}
+
+
+func layerErrorf(kind error, layer, format string, params...interface{}) error {
+	return &LayerError{Layer: layer, Kind: kind, msg: fmt.Sprintf(format, params...)}
+}
@@ -114,9 +114,15 @@ func (ld *Layerdefs) makeExportSymlinks(layer *Layerinfo) error {
 			return err
 		}
 	}
+	return ld.makeLayerExportLinks(layer)
+}
+
+
+// Makes the links under the export directory to the layer's binary packages and generated files
+func (ld *Layerdefs) makeLayerExportLinks(layer *Layerinfo) error {
 	for _, item := range ld.automatedLayerExportPaths(layer) {
 		if fs.Exists(item.Source) {
-			err = makeSymlinkInDirectory(item.Source, item.Mount)
+			err := makeSymlinkInDirectory(item.Source, item.Mount)
 			if err != nil {
 				return err
 			}
@@ -0,0 +1,75 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"potano.layercake/fs"
+	"potano.layercake/defaults"
+	"potano.layercake/portage/vdb"
+)
+
+
+/*
+  Returns a stamp which changes whenever a layer's contents may have changed.  The stamp
+  combines a counter, bumped when a session not declared read-only exits, with the
+  modification time of the layer's installed-package database, which Portage updates with
+  each merge or unmerge.
+*/
+func (ld *Layerdefs) generationStamp(layer *Layerinfo) string {
+	var mtime int64
+	pkgDbPath := path.Join(ld.buildPath(layer), vdb.PackageDatabasePath)
+	if info, err := os.Stat(pkgDbPath); err == nil {
+		mtime = info.ModTime().UnixNano()
+	}
+	return fmt.Sprintf("%d.%d", ld.generationCounter(layer), mtime)
+}
+
+
+func (ld *Layerdefs) generationCounter(layer *Layerinfo) int {
+	text, _, _ := fs.ReadFileIfExists(path.Join(layer.LayerPath, defaults.GenerationFile))
+	counter, _ := strconv.Atoi(strings.TrimSpace(text))
+	return counter
+}
+
+
+func (ld *Layerdefs) bumpGeneration(layer *Layerinfo) error {
+	return fs.WriteTextFile(path.Join(layer.LayerPath, defaults.GenerationFile),
+		strconv.Itoa(ld.generationCounter(layer) + 1) + "\n")
+}
+
+
+// Records the parent's generation stamp when a derived layer is mounted or remounted
+func (ld *Layerdefs) recordLowerGeneration(layer *Layerinfo) error {
+	if len(layer.Base) == 0 {
+		return nil
+	}
+	return fs.WriteTextFile(path.Join(layer.LayerPath, defaults.LowerGenerationFile),
+		ld.generationStamp(ld.layermap[layer.Base]) + "\n")
+}
+
+
+/*
+  Reports whether a mounted derived layer's view of its parent may be stale because the
+  parent, or one of its ancestors, changed after the layer was mounted.  Overlayfs gives
+  undefined results when a lower directory changes under a mounted overlay; remounting the
+  layer with the shake command brings it up to date.
+*/
+func (ld *Layerdefs) ViewIsStale(layer *Layerinfo) bool {
+	if len(layer.Base) == 0 || ld.mounts.GetMount(ld.buildPath(layer)) == nil {
+		return false
+	}
+	parent := ld.layermap[layer.Base]
+	text, exists, _ := fs.ReadFileIfExists(path.Join(layer.LayerPath,
+		defaults.LowerGenerationFile))
+	if exists && strings.TrimSpace(text) != ld.generationStamp(parent) {
+		return true
+	}
+	return ld.ViewIsStale(parent)
+}
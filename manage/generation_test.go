@@ -0,0 +1,136 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"testing"
+	"potano.layercake/config"
+	"potano.layercake/fs"
+)
+
+
+func TestViewIsStale(t *testing.T) {
+	td, err := NewTmpdir("layercake_generation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, def := range []struct {name, base string} {
+		{"base", ""}, {"derived", "base"}, {"grandchild", "derived"},
+	} {
+		if err = layers.AddLayer(def.name, def.base, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := layers.Layer("base")
+	derived := layers.Layer("derived")
+	grandchild := layers.Layer("grandchild")
+	pkgDbPath := path.Join(layers.buildPath(base), "var/db/pkg")
+	if err = fs.Mkdir(pkgDbPath); err != nil {
+		t.Fatal(err)
+	}
+
+	m_ninja := newMountNinja()
+	fs.GetAlternateProbeMountsCursor = func () fs.LineReader {
+		return fs.NewTextInputCursor("mountNinja", strings.NewReader(m_ninja.mountinfo()))
+	}
+	defer func () {
+		fs.GetAlternateProbeMountsCursor = nil
+	}()
+	for _, layer := range []*Layerinfo{derived, grandchild} {
+		lower := layers.buildPath(layers.Layer(layer.Base))
+		err = m_ninja.mount("overlay", layers.buildPath(layer), "overlay", 0,
+			"lowerdir=" + lower + ",upperdir=" + layers.ovfsUpperPath(layer) +
+			",workdir=" + layers.ovfsWorkPath(layer))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = layers.refreshMountInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.recordLowerGeneration(derived); err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.recordLowerGeneration(grandchild); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func (phase string, wantDerived, wantGrandchild bool) {
+		if have := layers.ViewIsStale(derived); have != wantDerived {
+			t.Errorf("%s: expected derived stale=%t, got %t", phase, wantDerived, have)
+		}
+		if have := layers.ViewIsStale(grandchild); have != wantGrandchild {
+			t.Errorf("%s: expected grandchild stale=%t, got %t", phase, wantGrandchild,
+				have)
+		}
+	}
+	check("after mount", false, false)
+
+	if err = layers.bumpGeneration(base); err != nil {
+		t.Fatal(err)
+	}
+	check("after chroot in base", true, true)
+
+	if err = layers.recordLowerGeneration(derived); err != nil {
+		t.Fatal(err)
+	}
+	check("after remount of derived", false, false)
+
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(pkgDbPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	check("after merge in base", true, true)
+}
+
+
+func TestSessionBumpsGeneration(t *testing.T) {
+	td, cfg, _, cleanup := setUpMountableLayers(t, "layercake_generation_session",
+		[]struct {name, base string} {{"base", ""}, {"derived", "base"}})
+	defer cleanup()
+	layers := mountForTest(t, cfg, "derived")
+	if err := td.WriteFile("/chroot", "#!/bin/sh\nexit 0\n"); err != nil {
+		t.Fatal(err)
+	}
+	cfg.ChrootExec = td.Path("/chroot")
+	if err := os.Chmod(cfg.ChrootExec, 0755); err != nil {
+		t.Fatal(err)
+	}
+	base := layers.Layer("base")
+	for _, tst := range []struct {
+		session Session
+		want int
+	} {
+		{Session{ReadOnly: true}, 0},
+		{Session{}, 1},
+	} {
+		if err := layers.Exec("base", []string{"ls"}, tst.session); err != nil {
+			t.Fatal(err)
+		}
+		if have := layers.generationCounter(base); have != tst.want {
+			t.Errorf("session %#v: expected generation %d, got %d", tst.session, tst.want,
+				have)
+		}
+	}
+	if !layers.ViewIsStale(layers.Layer("derived")) {
+		t.Errorf("derived layer not stale after modifying session in base")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"sort"
+	"runtime"
+	"strings"
+
+	"potano.layercake/fs"
+	"potano.layercake/defaults"
+)
+
+
+/*
+  Instruction-set features which code compiled with a given -march needs, named as in the flags
+  line of /proc/cpuinfo.  Each entry adds features to those of the entry it builds on.
+*/
+var marchFeatures = map[string]struct {base, features string} {
+	"i686": {"", "fpu cx8 cmov"},
+	"pentium4": {"i686", "mmx sse sse2"},
+	"prescott": {"pentium4", "pni"},
+	"x86-64": {"", "fpu cx8 cmov mmx fxsr sse sse2 lm"},
+	"x86-64-v2": {"x86-64", "cx16 lahf_lm popcnt pni sse4_1 sse4_2 ssse3"},
+	"x86-64-v3": {"x86-64-v2", "avx avx2 bmi1 bmi2 f16c fma abm movbe xsave"},
+	"x86-64-v4": {"x86-64-v3", "avx512f avx512bw avx512cd avx512dq avx512vl"},
+	"core2": {"x86-64", "pni ssse3 cx16"},
+	"nehalem": {"x86-64-v2", ""},
+	"westmere": {"nehalem", "aes pclmulqdq"},
+	"sandybridge": {"westmere", "avx xsave"},
+	"ivybridge": {"sandybridge", "f16c rdrand fsgsbase"},
+	"haswell": {"ivybridge", "avx2 bmi1 bmi2 fma abm movbe"},
+	"broadwell": {"haswell", "adx rdseed"},
+	"skylake": {"broadwell", "clflushopt xsavec"},
+	"skylake-avx512": {"skylake", "avx512f avx512bw avx512cd avx512dq avx512vl clwb"},
+	"cascadelake": {"skylake-avx512", "avx512_vnni"},
+	"icelake-client": {"skylake-avx512", "avx512vbmi avx512_vbmi2 avx512_vnni avx512_bitalg " +
+		"avx512_vpopcntdq avx512ifma gfni vaes vpclmulqdq sha_ni"},
+	"icelake-server": {"icelake-client", ""},
+	"tigerlake": {"icelake-client", "movdiri movdir64b"},
+	"sapphirerapids": {"icelake-server", "avx512_bf16 avx512_fp16 amx_tile amx_bf16 amx_int8 " +
+		"serialize movdiri movdir64b"},
+	"alderlake": {"skylake", "gfni vaes vpclmulqdq sha_ni serialize movdiri movdir64b"},
+	"znver1": {"x86-64-v3", "aes pclmulqdq adx rdseed sha_ni clzero clflushopt xsavec"},
+	"znver2": {"znver1", "clwb rdpid"},
+	"znver3": {"znver2", "vaes vpclmulqdq"},
+	"znver4": {"znver3", "avx512f avx512bw avx512cd avx512dq avx512vl avx512ifma avx512vbmi " +
+		"avx512_vbmi2 avx512_bf16 avx512_vnni avx512_bitalg avx512_vpopcntdq gfni"},
+	"znver5": {"znver4", "movdiri movdir64b"},
+}
+
+
+// The machine parts of the CHOSTs of code each host architecture can run natively
+var nativeMachines = map[string][]string{
+	"amd64": {"x86_64", "i386", "i486", "i586", "i686"},
+	"386": {"i386", "i486", "i586", "i686"},
+	"arm64": {"aarch64", "arm"},
+	"arm": {"arm"},
+	"ppc64le": {"powerpc64le"},
+	"ppc64": {"powerpc64", "powerpc"},
+	"riscv64": {"riscv64"},
+	"s390x": {"s390x", "s390"},
+}
+
+
+// Variables for the sake of testing
+var hostArch = runtime.GOARCH
+var cpuinfoPath = defaults.CpuinfoPath
+
+
+// Returns the instruction-set features needed by code compiled with -march set as given, or
+// nil if it is not in the table
+func marchRequirements(march string) map[string]bool {
+	if _, known := marchFeatures[march]; !known {
+		return nil
+	}
+	out := map[string]bool{}
+	for len(march) > 0 {
+		entry := marchFeatures[march]
+		for _, feature := range strings.Fields(entry.features) {
+			out[feature] = true
+		}
+		march = entry.base
+	}
+	return out
+}
+
+
+// Reads the instruction-set features of the host's first processor from /proc/cpuinfo
+func hostCPUFeatures() (map[string]bool, error) {
+	cursor, err := fs.NewTextInputFileCursor(cpuinfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var line string
+	for cursor.ReadNonBlankNonCommentLine(&line) {
+		pos := strings.IndexByte(line, ':')
+		if pos < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:pos])
+		if key == "flags" || key == "Features" {
+			out := map[string]bool{}
+			for _, feature := range strings.Fields(line[pos + 1:]) {
+				out[feature] = true
+			}
+			return out, nil
+		}
+	}
+	return nil, cursor.Err()
+}
+
+
+// Returns the last -march setting in compiler flags
+func marchSetting(flags string) string {
+	var march string
+	for _, flag := range strings.Fields(flags) {
+		if strings.HasPrefix(flag, "-march=") {
+			march = flag[len("-march="):]
+		}
+	}
+	return march
+}
+
+
+func chostMachine(chost string) string {
+	if pos := strings.IndexByte(chost, '-'); pos > 0 {
+		return chost[:pos]
+	}
+	return chost
+}
+
+
+/*
+  Checks whether the host can execute the code of the layer, whose CHOST and -march settings
+  must suit the host's processor since layers run natively.  Returns a description of each
+  problem found.  Layers which emulate another architecture and layers whose settings cannot
+  be read are not checked.
+*/
+func (ld *Layerdefs) hostCompatibilityProblems(layer *Layerinfo) []string {
+	if len(ld.layerEmulation(layer).Arch) > 0 {
+		return nil
+	}
+	vars, err := ld.readPortageSettings(layer, nil)
+	if err != nil {
+		return nil
+	}
+	var problems []string
+	chost := vars["CHOST"]
+	if machines, known := nativeMachines[hostArch]; known && len(chost) > 0 {
+		native := false
+		for _, machine := range machines {
+			native = native || strings.HasPrefix(chostMachine(chost), machine)
+		}
+		if !native {
+			return append(problems, fmt.Sprintf("CHOST %s cannot run natively on this %s " +
+				"host", chost, hostArch))
+		}
+	}
+	march := marchSetting(vars["CFLAGS"])
+	if len(march) == 0 {
+		march = marchSetting(vars["COMMON_FLAGS"])
+	}
+	required := marchRequirements(march)
+	if required == nil || (hostArch != "amd64" && hostArch != "386") {
+		return problems
+	}
+	have, err := hostCPUFeatures()
+	if err != nil || have == nil {
+		return problems
+	}
+	missing := []string{}
+	for feature := range required {
+		if !have[feature] {
+			missing = append(missing, feature)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		problems = append(problems, fmt.Sprintf("host processor lacks %s needed by " +
+			"-march=%s", strings.Join(missing, " "), march))
+	}
+	return problems
+}
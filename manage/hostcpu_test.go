@@ -0,0 +1,110 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"bytes"
+	"strings"
+
+	"testing"
+	"potano.layercake/fs"
+	"potano.layercake/config"
+)
+
+
+func TestHostCompatibility(t *testing.T) {
+	td, err := NewTmpdir("layercake_hostcpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	savedHostArch, savedCpuinfoPath, savedWriter := hostArch, cpuinfoPath, fs.MessageWriter
+	defer func () {
+		hostArch, cpuinfoPath, fs.MessageWriter = savedHostArch, savedCpuinfoPath, savedWriter
+	}()
+	hostArch = "amd64"
+	cpuinfoPath = td.Path("/cpuinfo")
+	err = td.WriteFile("/cpuinfo", "processor\t: 0\nvendor_id\t: GenuineIntel\n" +
+		"model name\t: Intel(R) Xeon(R) CPU E5-2680 v3 @ 2.50GHz\n" +
+		"flags\t\t: fpu vme de pse tsc msr pae mce cx8 apic sep mtrr pge mca cmov pat pse36 " +
+		"clflush mmx fxsr sse sse2 ss ht syscall nx lm constant_tsc pni pclmulqdq ssse3 fma " +
+		"cx16 sse4_1 sse4_2 movbe popcnt aes xsave avx f16c rdrand lahf_lm abm fsgsbase bmi1 " +
+		"avx2 bmi2\n\nprocessor\t: 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.AddLayer("base", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	layer := layers.Layer("base")
+	if problems := layers.hostCompatibilityProblems(layer); len(problems) > 0 {
+		t.Errorf("unpopulated layer: unexpected problems %v", problems)
+	}
+
+	portageDir := "/var/lib/layercake/layers/base/build/etc/portage"
+	if err = td.Mkdir(portageDir + "/make.profile"); err == nil {
+		err = td.WriteFile(portageDir + "/make.profile/make.defaults",
+			"CHOST=\"x86_64-pc-linux-gnu\"\nCFLAGS=\"-O2 -pipe\"\n" +
+			"FEATURES=\"buildpkg binpkg-multi-instance\"\n")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tst := range []struct {
+		makeConf, want string
+	} {
+		{"COMMON_FLAGS=\"-O2 -march=haswell\"\nCFLAGS=\"${COMMON_FLAGS}\"\n", ""},
+		{"COMMON_FLAGS=\"-O2 -march=x86-64-v2 -pipe\"\n", ""},
+		{"CFLAGS=\"-O2 -march=native\"\n", ""},
+		{"COMMON_FLAGS=\"-O2 -march=znver4\"\nCFLAGS=\"${COMMON_FLAGS}\"\n",
+			"host processor lacks adx avx512_bf16 avx512_bitalg avx512_vbmi2 avx512_vnni " +
+			"avx512_vpopcntdq avx512bw avx512cd avx512dq avx512f avx512ifma avx512vbmi " +
+			"avx512vl clflushopt clwb clzero gfni rdpid rdseed sha_ni vaes vpclmulqdq xsavec " +
+			"needed by -march=znver4"},
+		{"CHOST=\"aarch64-unknown-linux-gnu\"\nCFLAGS=\"-O2 -march=armv8-a\"\n",
+			"CHOST aarch64-unknown-linux-gnu cannot run natively on this amd64 host"},
+	} {
+		if err = td.WriteFile(portageDir + "/make.conf", tst.makeConf); err != nil {
+			t.Fatal(err)
+		}
+		problems := strings.Join(layers.hostCompatibilityProblems(layer), "; ")
+		if problems != tst.want {
+			t.Errorf("make.conf %q: expected %q, got %q", tst.makeConf, tst.want, problems)
+		}
+	}
+
+	var messages bytes.Buffer
+	fs.MessageWriter = &messages
+	if err = layers.AddLayer("derived", "base", ""); err != nil {
+		t.Fatal(err)
+	}
+	want := "Warning: parent layer base: CHOST aarch64-unknown-linux-gnu cannot run " +
+		"natively on this amd64 host\n"
+	if messages.String() != want {
+		t.Errorf("expected add warning %q, got %q", want, messages.String())
+	}
+	diagnoses, err := layers.Diagnose("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diagnoses) != 1 || diagnoses[0].Problem != "host cannot run layer" {
+		t.Errorf("unexpected diagnoses %#v", diagnoses)
+	}
+
+	layer.ConfigEmulation = LayerEmulation{"aarch64", "/usr/bin/qemu-aarch64"}
+	if problems := layers.hostCompatibilityProblems(layer); len(problems) > 0 {
+		t.Errorf("emulated layer: unexpected problems %v", problems)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"syscall"
+
+	"potano.layercake/fs"
+)
+
+
+// Namespaces a layerconfig may give chroot sessions in place of the host's
+var namespaceCloneflags = map[string]uintptr{
+	"net": syscall.CLONE_NEWNET,
+	"uts": syscall.CLONE_NEWUTS,
+	"pid": syscall.CLONE_NEWPID,
+	"ipc": syscall.CLONE_NEWIPC,
+}
+
+
+func (layer *Layerinfo) hasNamespace(ns string) bool {
+	for _, have := range layer.ConfigNamespaces {
+		if have == ns {
+			return true
+		}
+	}
+	return false
+}
+
+
+// Host names are dot-separated labels of letters, digits, and hyphens
+func isLegalHostname(name string) bool {
+	if len(name) < 1 || len(name) > 64 {
+		return false
+	}
+	labelLen := 0
+	for i, c := range name {
+		switch {
+		case c == '.':
+			if labelLen == 0 || name[i - 1] == '-' {
+				return false
+			}
+			labelLen = 0
+			continue
+		case c == '-':
+			if labelLen == 0 {
+				return false
+			}
+		case !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')):
+			return false
+		}
+		labelLen++
+	}
+	return labelLen > 0 && name[len(name) - 1] != '-'
+}
+
+
+// Describes the namespaces and personality of chroot sessions in the layer.  Setting the host
+// name implies a UTS namespace, lest the session rename the host.
+func (layer *Layerinfo) chrootSetup() fs.ChrootSetup {
+	setup := fs.ChrootSetup{Hostname: layer.ConfigHostname,
+		Personality: personalities[layer.ConfigPersonality]}
+	for _, ns := range layer.ConfigNamespaces {
+		setup.Cloneflags |= namespaceCloneflags[ns]
+	}
+	if len(setup.Hostname) > 0 {
+		setup.Cloneflags |= syscall.CLONE_NEWUTS
+	}
+	return setup
+}
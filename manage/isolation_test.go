@@ -0,0 +1,68 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"syscall"
+
+	"testing"
+)
+
+
+func TestIsolationDirectives(t *testing.T) {
+	td, err := NewTmpdir("layercake_isolation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+
+	err = td.WriteFile("/layerconfig", "namespace net pid\nnamespace net\nhostname amd64-build\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := ReadLayerFile(td.Path("/layerconfig"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameStrings(layer.ConfigNamespaces, []string{"net", "pid"}) ||
+		layer.ConfigHostname != "amd64-build" {
+		t.Fatalf("unexpected namespaces %v and hostname %s", layer.ConfigNamespaces,
+			layer.ConfigHostname)
+	}
+	setup := layer.chrootSetup()
+	if want := uintptr(syscall.CLONE_NEWNET | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS);
+		setup.Cloneflags != want || setup.Hostname != "amd64-build" {
+		t.Errorf("expected clone flags %x, got %#v", want, setup)
+	}
+
+	if err = WriteLayerfile(td.Path("/layerconfig"), layer); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := td.ReadFile("/layerconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\nnamespace net pid\nhostname amd64-build\n"; contents != want {
+		t.Errorf("expected layerconfig %q, got %q", want, contents)
+	}
+
+	err = td.WriteFile("/bad_layerconfig",
+		"namespace mnt\nhostname -bad\nhostname good\nhostname other\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadLayerFile(td.Path("/bad_layerconfig"), true)
+	bad := td.Path("/bad_layerconfig")
+	checkErrorByMessage(t, err, "Unknown namespace 'mnt' in " + bad + " line 1\n" +
+		"Hostname directive must give a valid host name in " + bad + " line 2\n" +
+		"New conflicting setting of hostname property in " + bad + " line 4",
+		"bad directives")
+
+	for name, legal := range map[string]bool{"build": true, "arm64.example.org": true,
+		"x-1": true, "": false, "a..b": false, "a-.b": false, "b-": false, "a_b": false} {
+		if isLegalHostname(name) != legal {
+			t.Errorf("host name %q: expected legal=%t", name, legal)
+		}
+	}
+}
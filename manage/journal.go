@@ -0,0 +1,130 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"potano.layercake/fs"
+	"potano.layercake/defaults"
+)
+
+
+/*
+  Operations which change more than one file record their intent in a journal file in the
+  base directory before starting and remove it when done.  If a command which changes layers
+  finds a journal, the operation was interrupted; it completes the operation if it got far
+  enough and otherwise undoes it.  Only renames need this, since other operations change a
+  single file, which they replace atomically.  The journal holds a single line:
+
+    rename <oldname> <newname>
+
+  An empty field is written as "-".
+*/
+func (ld *Layerdefs) journalPath() string {
+	return path.Join(ld.cfg.Basepath, defaults.JournalFile)
+}
+
+
+func (ld *Layerdefs) beginJournal(fields...string) error {
+	filename := ld.journalPath()
+	if fs.Exists(filename) {
+		return fmt.Errorf("Interrupted operation pending in %s", filename)
+	}
+	for i, field := range fields {
+		if len(field) == 0 {
+			fields[i] = "-"
+		}
+	}
+	return writeFileAtomically(filename, strings.Join(fields, " ") + "\n")
+}
+
+
+func (ld *Layerdefs) endJournal() error {
+	return fs.Remove(ld.journalPath())
+}
+
+
+// Completes or undoes an operation interrupted before it could remove its journal.  A journal
+// may also belong to an operation still running in another process, so the caller must hold
+// the lock.
+func (ld *Layerdefs) recoverJournal() error {
+	filename := ld.journalPath()
+	if !fs.Exists(filename) {
+		return nil
+	}
+	text, exists, err := fs.ReadFileIfExists(filename)
+	if err != nil || !exists {
+		return err
+	}
+	fields := strings.Fields(text)
+	for i, field := range fields {
+		if field == "-" {
+			fields[i] = ""
+		}
+	}
+	switch {
+	case len(fields) == 3 && fields[0] == "rename":
+		err = ld.recoverRename(fields[1], fields[2])
+	default:
+		err = fmt.Errorf("unrecognized entry")
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot recover interrupted operation in %s: %s", filename, err)
+	}
+	return ld.endJournal()
+}
+
+
+/*
+  A rename removes the layer's export links, renames its directory, and rewrites the
+  layerconfig files of its children.  Once the directory has the new name, the rename is
+  completed by removing any export links left under the old name and rewriting the children.
+  Otherwise it is undone by rewriting the children which were changed and restoring the export
+  links.
+*/
+func (ld *Layerdefs) recoverRename(oldname, newname string) error {
+	haveOld := fs.Exists(ld.layerPath(oldname))
+	haveNew := fs.Exists(ld.layerPath(newname))
+	var from, to string
+	switch {
+	case haveNew && !haveOld:
+		from, to = oldname, newname
+		fs.Printf("Completing interrupted rename of layer %s to %s\n", oldname, newname)
+		stale := &Layerinfo{Name: oldname, LayerPath: ld.layerPath(oldname)}
+		if err := ld.removeLayerExportLinks(stale); err != nil {
+			return err
+		}
+	case haveOld && !haveNew:
+		from, to = newname, oldname
+		fs.Printf("Undoing interrupted rename of layer %s to %s\n", oldname, newname)
+	default:
+		return fmt.Errorf("cannot tell whether layer %s was renamed to %s", oldname, newname)
+	}
+	for _, child := range ld.layermap {
+		if child.Base == from {
+			child.Base = to
+			if err := ld.writeLayerFile(child); err != nil {
+				return err
+			}
+		}
+	}
+	if to == oldname {
+		return ld.makeLayerExportLinks(ld.layermap[oldname])
+	}
+	return nil
+}
+
+
+// Writes a file under a temporary name and renames it into place so that readers see either
+// the old or the new contents
+func writeFileAtomically(filename, contents string) error {
+	tmpname := filename + defaults.NewFileSuffix
+	if err := fs.WriteTextFile(tmpname, contents); err != nil {
+		return err
+	}
+	return fs.Rename(tmpname, filename)
+}
@@ -0,0 +1,173 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"testing"
+	"potano.layercake/config"
+	"potano.layercake/defaults"
+	"potano.layercake/fs"
+)
+
+
+func TestJournalRecovery(t *testing.T) {
+	td, err := NewTmpdir("layercake_journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, def := range []struct {name, base string} {
+		{"base", ""}, {"derived", "base"}, {"other", "base"},
+	} {
+		if err = layers.AddLayer(def.name, def.base, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal := path.Join(cfg.Basepath, defaults.JournalFile)
+	reload := func () *Layerdefs {
+		if err := Lock(cfg, 0); err != nil {
+			t.Fatal(err)
+		}
+		layers, err := findLayers(cfg, &config.Opts{}, true)
+		Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fs.Exists(journal) {
+			t.Fatalf("journal still present after recovery")
+		}
+		return layers
+	}
+
+	exportLink := func (name string) string {
+		return path.Join(cfg.Exportdirs, cfg.ExportBinPkgdir, name)
+	}
+	binpkgs := path.Join(cfg.Layerdirs, "base", cfg.LayerBinPkgdir)
+	if err = os.MkdirAll(binpkgs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.makeLayerExportLinks(layers.Layer("base")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("read-only load leaves journal", func (t *testing.T) {
+		if err := fs.WriteTextFile(journal, "rename base newbase\n"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := FindLayers(cfg, &config.Opts{}); err != nil {
+			t.Fatal(err)
+		}
+		if !fs.Exists(journal) {
+			t.Fatalf("read-only load removed the journal")
+		}
+		os.Remove(journal)
+	})
+
+	t.Run("rename rolled forward", func (t *testing.T) {
+		// Simulate a crash after the directory was renamed but before the children were
+		// rewritten
+		if err := fs.WriteTextFile(journal, "rename base newbase\n"); err != nil {
+			t.Fatal(err)
+		}
+		err := os.Rename(path.Join(cfg.Layerdirs, "base"), path.Join(cfg.Layerdirs, "newbase"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = FindLayers(cfg, &config.Opts{})
+		if err == nil || !strings.HasSuffix(err.Error(), "the next command which changes " +
+			"layers will recover the operation interrupted in " + journal) {
+			t.Fatalf("read-only load: unexpected error %v", err)
+		}
+		layers := reload()
+		if fs.IsSymlink(exportLink("base")) {
+			t.Fatalf("export link of old name left in place")
+		}
+		if layers.Layer("newbase") == nil || layers.Layer("base") != nil {
+			t.Fatalf("rename not completed")
+		}
+		for _, name := range []string{"derived", "other"} {
+			if layers.Layer(name).Base != "newbase" {
+				t.Fatalf("layer %s has base %s", name, layers.Layer(name).Base)
+			}
+		}
+	})
+
+	t.Run("rename rolled back", func (t *testing.T) {
+		// Simulate a crash after the export links were removed but before the directory
+		// was renamed
+		if err := fs.WriteTextFile(journal, "rename newbase base\n"); err != nil {
+			t.Fatal(err)
+		}
+		layers := reload()
+		if layers.Layer("newbase") == nil || layers.Layer("base") != nil {
+			t.Fatalf("rename not undone")
+		}
+		if layers.Layer("derived").Base != "newbase" {
+			t.Fatalf("derived layer has base %s", layers.Layer("derived").Base)
+		}
+		if !fs.IsSymlink(exportLink("newbase")) {
+			t.Fatalf("export link not restored")
+		}
+	})
+
+	t.Run("failed rename restores export links", func (t *testing.T) {
+		layers := reload()
+		// A non-empty directory in the way makes renaming the layer directory fail after
+		// the export links were removed
+		blocker := path.Join(cfg.Layerdirs, "renamed", "blocker")
+		if err := os.MkdirAll(blocker, 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := layers.RenameLayer("newbase", "renamed")
+		os.RemoveAll(path.Join(cfg.Layerdirs, "renamed"))
+		if err == nil {
+			t.Fatalf("rename onto a non-empty directory succeeded")
+		}
+		if fs.Exists(journal) {
+			t.Fatalf("journal left after undone rename")
+		}
+		if !fs.IsSymlink(exportLink("newbase")) {
+			t.Fatalf("export link not restored")
+		}
+		layers = reload()
+		if err = layers.RenameLayer("newbase", "renamed"); err != nil {
+			t.Fatal(err)
+		}
+		if fs.IsSymlink(exportLink("newbase")) || fs.Exists(journal) {
+			t.Fatalf("rename left export link or journal")
+		}
+		layers = reload()
+		if layers.Layer("renamed") == nil || layers.Layer("derived").Base != "renamed" {
+			t.Fatalf("rename not carried out")
+		}
+	})
+
+	t.Run("pending journal blocks new operation", func (t *testing.T) {
+		layers := reload()
+		if err := fs.WriteTextFile(journal, "rename other another\n"); err != nil {
+			t.Fatal(err)
+		}
+		err := layers.RenameLayer("derived", "derived2")
+		checkErrorByMessage(t, err, "Interrupted operation pending in " + journal, "rename")
+		if layers.Layer("derived") == nil {
+			t.Fatalf("rename went ahead")
+		}
+		reload()
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"potano.layercake/fs"
+	"potano.layercake/defaults"
 )
 
 
@@ -17,10 +18,12 @@ func ReadLayerFile(filename string, harderror bool) (*Layerinfo, error) {
 		return nil, err
 	}
 	defer cursor.Close()
-	layer := &Layerinfo{
-		ConfigMounts: []NeededMountType{},
-		ConfigExports: []NeededMountType{},
-	}
+	return readLayerConfig(cursor.TextInputCursor, harderror)
+}
+
+
+func readLayerConfig(cursor *fs.TextInputCursor, harderror bool) (*Layerinfo, error) {
+	layer := newConfiguredLayer()
 
 	var line string
 	for cursor.ReadNonBlankNonCommentLine(&line) {
@@ -29,36 +32,7 @@ func ReadLayerFile(filename string, harderror bool) (*Layerinfo, error) {
 		if len(fields) < 1 {
 			continue
 		}
-		switch fields[0] {
-		case "base":
-			if len(fields) < 2 {
-				cursor.LogError("No base specified")
-			} else if len(layer.Base) > 0 && layer.Base != fields[1] {
-				cursor.LogError("New conflicting setting of base property")
-			} else {
-				layer.Base = fields[1]
-			}
-		case "import":
-			if len(fields) < 4 {
-				cursor.LogError("Incomplete import specification")
-			} else {
-				mount := path.Clean(fields[3])
-				source := path.Clean(fields[2])
-				fstype := fields[1]
-				layer.ConfigMounts = append(layer.ConfigMounts,
-					NeededMountType{mount, source, fstype})
-			}
-		case "export":
-			if len(fields) < 4 {
-				cursor.LogError("Incomplete export specification")
-			} else {
-				mount := path.Clean(fields[3])
-				source := path.Clean(fields[2])
-				fstype := fields[1]
-				layer.ConfigExports = append(layer.ConfigExports,
-					NeededMountType{mount, source, fstype})
-			}
-		default:
+		if !layer.parseConfigDirective(line, fields, cursor) {
 			cursor.LogError("Unknown layerconf keyword '" + fields[0] + "'")
 		}
 	}
@@ -73,12 +47,122 @@ func ReadLayerFile(filename string, harderror bool) (*Layerinfo, error) {
 }
 
 
+func newConfiguredLayer() *Layerinfo {
+	return &Layerinfo{
+		ConfigMounts: []NeededMountType{},
+		ConfigExports: []NeededMountType{},
+	}
+}
+
+
+// Parses one layerconfig directive.  Returns false if the keyword is not a layerconfig keyword.
+func (layer *Layerinfo) parseConfigDirective(line string, fields []string,
+		cursor fs.LineReader) bool {
+	switch fields[0] {
+	case "base":
+		if len(fields) < 2 {
+			cursor.LogError("No base specified")
+		} else if len(layer.Base) > 0 && layer.Base != fields[1] {
+			cursor.LogError("New conflicting setting of base property")
+		} else {
+			layer.Base = fields[1]
+		}
+	case "import":
+		if len(fields) < 4 {
+			cursor.LogError("Incomplete import specification")
+		} else {
+			mount := path.Clean(fields[3])
+			source := path.Clean(fields[2])
+			fstype := fields[1]
+			layer.ConfigMounts = append(layer.ConfigMounts,
+				NeededMountType{mount, source, fstype})
+		}
+	case "export":
+		if len(fields) < 4 {
+			cursor.LogError("Incomplete export specification")
+		} else {
+			mount := path.Clean(fields[3])
+			source := path.Clean(fields[2])
+			fstype := fields[1]
+			layer.ConfigExports = append(layer.ConfigExports,
+				NeededMountType{mount, source, fstype})
+		}
+	case "env":
+		setting := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+		if len(fields) < 2 || !isLegalEnvSetting(setting) {
+			cursor.LogError("Environment setting must have the form KEY=value")
+		} else {
+			layer.ConfigEnv = append(layer.ConfigEnv, setting)
+		}
+	case "envfile":
+		if len(fields) != 2 {
+			cursor.LogError("Envfile directive must name one file")
+		} else {
+			layer.ConfigEnvFiles = append(layer.ConfigEnvFiles, path.Clean(fields[1]))
+		}
+	case "namespace":
+		if len(fields) < 2 {
+			cursor.LogError("No namespace specified")
+		}
+		for _, ns := range fields[1:] {
+			if _, known := namespaceCloneflags[ns]; !known {
+				cursor.LogError("Unknown namespace '" + ns + "'")
+			} else if !layer.hasNamespace(ns) {
+				layer.ConfigNamespaces = append(layer.ConfigNamespaces, ns)
+			}
+		}
+	case "hostname":
+		if len(fields) != 2 || !isLegalHostname(fields[1]) {
+			cursor.LogError("Hostname directive must give a valid host name")
+		} else if len(layer.ConfigHostname) > 0 && layer.ConfigHostname != fields[1] {
+			cursor.LogError("New conflicting setting of hostname property")
+		} else {
+			layer.ConfigHostname = fields[1]
+		}
+	case "personality":
+		if len(fields) != 2 {
+			cursor.LogError("Personality directive must name one personality")
+		} else if _, known := personalities[fields[1]]; !known {
+			cursor.LogError("Unknown personality '" + fields[1] + "'")
+		} else if len(layer.ConfigPersonality) > 0 && layer.ConfigPersonality != fields[1] {
+			cursor.LogError("New conflicting setting of personality property")
+		} else {
+			layer.ConfigPersonality = fields[1]
+		}
+	case "emulate":
+		if len(fields) != 3 {
+			cursor.LogError("Emulate directive must give an architecture and an interpreter")
+		} else if _, known := emulatedArches[fields[1]]; !known {
+			cursor.LogError("Cannot emulate unknown architecture '" + fields[1] + "'")
+		} else if !path.IsAbs(fields[2]) {
+			cursor.LogError("Interpreter path must be absolute")
+		} else if len(layer.ConfigEmulation.Arch) > 0 {
+			cursor.LogError("Layer may emulate only one architecture")
+		} else {
+			layer.ConfigEmulation = LayerEmulation{fields[1], path.Clean(fields[2])}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+
+// Writes the layerconfig file under a temporary name and renames it into place so that an
+// interrupted write never leaves a truncated file behind
 func WriteLayerfile(filename string, layer *Layerinfo) error {
-	cursor, err := fs.NewTextOutputFileCursor(filename)
+	tmpname := filename + defaults.NewFileSuffix
+	cursor, err := fs.NewTextOutputFileCursor(tmpname)
 	if nil != err {
 		return err
 	}
-	defer cursor.Close()
+	writeConfigDirectives(cursor, layer)
+	cursor.Close()
+	return fs.Rename(tmpname, filename)
+}
+
+
+func writeConfigDirectives(cursor *fs.TextOutputFileCursor, layer *Layerinfo) {
 	if len(layer.Base) > 0 {
 		cursor.Printf("base %s\n\n", layer.Base)
 	}
@@ -86,16 +170,40 @@ func WriteLayerfile(filename string, layer *Layerinfo) error {
 		cursor.Printf("import %s %s %s\n", mnt.Fstype, mnt.Source, mnt.Mount)
 	}
 	if len(layer.ConfigExports) > 0 {
-		cursor.Printf("\n");
+		cursor.Printf("\n")
 	}
 	for _, mnt := range layer.ConfigExports {
 		cursor.Printf("export %s %s %s\n", mnt.Fstype, mnt.Source, mnt.Mount)
 	}
-	return nil
+	if len(layer.ConfigEnvFiles) > 0 || len(layer.ConfigEnv) > 0 {
+		cursor.Printf("\n")
+	}
+	for _, filename := range layer.ConfigEnvFiles {
+		cursor.Printf("envfile %s\n", filename)
+	}
+	for _, setting := range layer.ConfigEnv {
+		cursor.Printf("env %s\n", setting)
+	}
+	if len(layer.ConfigNamespaces) > 0 || len(layer.ConfigHostname) > 0 ||
+		len(layer.ConfigPersonality) > 0 || len(layer.ConfigEmulation.Arch) > 0 {
+		cursor.Printf("\n")
+	}
+	if len(layer.ConfigNamespaces) > 0 {
+		cursor.Printf("namespace %s\n", strings.Join(layer.ConfigNamespaces, " "))
+	}
+	if len(layer.ConfigHostname) > 0 {
+		cursor.Printf("hostname %s\n", layer.ConfigHostname)
+	}
+	if len(layer.ConfigPersonality) > 0 {
+		cursor.Printf("personality %s\n", layer.ConfigPersonality)
+	}
+	if len(layer.ConfigEmulation.Arch) > 0 {
+		cursor.Printf("emulate %s %s\n", layer.ConfigEmulation.Arch,
+			layer.ConfigEmulation.Interpreter)
+	}
 }
 
 
 func (layers *Layerdefs) writeLayerFile(layer *Layerinfo) error {
 	return WriteLayerfile(layers.layerconfigFilePath(layer), layer)
 }
-
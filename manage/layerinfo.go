@@ -52,7 +52,8 @@ func (ld *Layerdefs) testName(tests...nametest) error {
 			}
 		} else if (mask & name_need) > 0 {
 			if _, have := ld.layermap[name]; !have {
-				return fmt.Errorf("%s name '%s' does not exist", desc, name)
+				return layerErrorf(ErrNotFound, name, "%s name '%s' does not exist",
+					desc, name)
 			}
 		}
 	}
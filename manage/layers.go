@@ -4,11 +4,13 @@
 package manage
 
 import (
+	"io"
 	"os"
 	"fmt"
+	"bytes"
 	"path"
-	"errors"
 	"strings"
+	"syscall"
 	"path/filepath"
 
 	"potano.layercake/fs"
@@ -60,11 +62,18 @@ type Layerinfo struct {
 	Name, Base string
 	ConfigMounts []NeededMountType
 	ConfigExports []NeededMountType
+	ConfigEnv []string
+	ConfigEnvFiles []string
+	ConfigNamespaces []string
+	ConfigHostname string
+	ConfigPersonality string
+	ConfigEmulation LayerEmulation
 	LayerPath string
 	State int
 	Messages []string
 	MountBusy, NonMountBusy, Overlain, Chroot bool
 	Mounts []*fs.MountType
+	Users []fs.InUseProc
 }
 
 
@@ -97,6 +106,11 @@ func (ld *Layerdefs) DescribeMounts(li *Layerinfo, detailed bool) []string {
 }
 
 
+func (li *Layerinfo) StateDescription() string {
+	return layerstateDescriptions[li.State]
+}
+
+
 func (li *Layerinfo) DescribeUsage() string {
 	if li.Chroot {
 		return "active chroot"
@@ -113,16 +127,32 @@ func (li *Layerinfo) DescribeUsage() string {
 
 
 func (ld *Layerdefs) describeMounts(li *Layerinfo, leftpad string) (out []string) {
-	if len(li.Mounts) == 0 {
-		return
+	required, overlayfs, other := ld.classifyMounts(li)
+	if len(required) > 0 {
+		out = append(out, leftpad + "required: " + strings.Join(required, ", "))
 	}
+	if overlayfs {
+		out = append(out, leftpad + "overlayfs")
+	}
+	for _, m := range other {
+		out = append(out, leftpad + m)
+	}
+	return
+}
+
+
+// Sorts a layer's current mounts into those its layerconfig requires, named as in the
+// layerconfig, its overlayfs mount, and any others
+func (ld *Layerdefs) classifyMounts(li *Layerinfo) (required []string, overlayfs bool,
+		other []string) {
 	buildpath := ld.buildPath(li)
 	configed := map[string]string{}
 	for _, cm := range li.ConfigMounts {
 		configed[path.Join(buildpath, cm.Mount)] = cm.Mount
 	}
-	var required, other []string
-	var overlayfs bool
+	if emu := ld.layerEmulation(li); len(emu.Arch) > 0 {
+		configed[path.Join(buildpath, emu.Interpreter)] = emu.Interpreter
+	}
 	for _, mnt := range li.Mounts {
 		if mnt.InShadow {
 			continue
@@ -135,15 +165,6 @@ func (ld *Layerdefs) describeMounts(li *Layerinfo, leftpad string) (out []string
 			other = append(other, mnt.Mountpoint)
 		}
 	}
-	if len(required) > 0 {
-		out = append(out, leftpad + "required: " + strings.Join(required, ", "))
-	}
-	if overlayfs {
-		out = append(out, leftpad + "overlayfs")
-	}
-	for _, m := range other {
-		out = append(out, leftpad + m)
-	}
 	return
 }
 
@@ -176,7 +197,7 @@ func (ld *Layerdefs) AddLayer(name, base, configFile string) error {
 	var basis_layer *Layerinfo
 	if len(base) > 0 {
 		if base == name {
-			return errors.New("Layer cannot be its own base")
+			return layerErrorf(ErrCycle, name, "Layer cannot be its own base")
 		}
 		basis_layer = ld.layermap[base]
 	}
@@ -233,6 +254,12 @@ func (ld *Layerdefs) AddLayer(name, base, configFile string) error {
 	}
 	ld.layermap[name] = layer
 	ld.normalizeOrder()
+	if len(base) > 0 {
+		// Until it changes its own settings, the layer has its parent's CHOST and -march
+		for _, problem := range ld.hostCompatibilityProblems(ld.layermap[base]) {
+			fs.Printf("Warning: parent layer %s: %s\n", base, problem)
+		}
+	}
 	return nil
 }
 
@@ -263,8 +290,8 @@ func (layer *Layerinfo) errorIfBusy(operation string, alteringLayer bool) error
 		msg = append(msg, "is in use by overlay")
 	}
 	if len(msg) > 0 {
-		return fmt.Errorf("Layer %s %s; cannot %s", layer.Name, fns.AndSlice(msg),
-			operation)
+		return layerErrorf(ErrLayerBusy, layer.Name, "Layer %s %s; cannot %s", layer.Name,
+			fns.AndSlice(msg), operation)
 	}
 	return nil
 }
@@ -352,22 +379,43 @@ func (ld *Layerdefs) RenameLayer(oldname, newname string) error {
 		children = append(children, child)
 	}
 
+	err = ld.beginJournal("rename", oldname, newname)
+	if err != nil {
+		return err
+	}
+	// Undoes the rename up to the renaming of the directory; the journal stays if that fails
+	undo := func () {
+		if ld.makeLayerExportLinks(layer) == nil {
+			ld.endJournal()
+		}
+	}
 	err = ld.removeLayerExportLinks(layer)
 	if err != nil {
+		undo()
 		return err
 	}
-
 	newLayerPath := ld.layerPath(newname)
 	err = fs.Rename(layer.LayerPath, newLayerPath)
 	if err != nil {
+		undo()
 		return err
 	}
 
-	for _, child := range children {
+	for i, child := range children {
 		child.Base = newname
 		err = ld.writeLayerFile(child)
 		if err != nil {
-			return nil
+			// Undo what was done so far; the journal stays if that fails as well
+			for _, done := range children[:i+1] {
+				done.Base = oldname
+				if ld.writeLayerFile(done) != nil {
+					return err
+				}
+			}
+			if fs.Rename(newLayerPath, layer.LayerPath) == nil {
+				undo()
+			}
+			return err
 		}
 	}
 
@@ -376,11 +424,7 @@ func (ld *Layerdefs) RenameLayer(oldname, newname string) error {
 	delete(ld.layermap, oldname)
 	ld.layermap[newname] = layer
 	ld.normalizeOrder()
-	err = ld.writeLayerFile(layer)
-	if err != nil {
-		return err
-	}
-	return nil
+	return ld.endJournal()
 }
 
 
@@ -399,13 +443,6 @@ func (ld *Layerdefs) RebaseLayer(name, newbase string) error {
 	if err != nil {
 		return err
 	}
-	oldbase := layer.Base
-	err = ld.checkInheritance()
-	if err != nil {
-		layer.Base = oldbase
-		return errors.New("Rebasing would orphan one or more layers")
-	}
-
 	for _, child := range ld.layermap {
 		if child.Base != name {
 			continue
@@ -416,28 +453,46 @@ func (ld *Layerdefs) RebaseLayer(name, newbase string) error {
 		}
 	}
 
+	oldbase := layer.Base
 	layer.Base = newbase
-	ld.normalizeOrder()
+	err = ld.checkInheritance()
+	if err != nil {
+		layer.Base = oldbase
+		return layerErrorf(ErrCycle, name, "Rebasing would orphan one or more layers")
+	}
+
 	err = ld.writeLayerFile(layer)
 	if err != nil {
+		layer.Base = oldbase
 		return err
 	}
+	ld.normalizeOrder()
 	return nil
 }
 
 
 func (ld *Layerdefs) Shell(name string) error {
-	err := ld.testName(nametest{name, name_need, "Layer"})
+	builddir, err := ld.shellDir(name)
 	if nil != err {
 		return err
 	}
+	return fs.Shell(builddir)
+}
+
+
+// Returns the directory in which to open a shell for the named layer, giving the caution
+func (ld *Layerdefs) shellDir(name string) (string, error) {
+	err := ld.testName(nametest{name, name_need, "Layer"})
+	if nil != err {
+		return "", err
+	}
 	layer := ld.layermap[name]
 	builddir := ld.buildPath(layer)
 	if !fs.IsDir(builddir) {
-		return fmt.Errorf("Build directory for layer %s does not exist", name)
+		return "", fmt.Errorf("Build directory for layer %s does not exist", name)
 	}
 	fs.Println("Exit to return to layercake.\nCaution: this is *not* a chroot.")
-	return fs.Shell(builddir)
+	return builddir, nil
 }
 
 
@@ -500,6 +555,7 @@ func (ld *Layerdefs) Mount(name string) error {
 		}
 	}
 	for _, layer := range ancestors {
+		wasMounted := layer.State >= Layerstate_mounted
 		err = ld.mountOne(layer)
 		if err != nil {
 			return err
@@ -508,6 +564,11 @@ func (ld *Layerdefs) Mount(name string) error {
 		if err != nil {
 			return err
 		}
+		if !wasMounted && layer.State >= Layerstate_mounted {
+			if err = ld.noteActivity(layer); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -516,7 +577,7 @@ func (ld *Layerdefs) Mount(name string) error {
 func (ld *Layerdefs) mountOne(layer *Layerinfo) error {
 	name := layer.Name
 	if layer.State < Layerstate_mountable {
-		return fmt.Errorf("Layer %s is not yet mountable", name)
+		return layerErrorf(ErrNotMountable, name, "Layer %s is not yet mountable", name)
 	}
 	builddir := ld.buildPath(layer)
 	if len(layer.Base) > 0 {
@@ -530,6 +591,9 @@ func (ld *Layerdefs) mountOne(layer *Layerinfo) error {
 			if nil != err {
 				return err
 			}
+			if err = ld.recordLowerGeneration(layer); nil != err {
+				return err
+			}
 		}
 	}
 	expanded, err := ld.expandConfigMounts(layer)
@@ -555,6 +619,10 @@ func (ld *Layerdefs) mountOne(layer *Layerinfo) error {
 			}
 		}
 	}
+	err = ld.setUpEmulation(layer)
+	if err != nil {
+		return err
+	}
 	err = ld.refreshMountInfo()
 	if err != nil {
 		return err
@@ -585,7 +653,7 @@ func (ld *Layerdefs) Unmount(name string, unmountAll bool) error {
 		return err
 	}
 	if !unmountAll {
-		fmt.Errorf("Must specify a layer to unmount or -all switch")
+		return fmt.Errorf("Must specify a layer to unmount or -all switch")
 	}
 	busyLayers := make([]string, 0, len(ld.normalizedOrder))
 	for i := len(ld.normalizedOrder) - 1; i >= 0; i-- {
@@ -627,6 +695,9 @@ func (ld *Layerdefs) unmountLayer(name string) (int, error) {
 	for uX := len(layer.Mounts) - 1; uX >= 0; uX-- {
 		path := layer.Mounts[uX].Mountpoint
 		err := fs.Unmount(path, ld.opts.Force)
+		if nil == err {
+			err = ld.removeEmulationPlaceholder(layer, path)
+		}
 		if nil != err {
 			layer.State = Layerstate_error
 			return Unmount_status_error, err
@@ -641,33 +712,192 @@ func (ld *Layerdefs) unmountLayer(name string) (int, error) {
 }
 
 
-func (ld *Layerdefs) Chroot(name string) error {
-	err := ld.testName(nametest{name, name_need, "Layer"})
+func (ld *Layerdefs) Chroot(name string, session Session) error {
+	return ld.runInChroot(name, nil, session, nil)
+}
+
+
+// Runs a command in a chroot using the named layer
+func (ld *Layerdefs) Exec(name string, command []string, session Session) error {
+	if len(command) == 0 {
+		return fmt.Errorf("No command specified")
+	}
+	return ld.runInChroot(name, command, session, nil)
+}
+
+
+// Runs a command in a chroot using the named layer, returning its combined output
+func (ld *Layerdefs) ExecOutput(name string, command []string, session Session) ([]byte,
+	error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("No command specified")
+	}
+	var out bytes.Buffer
+	err := ld.runInChroot(name, command, session, &out)
+	return out.Bytes(), err
+}
+
+
+func (ld *Layerdefs) runInChroot(name string, command []string, session Session,
+	out io.Writer) error {
+	cs, err := ld.startSession(name, command, session)
 	if nil != err {
 		return err
 	}
+	return cs.finish(cs.run(nil, out))
+}
+
+
+// A chroot session made ready by startSession.  The session is run and then finished
+// separately so that callers need not hold locks while it runs.
+type chrootSession struct {
+	ld *Layerdefs
+	layer *Layerinfo
+	command []string
+	session Session
+	usr *sessionUser
+	env []string
+	logfile *os.File
+}
+
+
+// Mounts the layer if need be and prepares a session in it
+func (ld *Layerdefs) startSession(name string, command []string, session Session) (
+	*chrootSession, error) {
+	err := ld.testName(nametest{name, name_need, "Layer"})
+	if nil != err {
+		return nil, err
+	}
 	layer := ld.layermap[name]
+	if err = ld.readyForSession(layer, false); nil != err {
+		return nil, err
+	}
+	if err = ld.checkPersonality(layer); nil != err {
+		return nil, err
+	}
+	cs := &chrootSession{ld: ld, layer: layer, command: command, session: session}
+	if !session.isDefault() {
+		if cs.usr, err = ld.lookupSessionUser(layer, session.User); nil != err {
+			return nil, err
+		}
+	}
+	cs.env, err = ld.chrootEnvironment(layer, cs.usr)
+	if nil != err {
+		return nil, err
+	}
+	if err = ld.noteActivity(layer); nil != err {
+		return nil, err
+	}
+	cs.logfile, err = ld.startSessionLog(layer, command)
+	if nil != err {
+		return nil, fmt.Errorf("%s starting session log", err)
+	}
+	return cs, nil
+}
+
+
+// Runs the session's command, passing its output to the writer as for fs.Chroot.  Closing the
+// done channel kills the command.
+func (cs *chrootSession) run(done <-chan struct{}, out io.Writer) error {
+	builddir := cs.ld.buildPath(cs.layer)
+	setup := cs.layer.chrootSetup()
+	setup.Done = done
+	var transcript io.Writer
+	if cs.logfile != nil {
+		transcript = cs.logfile
+	}
+	if cs.usr == nil {
+		fds := []*os.File{}
+		return fs.Chroot(builddir, cs.ld.cfg.ChrootExec, cs.command, cs.env, fds, setup, out,
+			transcript)
+	}
+	workdir := cs.usr.home
+	if !fs.IsDir(path.Join(builddir, workdir)) {
+		workdir = "/"
+	}
+	cred := &syscall.Credential{Uid: cs.usr.uid, Gid: cs.usr.gid, Groups: cs.usr.groups}
+	return fs.ChrootAs(builddir, cs.usr.sessionArgs(cs.command, cs.session.Login), cs.env, cred,
+		workdir, setup, out, transcript)
+}
+
+
+// Records the end of a session which returned the given error, which is returned unless
+// there is none and the recording fails
+func (cs *chrootSession) finish(err error) error {
+	if cs.logfile != nil {
+		if logErr := endSessionLog(cs.logfile, err); nil == err {
+			err = logErr
+		}
+	}
+	if !cs.session.ReadOnly {
+		if bumpErr := cs.ld.bumpGeneration(cs.layer); nil == err {
+			err = bumpErr
+		}
+	}
+	if touchErr := cs.ld.noteActivity(cs.layer); nil == err {
+		err = touchErr
+	}
+	return err
+}
+
+
+/*
+  Mounts the layer if need be and checks that its view of lower layers is current, remounting
+  it if it is stale and remountStale is set.  Unless this process's command already holds it,
+  the lock on the base directory is held meanwhile so that the mounting cannot race another
+  command; since the layers were probed before the lock was taken, the mount table is probed
+  again first.  The lock is not kept for the session itself, which may last indefinitely.
+*/
+func (ld *Layerdefs) readyForSession(layer *Layerinfo, remountStale bool) error {
+	if heldLock == nil && !ld.opts.Pretend {
+		lock, err := takeLock(ld.cfg, ld.opts.Wait)
+		if nil != err {
+			return err
+		}
+		defer lock.Unlock()
+		if err = ld.reprobeMounts(); nil != err {
+			return err
+		}
+	}
+	name := layer.Name
 	if layer.State < Layerstate_mounted {
-		if err = ld.Mount(name); nil != err {
+		if err := ld.Mount(name); nil != err {
 			return err
 		}
 	}
-	builddir := ld.buildPath(layer)
-	if !fs.IsDir(builddir) {
+	if !fs.IsDir(ld.buildPath(layer)) {
 		return fmt.Errorf("Build directory for layer %s does not exist", name)
 	}
-	env := []string{"LAYERCAKE_LAYER=" + name}
-	fds := []*os.File{}
-	return fs.Chroot(builddir, ld.cfg.ChrootExec, env, fds)
+	if ld.ViewIsStale(layer) {
+		if remountStale {
+			return ld.remount(layer)
+		}
+		if !ld.opts.Force {
+			return fmt.Errorf("A lower layer of %s changed since it was mounted; " +
+				"run shake or use -force", name)
+		}
+		fs.Println("Warning: a lower layer changed since this layer was mounted")
+	}
+	return nil
+}
+
+
+// Probes the mount table again and brings the states of the layers up to date with it
+func (ld *Layerdefs) reprobeMounts() error {
+	if err := ld.refreshMountInfo(); nil != err {
+		return err
+	}
+	for _, layer := range ld.Layers() {
+		ld.findLayerstate(layer)
+	}
+	return nil
 }
 
 
 func (ld *Layerdefs) Shake() error {
 	for _, layer := range ld.Layers() {
-		target := ld.buildPath(layer)
 		if len(layer.Base) > 0 && layer.State >= Layerstate_mounted {
-			err := fs.Mount("", target, "remount", "")
-			if nil != err {
+			if err := ld.remount(layer); nil != err {
 				return err
 			}
 		}
@@ -675,3 +905,13 @@ func (ld *Layerdefs) Shake() error {
 	return nil
 }
 
+
+// Remounts a derived layer's overlay so that it sees the current contents of its base
+func (ld *Layerdefs) remount(layer *Layerinfo) error {
+	err := fs.Mount("", ld.buildPath(layer), "remount", "")
+	if nil != err {
+		return err
+	}
+	return ld.recordLowerGeneration(layer)
+}
+
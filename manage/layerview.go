@@ -0,0 +1,88 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"potano.layercake/fs"
+)
+
+
+const maxSymlinksInLayerPath = 40
+
+
+// A derived layer's files are visible only through its overlayfs mount
+func (ld *Layerdefs) errorIfBuildRootHidden(layer *Layerinfo) error {
+	if len(layer.Base) > 0 && ld.mounts.GetMount(ld.buildPath(layer)) == nil {
+		return fmt.Errorf("Layer %s must be mounted to read its files", layer.Name)
+	}
+	return nil
+}
+
+
+/*
+  Translates a path as seen from within a layer's chroot to the corresponding host path.
+  Follows symlinks as the chroot would see them and maps paths under configured imports to
+  the import sources, so that shared directories such as /var/db/repos are found even when
+  the layer is not mounted.
+*/
+func (ld *Layerdefs) hostPath(layer *Layerinfo, chrootPath string) (string, error) {
+	mounts, err := ld.expandConfigMounts(layer)
+	if err != nil {
+		return "", err
+	}
+	builddir := ld.buildPath(layer)
+	toHost := func (pth string) string {
+		var best expandedNeededMountType
+		for _, m := range mounts {
+			mp := m.UnexpandedMount
+			if len(mp) > len(best.UnexpandedMount) &&
+				(pth == mp || strings.HasPrefix(pth, mp + "/")) {
+				best = m
+			}
+		}
+		if len(best.UnexpandedMount) > 0 {
+			return path.Join(best.Source, pth[len(best.UnexpandedMount):])
+		}
+		return path.Join(builddir, pth)
+	}
+
+	resolved := "/"
+	remaining := strings.Split(path.Clean("/" + chrootPath), "/")
+	numLinks := 0
+	for len(remaining) > 0 {
+		name := remaining[0]
+		remaining = remaining[1:]
+		if len(name) == 0 || name == "." {
+			continue
+		}
+		if name == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+		candidate := path.Join(resolved, name)
+		hostname := toHost(candidate)
+		if !fs.IsSymlink(hostname) {
+			resolved = candidate
+			continue
+		}
+		numLinks++
+		if numLinks > maxSymlinksInLayerPath {
+			return "", fmt.Errorf("too many levels of symlinks resolving %s in layer %s",
+				chrootPath, layer.Name)
+		}
+		target, err := fs.Readlink(hostname)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+	return toHost(resolved), nil
+}
@@ -0,0 +1,77 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"path"
+
+	"testing"
+	"potano.layercake/config"
+)
+
+
+func TestHostPath(t *testing.T) {
+	td, err := NewTmpdir("layercake_hostpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.AddLayer("base", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	layer := layers.Layer("base")
+	layer.ConfigMounts = []NeededMountType{
+		{"/var/db/repos", td.Path("repos"), "rbind"},
+		{"/var/cache/binpkgs", "$$base/packages", "rbind"},
+	}
+	builddir := layers.buildPath(layer)
+	td.Mkdir("repos/gentoo/profiles/default/amd64")
+	td.Mkdir(layercake_layers_path + "/base/build/etc/portage")
+	td.Mkdir(layercake_layers_path + "/base/build/usr/lib")
+	for _, link := range []struct {from, to string} {
+		{"etc/portage/make.profile", "../../var/db/repos/gentoo/profiles/default/amd64"},
+		{"lib", "usr/lib"},
+		{"lib64", "/lib"},
+		{"loop", "/loop"},
+	} {
+		if err = os.Symlink(link.to, path.Join(builddir, link.from)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tst := range []struct {chrootPath, expected string} {
+		{"/", builddir},
+		{"/etc/portage/make.conf", builddir + "/etc/portage/make.conf"},
+		{"/var/db/repos", td.Path("repos")},
+		{"/var/db/repos/gentoo", td.Path("repos/gentoo")},
+		{"/var/db/repository", builddir + "/var/db/repository"},
+		{"/etc/portage/make.profile/parent",
+			td.Path("repos/gentoo/profiles/default/amd64/parent")},
+		{"/lib64/libc.so", builddir + "/usr/lib/libc.so"},
+		{"/usr/../lib/x", builddir + "/usr/lib/x"},
+		{"/var/cache/binpkgs/Packages", layer.LayerPath + "/packages/Packages"},
+	} {
+		have, err := layers.hostPath(layer, tst.chrootPath)
+		if err != nil {
+			t.Errorf("%s: %s", tst.chrootPath, err)
+		} else if have != tst.expected {
+			t.Errorf("%s: expected %s, got %s", tst.chrootPath, tst.expected, have)
+		}
+	}
+	_, err = layers.hostPath(layer, "/loop/x")
+	checkErrorByMessage(t, err, "too many levels of symlinks resolving /loop/x in layer base",
+		"symlink loop")
+}
@@ -0,0 +1,55 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"potano.layercake/fs"
+	"potano.layercake/config"
+	"potano.layercake/defaults"
+)
+
+
+// Lock serializing state-changing commands; held by this process until Unlock is called or
+// the process exits
+var heldLock *fs.FileLock
+
+
+func lockPath(cfg *config.ConfigType) string {
+	return path.Join(cfg.Basepath, defaults.LockFile)
+}
+
+
+// Takes the lock on the base directory for the rest of a state-changing command, waiting up to
+// the given duration for another layercake command to finish
+func Lock(cfg *config.ConfigType, wait time.Duration) error {
+	if heldLock != nil {
+		return nil
+	}
+	lock, err := takeLock(cfg, wait)
+	if err != nil {
+		return err
+	}
+	heldLock = lock
+	return nil
+}
+
+
+func takeLock(cfg *config.ConfigType, wait time.Duration) (*fs.FileLock, error) {
+	lock, err := fs.LockFile(lockPath(cfg), wait)
+	if err != nil && wait == 0 {
+		return nil, fmt.Errorf("%s; another layercake command is running (see -wait)", err)
+	}
+	return lock, err
+}
+
+
+func Unlock() error {
+	lock := heldLock
+	heldLock = nil
+	return lock.Unlock()
+}
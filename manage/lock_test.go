@@ -0,0 +1,78 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"time"
+	"strings"
+
+	"testing"
+	"potano.layercake/config"
+	"potano.layercake/fs"
+)
+
+
+func TestSessionMountsSerialize(t *testing.T) {
+	td, cfg, _, cleanup := setUpMountableLayers(t, "layercake_lock",
+		[]struct {name, base string} {{"base", ""}, {"derived", "base"}})
+	defer cleanup()
+	if err := td.WriteFile("/chroot", "#!/bin/sh\nexit 0\n"); err != nil {
+		t.Fatal(err)
+	}
+	cfg.ChrootExec = td.Path("/chroot")
+	if err := os.Chmod(cfg.ChrootExec, 0755); err != nil {
+		t.Fatal(err)
+	}
+	builddir := td.Path("/var/lib/layercake/layers/derived/build")
+	overlayMounts := func () int {
+		cursor := fs.GetAlternateProbeMountsCursor()
+		defer cursor.Close()
+		count := 0
+		var line string
+		for cursor.ReadLine(&line) {
+			if fields := strings.Fields(line); len(fields) > 4 && fields[4] == builddir {
+				count++
+			}
+		}
+		return count
+	}
+
+	// Both sessions probe the layers while the derived layer is unmounted, as two commands
+	// started together would
+	opts := &config.Opts{Wait: 5 * time.Second}
+	first := getLayers(t, cfg, opts, fs.InUseLayerMap{}, "first")
+	second := getLayers(t, cfg, opts, fs.InUseLayerMap{}, "second")
+	held, err := fs.LockFile(lockPath(cfg), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 2)
+	for _, layers := range []*Layerdefs{first, second} {
+		go func (layers *Layerdefs) {
+			done <- layers.Exec("derived", []string{"true"}, Session{})
+		}(layers)
+	}
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case err = <-done:
+		t.Fatalf("session started while another command held the lock (%v)", err)
+	default:
+	}
+	if n := overlayMounts(); n != 0 {
+		t.Fatalf("layer mounted while another command held the lock")
+	}
+	held.Unlock()
+	for range []int{1, 2} {
+		if err = <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := overlayMounts(); n != 1 {
+		t.Errorf("expected one overlay mount of the derived layer, found %d", n)
+	}
+	if heldLock != nil {
+		t.Errorf("lock still held after the sessions")
+	}
+}
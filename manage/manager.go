@@ -0,0 +1,525 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"io"
+	"bytes"
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"strings"
+	"context"
+
+	"potano.layercake/fs"
+	"potano.layercake/config"
+)
+
+
+/*
+  Manager is the entry point for Go programs which manage layers.  Each call loads and probes
+  the layers afresh, so a Manager may be kept for the life of a program.  Calls which change
+  layers hold the lock on the base directory for their duration.
+
+  The fs package routes messages and decisions about carrying out actions through package-level
+  hooks; a call installs the Manager's Logger and Pretender in them for its duration, so calls
+  from different goroutines are serialized.  The exception is the running of a command in a
+  chroot, during which other calls proceed.
+
+  A call checks its context when it starts.  Cancelling the context later kills a command the
+  call runs in a chroot and stops UpdateAll before its next layer; other calls run to completion.
+*/
+type Manager struct {
+	Config *config.ConfigType
+	Opts *config.Opts
+
+	// Receives messages otherwise written to standard output; standard output if nil
+	Logger io.Writer
+
+	// Decides whether actions are carried out; if nil, they are unless Opts.Pretend is set
+	Pretender fs.PretenderFn
+}
+
+
+var managerMutex sync.Mutex
+
+// Set while Hold waits for the lock; protected by managerMutex
+var holdPending bool
+
+
+func NewManager(cfg *config.ConfigType, opts *config.Opts) *Manager {
+	if opts == nil {
+		opts = &config.Opts{}
+	}
+	return &Manager{Config: cfg, Opts: opts}
+}
+
+
+/*
+  Installs the Manager's hooks and, for changes, takes the lock unless Hold has it.  The wait
+  for the lock comes before the mutex is taken so that other calls proceed meanwhile.  The
+  returned function undoes all this.
+*/
+func (m *Manager) begin(ctx context.Context, changing bool) (func (), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	needLock := changing && !m.Opts.Pretend
+	for {
+		var lock *fs.FileLock
+		if needLock {
+			managerMutex.Lock()
+			held := heldLock != nil
+			managerMutex.Unlock()
+			if !held {
+				var err error
+				if lock, err = takeLock(m.Config, m.Opts.Wait); err != nil {
+					return nil, err
+				}
+			}
+		}
+		unhook := m.hook()
+		if needLock && lock == nil && heldLock == nil {
+			// Release came between the check and taking the mutex
+			unhook()
+			continue
+		}
+		if lock != nil {
+			heldLock = lock
+		}
+		return func () {
+			if lock != nil {
+				Unlock()
+			}
+			unhook()
+		}, nil
+	}
+}
+
+
+// Takes the mutex and installs the Manager's hooks.  The returned function undoes this.
+func (m *Manager) hook() func () {
+	managerMutex.Lock()
+	savedWriteOK, savedWriter := fs.WriteOK, fs.MessageWriter
+	fs.WriteOK = m.Pretender
+	if fs.WriteOK == nil {
+		fs.WriteOK = fs.MakePretender(m.Opts.Pretend, false, nil)
+	}
+	fs.MessageWriter = m.Logger
+	if fs.MessageWriter == nil {
+		fs.MessageWriter = os.Stdout
+	}
+	return func () {
+		fs.WriteOK, fs.MessageWriter = savedWriteOK, savedWriter
+		managerMutex.Unlock()
+	}
+}
+
+
+// Loads and probes the layers, recovering an interrupted operation if the call changes layers
+func (m *Manager) load(changing bool) (*Layerdefs, error) {
+	missing := CheckBaseSetUp(m.Config)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Missing item(s):\n  %s\nCannot proceed unless all exist",
+			strings.Join(missing, "\n  "))
+	}
+	ld, err := findLayers(m.Config, m.Opts, changing && heldLock != nil)
+	if err != nil {
+		return nil, err
+	}
+	inuse, err := fs.FindLayerUsers(m.Config.Layerdirs)
+	if err != nil {
+		return nil, fmt.Errorf("%s finding users in buildroot", err)
+	}
+	err = ld.ProbeAllLayerstate(inuse)
+	if err != nil {
+		return nil, fmt.Errorf("%s probing layers", err)
+	}
+	return ld, nil
+}
+
+
+func (m *Manager) run(ctx context.Context, changing bool, fn func (*Layerdefs) error) error {
+	end, err := m.begin(ctx, changing)
+	if err != nil {
+		return err
+	}
+	defer end()
+	ld, err := m.load(changing)
+	if err != nil {
+		return err
+	}
+	return fn(ld)
+}
+
+
+// Loads and probes the layers.  The Manager's hooks are not installed for calls made on the
+// result; use View or Update for that.
+func (m *Manager) Layers(ctx context.Context) (*Layerdefs, error) {
+	var out *Layerdefs
+	err := m.run(ctx, false, func (ld *Layerdefs) error {
+		out = ld
+		return nil
+	})
+	return out, err
+}
+
+
+// Calls fn with freshly probed layers for operations which do not change them
+func (m *Manager) View(ctx context.Context, fn func (*Layerdefs) error) error {
+	return m.run(ctx, false, fn)
+}
+
+
+// Calls fn with freshly probed layers while holding the lock on the base directory
+func (m *Manager) Update(ctx context.Context, fn func (*Layerdefs) error) error {
+	return m.run(ctx, true, fn)
+}
+
+
+/*
+  Like View, but fn may run commands in chroots through the function passed to it, which
+  releases the mutex and removes the Manager's hooks while the command runs so that other calls
+  proceed meanwhile.  The command must not depend on the hooks.
+*/
+func (m *Manager) viewRunning(ctx context.Context,
+		fn func (ld *Layerdefs, outside func (func () error) error) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	unhook := m.hook()
+	defer func () {
+		unhook()
+	}()
+	ld, err := m.load(false)
+	if err != nil {
+		return err
+	}
+	return fn(ld, func (command func () error) error {
+		unhook()
+		defer func () {
+			unhook = m.hook()
+		}()
+		return command()
+	})
+}
+
+
+/*
+  Takes the lock on the base directory, waiting up to the given time, and keeps it until
+  Release so that a series of calls is not interleaved with other layercake commands.  Fails
+  if the lock is already held this way.  The mutex is not held during the wait, so that other
+  calls proceed meanwhile.
+*/
+func (m *Manager) Hold(ctx context.Context, wait time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	managerMutex.Lock()
+	if heldLock != nil || holdPending {
+		managerMutex.Unlock()
+		return fmt.Errorf("The lock is already held")
+	}
+	holdPending = true
+	managerMutex.Unlock()
+
+	lock, err := fs.LockFile(lockPath(m.Config), wait)
+	managerMutex.Lock()
+	defer managerMutex.Unlock()
+	holdPending = false
+	if err != nil {
+		return err
+	}
+	heldLock = lock
+	return nil
+}
+
+
+// Releases the lock taken by Hold
+func (m *Manager) Release() error {
+	managerMutex.Lock()
+	defer managerMutex.Unlock()
+	if heldLock == nil {
+		return fmt.Errorf("The lock is not held")
+	}
+	return Unlock()
+}
+
+
+func (m *Manager) List(ctx context.Context) ([]*LayerStatus, error) {
+	var out []*LayerStatus
+	err := m.View(ctx, func (ld *Layerdefs) error {
+		out = ld.StatusAll()
+		return nil
+	})
+	return out, err
+}
+
+
+func (m *Manager) Status(ctx context.Context, name string) (*LayerStatus, error) {
+	var out *LayerStatus
+	err := m.View(ctx, func (ld *Layerdefs) (err error) {
+		out, err = ld.Status(name)
+		return
+	})
+	return out, err
+}
+
+
+func (m *Manager) Add(ctx context.Context, name, base, configFile string) error {
+	return m.Update(ctx, func (ld *Layerdefs) error {
+		return ld.AddLayer(name, base, configFile)
+	})
+}
+
+
+func (m *Manager) Remove(ctx context.Context, name string, removeFiles bool) error {
+	return m.Update(ctx, func (ld *Layerdefs) error {
+		return ld.RemoveLayer(name, removeFiles)
+	})
+}
+
+
+func (m *Manager) Rename(ctx context.Context, oldname, newname string) error {
+	return m.Update(ctx, func (ld *Layerdefs) error {
+		return ld.RenameLayer(oldname, newname)
+	})
+}
+
+
+func (m *Manager) Rebase(ctx context.Context, name, newbase string) error {
+	return m.Update(ctx, func (ld *Layerdefs) error {
+		return ld.RebaseLayer(name, newbase)
+	})
+}
+
+
+func (m *Manager) Mount(ctx context.Context, name string) error {
+	return m.Update(ctx, func (ld *Layerdefs) error {
+		return ld.Mount(name)
+	})
+}
+
+
+// Unmounts the named layer or, if the name is empty, all layers not in use
+func (m *Manager) Unmount(ctx context.Context, name string) error {
+	return m.Update(ctx, func (ld *Layerdefs) error {
+		return ld.Unmount(name, len(name) == 0)
+	})
+}
+
+
+func (m *Manager) Shake(ctx context.Context) error {
+	return m.Update(ctx, func (ld *Layerdefs) error {
+		return ld.Shake()
+	})
+}
+
+
+// Unmounts layers idle for at least the given time; see Layerdefs.Reap
+func (m *Manager) Reap(ctx context.Context, idle time.Duration) (reaped []string, err error) {
+	err = m.Update(ctx, func (ld *Layerdefs) error {
+		reaped, err = ld.Reap(idle)
+		return err
+	})
+	return
+}
+
+
+// Updates all layers in order; see Layerdefs.UpdateAll.  The lock is held only while each
+// layer is made ready, and other calls proceed while the update command runs.  Cancelling
+// the context kills the running command and leaves the remaining layers alone.
+func (m *Manager) UpdateAll(ctx context.Context, command []string) (results []UpdateResult,
+	err error) {
+	err = m.viewRunning(ctx, func (ld *Layerdefs, outside func (func () error) error) error {
+		results = ld.updateAll(command, ctx.Done(), func (cs *chrootSession) error {
+			return outside(func () error {
+				return cs.run(ctx.Done(), nil)
+			})
+		})
+		return ctx.Err()
+	})
+	return
+}
+
+
+// Opens an interactive session in a chroot of the named layer; see Exec
+func (m *Manager) Chroot(ctx context.Context, name string, session Session) error {
+	return m.runSession(ctx, name, nil, session, nil)
+}
+
+
+// Runs a command in a chroot of the named layer.  Neither the lock nor the Manager's hooks are
+// held while the command runs, which is killed if the context is cancelled.
+func (m *Manager) Exec(ctx context.Context, name string, command []string,
+		session Session) error {
+	if len(command) == 0 {
+		return fmt.Errorf("No command specified")
+	}
+	return m.runSession(ctx, name, command, session, nil)
+}
+
+
+// Like Exec, but returns the command's combined output rather than passing it through
+func (m *Manager) ExecOutput(ctx context.Context, name string, command []string,
+		session Session) ([]byte, error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("No command specified")
+	}
+	var out bytes.Buffer
+	err := m.runSession(ctx, name, command, session, &out)
+	return out.Bytes(), err
+}
+
+
+func (m *Manager) runSession(ctx context.Context, name string, command []string,
+		session Session, out io.Writer) error {
+	return m.viewRunning(ctx, func (ld *Layerdefs, outside func (func () error) error) error {
+		cs, err := ld.startSession(name, command, session)
+		if err != nil {
+			return err
+		}
+		err = outside(func () error {
+			return cs.run(ctx.Done(), out)
+		})
+		return cs.finish(err)
+	})
+}
+
+
+// Opens a shell in the build directory of the named layer; see Layerdefs.Shell.  Other calls
+// proceed while the shell runs.
+func (m *Manager) Shell(ctx context.Context, name string) error {
+	return m.viewRunning(ctx, func (ld *Layerdefs, outside func (func () error) error) error {
+		builddir, err := ld.shellDir(name)
+		if err != nil {
+			return err
+		}
+		return outside(func () error {
+			return fs.Shell(builddir)
+		})
+	})
+}
+
+
+func (m *Manager) Bootstrap(ctx context.Context, name, tarball, digestsFile string) error {
+	return m.Update(ctx, func (ld *Layerdefs) error {
+		return ld.Bootstrap(name, tarball, digestsFile)
+	})
+}
+
+
+func (m *Manager) Makedirs(ctx context.Context, name string) error {
+	return m.Update(ctx, func (ld *Layerdefs) error {
+		return ld.Makedirs(name)
+	})
+}
+
+
+func (m *Manager) ExportLayer(ctx context.Context, name, filename string) error {
+	return m.View(ctx, func (ld *Layerdefs) error {
+		return ld.ExportLayer(name, filename)
+	})
+}
+
+
+func (m *Manager) ImportLayer(ctx context.Context, filename, name, base string) error {
+	return m.Update(ctx, func (ld *Layerdefs) error {
+		return ld.ImportLayer(filename, name, base)
+	})
+}
+
+
+func (m *Manager) ApplyManifest(ctx context.Context, filename string) (steps []ApplyStep,
+	err error) {
+	err = m.Update(ctx, func (ld *Layerdefs) error {
+		steps, err = ld.ApplyManifest(filename)
+		return err
+	})
+	return
+}
+
+
+func (m *Manager) WriteManifest(ctx context.Context, filename string) error {
+	return m.View(ctx, func (ld *Layerdefs) error {
+		return ld.WriteManifest(filename)
+	})
+}
+
+
+func (m *Manager) CheckCoverage(ctx context.Context, name, archive string) (
+	problems []CoverageProblem, err error) {
+	err = m.View(ctx, func (ld *Layerdefs) error {
+		problems, err = ld.CheckCoverage(name, archive)
+		return err
+	})
+	return
+}
+
+
+func (m *Manager) PlanRebuild(ctx context.Context, name string) (items []RebuildItem,
+	err error) {
+	err = m.View(ctx, func (ld *Layerdefs) error {
+		items, err = ld.PlanRebuild(name)
+		return err
+	})
+	return
+}
+
+
+func (m *Manager) CompareLayers(ctx context.Context, nameA, nameB string) (
+	diffs []PackageDifference, err error) {
+	err = m.View(ctx, func (ld *Layerdefs) error {
+		diffs, err = ld.CompareLayers(nameA, nameB)
+		return err
+	})
+	return
+}
+
+
+func (m *Manager) Diagnose(ctx context.Context, name string) (problems []Diagnosis,
+	err error) {
+	err = m.View(ctx, func (ld *Layerdefs) error {
+		problems, err = ld.Diagnose(name)
+		return err
+	})
+	return
+}
+
+
+func (m *Manager) Repair(ctx context.Context, name string) (repaired int, err error) {
+	err = m.Update(ctx, func (ld *Layerdefs) error {
+		repaired, err = ld.Repair(name)
+		return err
+	})
+	return
+}
+
+
+func (m *Manager) SessionLogs(ctx context.Context, name string) (logs []SessionLog,
+	err error) {
+	err = m.View(ctx, func (ld *Layerdefs) error {
+		logs, err = ld.SessionLogs(name)
+		return err
+	})
+	return
+}
+
+
+// Writes a session log; see Layerdefs.ShowSessionLog.  Other calls proceed while the log is
+// followed, which stops when the context is cancelled.
+func (m *Manager) ShowSessionLog(ctx context.Context, name, logname string, follow bool,
+	w io.Writer) error {
+	var file *os.File
+	err := m.View(ctx, func (ld *Layerdefs) (err error) {
+		file, err = ld.openSessionLog(name, logname)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return copySessionLog(file, follow, ctx.Done(), w)
+}
@@ -0,0 +1,326 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"time"
+	"errors"
+	"context"
+	"strings"
+
+	"testing"
+	"potano.layercake/config"
+	"potano.layercake/fs"
+)
+
+
+func TestManager(t *testing.T) {
+	td, err := NewTmpdir("layercake_manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	mgr := NewManager(cfg, &config.Opts{})
+	for _, def := range []struct {name, base string} {
+		{"base", ""}, {"derived", "base"},
+	} {
+		if err = mgr.Add(ctx, def.name, def.base, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := mgr.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "base" || list[1].Name != "derived" ||
+		list[1].Base != "base" || list[1].State != Layerstate_complete ||
+		list[1].StateDescription != "not yet populated" || list[1].Usage != "idle" {
+		t.Fatalf("unexpected layer list %#v", list)
+	}
+
+	for _, test := range []struct {
+		desc string
+		err error
+		kind error
+	} {
+		{"status of missing layer", func () error {
+			_, err := mgr.Status(ctx, "nosuch")
+			return err
+		}(), ErrNotFound},
+		{"mount unpopulated layer", mgr.Mount(ctx, "derived"), ErrNotMountable},
+		{"rebase into cycle", mgr.Rebase(ctx, "base", "derived"), ErrCycle},
+	} {
+		if !errors.Is(test.err, test.kind) {
+			t.Errorf("%s: expected %v, got %v", test.desc, test.kind, test.err)
+		}
+		var layerErr *LayerError
+		if !errors.As(test.err, &layerErr) || len(layerErr.Layer) == 0 {
+			t.Errorf("%s: expected LayerError naming a layer, got %#v", test.desc,
+				test.err)
+		}
+	}
+
+	actions := []string{}
+	var messages strings.Builder
+	pretender := &Manager{
+		Config: cfg,
+		Opts: &config.Opts{Pretend: true},
+		Logger: &messages,
+		Pretender: func (msg string, parms...interface{}) bool {
+			actions = append(actions, msg)
+			return false
+		},
+	}
+	if err = pretender.Add(ctx, "other", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) == 0 {
+		t.Fatalf("pretender was not consulted")
+	}
+	if fs.MessageWriter == &messages {
+		t.Fatalf("logger not restored after call")
+	}
+	if status, _ := mgr.Status(ctx, "other"); status != nil {
+		t.Fatalf("pretended add created layer")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err = mgr.Add(cancelled, "other", "", ""); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+}
+
+
+func TestManagerHold(t *testing.T) {
+	td, err := NewTmpdir("layercake_manager_hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	mgr := NewManager(cfg, &config.Opts{})
+	if err = mgr.Release(); err == nil {
+		t.Fatal("released a lock which was not held")
+	}
+	if err = mgr.Hold(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	first := heldLock
+	if err = mgr.Hold(ctx, 0); err == nil {
+		t.Fatal("took a lock which was already held")
+	}
+	if heldLock != first {
+		t.Fatal("second Hold replaced the held lock")
+	}
+	if err = mgr.Add(ctx, "base", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if heldLock != first {
+		t.Fatal("Update disturbed the held lock")
+	}
+	if err = mgr.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if heldLock != nil {
+		t.Fatal("lock still held after Release")
+	}
+	lock, err := fs.LockFile(lockPath(cfg), 0)
+	if err != nil {
+		t.Fatalf("lock not released: %s", err)
+	}
+	lock.Unlock()
+}
+
+
+// A call waiting for another command's lock does not hold up calls which need no lock
+func TestManagerLockWaitDoesNotBlock(t *testing.T) {
+	td, err := NewTmpdir("layercake_manager_wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	mgr := NewManager(cfg, &config.Opts{Wait: 10 * time.Second})
+	mgr.Logger = &strings.Builder{}
+
+	// Stands for another layercake command
+	other, err := fs.LockFile(lockPath(cfg), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDone := make(chan error, 1)
+	go func () {
+		addDone <- mgr.Add(ctx, "base", "", "")
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	listDone := make(chan error, 1)
+	go func () {
+		_, err := mgr.List(ctx)
+		listDone <- err
+	}()
+	select {
+	case err = <-listDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("List blocked while Add waited for the lock")
+	}
+	select {
+	case err = <-addDone:
+		t.Fatalf("Add finished while another command held the lock: %v", err)
+	default:
+	}
+
+	if err = other.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-addDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Add did not proceed once the lock was free")
+	}
+	if heldLock != nil {
+		t.Error("lock still held after Add")
+	}
+}
+
+
+func TestManagerExecCancel(t *testing.T) {
+	td, cfg, _, cleanup := setUpMountableLayers(t, "layercake_manager_cancel",
+		[]struct {name, base string} {{"base", ""}})
+	defer cleanup()
+	err := td.WriteFile("/chroot", "#!/bin/sh\ntouch " + td.Path("/started") + "\nsleep 30\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ChrootExec = td.Path("/chroot")
+	if err = os.Chmod(cfg.ChrootExec, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mgr := NewManager(cfg, &config.Opts{})
+	mgr.Logger = &strings.Builder{}
+	execDone := make(chan error, 1)
+	go func () {
+		_, err := mgr.ExecOutput(ctx, "base", []string{"sleep"}, Session{})
+		execDone <- err
+	}()
+	for deadline := time.Now().Add(5 * time.Second); !td.IsFile("/started"); {
+		if time.Now().After(deadline) {
+			t.Fatal("command did not start")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case err = <-execDone:
+		if err == nil {
+			t.Fatal("cancelled command reported success")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling the context did not stop the command")
+	}
+}
+
+
+func TestManagerCommandsDoNotBlock(t *testing.T) {
+	td, cfg, _, cleanup := setUpMountableLayers(t, "layercake_manager_exec",
+		[]struct {name, base string} {{"base", ""}})
+	defer cleanup()
+	err := td.WriteFile("/chroot", "#!/bin/sh\ntouch " + td.Path("/started") + "\n" +
+		"while [ ! -e " + td.Path("/finish") + " ]; do sleep 0.05; done\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ChrootExec = td.Path("/chroot")
+	if err = os.Chmod(cfg.ChrootExec, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	mgr := NewManager(cfg, &config.Opts{})
+	mgr.Logger = &strings.Builder{}
+	for _, tc := range []struct {
+		name string
+		run func () error
+	}{
+		{"exec", func () error {
+			_, err := mgr.ExecOutput(ctx, "base", []string{"sleep"}, Session{})
+			return err
+		}},
+		{"update-all", func () error {
+			results, err := mgr.UpdateAll(ctx, []string{"sleep"})
+			if err == nil && len(results) > 0 {
+				err = results[0].Err
+			}
+			return err
+		}},
+	} {
+		os.Remove(td.Path("/started"))
+		os.Remove(td.Path("/finish"))
+		cmdDone := make(chan error, 1)
+		go func () {
+			cmdDone <- tc.run()
+		}()
+		for deadline := time.Now().Add(5 * time.Second); !td.IsFile("/started"); {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: command did not start", tc.name)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		listDone := make(chan error, 1)
+		go func () {
+			_, err := mgr.List(ctx)
+			listDone <- err
+		}()
+		select {
+		case err = <-listDone:
+			if err != nil {
+				t.Fatalf("%s: %s", tc.name, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: List blocked while a command ran", tc.name)
+		}
+		if heldLock != nil {
+			t.Errorf("%s: lock held while a command ran", tc.name)
+		}
+		if err = td.WriteFile("/finish", ""); err != nil {
+			t.Fatal(err)
+		}
+		if err = <-cmdDone; err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"potano.layercake/fs"
+)
+
+
+/*
+  A site manifest describes every layer in one file.  Each layer's description begins with a
+  line "layer <name>" and continues with the directives of a layerconfig file:  base, import,
+  export, env, and the like.  A "formerly <oldname>" directive marks a layer to be renamed from an
+  existing layer.  There are no hook directives:  layers have no hooks to describe, since
+  running site commands as root on every mount and unmount is left to scripts around layercake.
+*/
+type manifestEntry struct {
+	layer *Layerinfo
+	formerly string
+	sortKey string
+}
+
+
+const (
+	Apply_rename = iota
+	Apply_create
+	Apply_rebase
+	Apply_reconfigure
+	Apply_retire
+)
+
+var applyDescriptions []string = []string{
+	"rename",
+	"create",
+	"rebase",
+	"reconfigure",
+	"retire",
+}
+
+
+type ApplyStep struct {
+	Action int
+	Layer, Details string
+	entry *manifestEntry
+}
+
+
+func (as ApplyStep) Description() string {
+	return applyDescriptions[as.Action]
+}
+
+
+func readManifest(filename string) ([]*manifestEntry, error) {
+	cursor, err := fs.NewTextInputFileCursor(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	entries := map[string]*manifestEntry{}
+	var current *manifestEntry
+	var line string
+	for cursor.ReadNonBlankNonCommentLine(&line) {
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		if len(fields) < 1 {
+			continue
+		}
+		switch fields[0] {
+		case "layer":
+			current = nil
+			if len(fields) != 2 {
+				cursor.LogError("Expected a single layer name")
+			} else if !isLegalLayerName(fields[1]) {
+				cursor.LogError("Illegal layer name '" + fields[1] + "'")
+			} else if entries[fields[1]] != nil {
+				cursor.LogError("Layer " + fields[1] + " described more than once")
+			} else {
+				current = &manifestEntry{layer: newConfiguredLayer()}
+				current.layer.Name = fields[1]
+				entries[fields[1]] = current
+			}
+		case "formerly":
+			if current == nil {
+				cursor.LogError("'formerly' outside of layer description")
+			} else if len(fields) != 2 {
+				cursor.LogError("Expected a single former layer name")
+			} else {
+				current.formerly = fields[1]
+			}
+		default:
+			if current == nil {
+				cursor.LogError("'" + fields[0] + "' outside of layer description")
+			} else if !current.layer.parseConfigDirective(line, fields, cursor) {
+				cursor.LogError("Unknown manifest keyword '" + fields[0] + "'")
+			}
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	return sortManifestEntries(filename, entries)
+}
+
+
+// Orders manifest entries so that parents precede their children
+func sortManifestEntries(filename string, entries map[string]*manifestEntry) ([]*manifestEntry,
+		error) {
+	out := make([]*manifestEntry, 0, len(entries))
+	for name, entry := range entries {
+		key := name
+		visited := map[string]bool{name: true}
+		for base := entry.layer.Base; len(base) > 0; {
+			parent := entries[base]
+			if parent == nil {
+				return nil, fmt.Errorf("%s: layer %s refers to undescribed base %s",
+					filename, name, base)
+			}
+			if visited[base] {
+				return nil, layerErrorf(ErrCycle, name,
+					"%s: layer %s is in cycle of inheritance", filename, name)
+			}
+			visited[base] = true
+			key = base + "/" + key
+			base = parent.layer.Base
+		}
+		entry.sortKey = key
+		out = append(out, entry)
+	}
+	sort.Slice(out, func (i, j int) bool {
+		return out[i].sortKey < out[j].sortKey
+	})
+	return out, nil
+}
+
+
+/*
+  Compares a site manifest with the existing layers and returns the steps needed to make the
+  layers match it.  Renames come first, then creation, rebasing, and reconfiguration of
+  layers from parents to children, and finally retirement of layers the manifest does not
+  describe.  Retirement is the pseudo-deletion of the remove command.
+*/
+func (ld *Layerdefs) PlanManifest(filename string) ([]ApplyStep, error) {
+	entries, err := readManifest(filename)
+	if err != nil {
+		return nil, err
+	}
+	current := map[string]*Layerinfo{}
+	for name, layer := range ld.layermap {
+		current[name] = layer
+	}
+
+	var steps []ApplyStep
+	renamed := map[string]string{}
+	for _, entry := range entries {
+		name, formerly := entry.layer.Name, entry.formerly
+		if len(formerly) == 0 || current[formerly] == nil {
+			continue
+		}
+		if current[name] != nil {
+			return nil, fmt.Errorf("Cannot rename layer %s to %s: both exist", formerly,
+				name)
+		}
+		steps = append(steps, ApplyStep{Apply_rename, formerly, "to " + name, entry})
+		current[name] = current[formerly]
+		delete(current, formerly)
+		renamed[formerly] = name
+	}
+
+	described := map[string]bool{}
+	for _, entry := range entries {
+		want := entry.layer
+		described[want.Name] = true
+		have := current[want.Name]
+		if have == nil {
+			details := "as base layer"
+			if len(want.Base) > 0 {
+				details = "derived from " + want.Base
+			}
+			steps = append(steps, ApplyStep{Apply_create, want.Name, details, entry})
+			continue
+		}
+		haveBase := have.Base
+		if newname, have := renamed[haveBase]; have {
+			haveBase = newname
+		}
+		if haveBase != want.Base {
+			details := fmt.Sprintf("from %s to %s", describeBase(haveBase),
+				describeBase(want.Base))
+			steps = append(steps, ApplyStep{Apply_rebase, want.Name, details, entry})
+		}
+		var changed []string
+		if !sameNeededMounts(have.ConfigMounts, want.ConfigMounts) {
+			changed = append(changed, "imports")
+		}
+		if !sameNeededMounts(have.ConfigExports, want.ConfigExports) {
+			changed = append(changed, "exports")
+		}
+		if !sameStrings(have.ConfigEnv, want.ConfigEnv) ||
+			!sameStrings(have.ConfigEnvFiles, want.ConfigEnvFiles) {
+			changed = append(changed, "environment")
+		}
+		if !sameStrings(have.ConfigNamespaces, want.ConfigNamespaces) ||
+			have.ConfigHostname != want.ConfigHostname {
+			changed = append(changed, "isolation")
+		}
+		if have.ConfigPersonality != want.ConfigPersonality {
+			changed = append(changed, "personality")
+		}
+		if have.ConfigEmulation != want.ConfigEmulation {
+			changed = append(changed, "emulation")
+		}
+		if len(changed) > 0 {
+			steps = append(steps, ApplyStep{Apply_reconfigure, want.Name,
+				strings.Join(changed, ", "), entry})
+		}
+	}
+
+	for i := len(ld.normalizedOrder) - 1; i >= 0; i-- {
+		name := ld.normalizedOrder[i]
+		if current[name] != nil && !described[name] {
+			steps = append(steps, ApplyStep{Apply_retire, name, "", nil})
+		}
+	}
+	return steps, nil
+}
+
+
+// Plans the steps needed to make the layers match a site manifest and carries them out.  As
+// for other operations, the actions go through fs.WriteOK, which in pretend mode reports them
+// rather than taking them.
+func (ld *Layerdefs) ApplyManifest(filename string) ([]ApplyStep, error) {
+	steps, err := ld.PlanManifest(filename)
+	if err != nil {
+		return steps, err
+	}
+	for _, step := range steps {
+		switch step.Action {
+		case Apply_rename:
+			err = ld.RenameLayer(step.Layer, step.entry.layer.Name)
+		case Apply_create:
+			want := step.entry.layer
+			err = ld.AddLayer(want.Name, want.Base, "")
+			if err == nil {
+				err = ld.configureLayer(ld.layermap[want.Name], want)
+			}
+		case Apply_rebase:
+			err = ld.RebaseLayer(step.Layer, step.entry.layer.Base)
+		case Apply_reconfigure:
+			layer := ld.layermap[step.Layer]
+			err = layer.errorIfBusy("reconfigure", true)
+			if err == nil {
+				err = ld.configureLayer(layer, step.entry.layer)
+			}
+		case Apply_retire:
+			err = ld.RemoveLayer(step.Layer, false)
+		}
+		if err != nil {
+			return steps, fmt.Errorf("%s while applying %s of layer %s", err,
+				step.Description(), step.Layer)
+		}
+	}
+	return steps, nil
+}
+
+
+func (ld *Layerdefs) configureLayer(layer, want *Layerinfo) error {
+	layer.ConfigMounts = want.ConfigMounts
+	layer.ConfigExports = want.ConfigExports
+	layer.ConfigEnv = want.ConfigEnv
+	layer.ConfigEnvFiles = want.ConfigEnvFiles
+	layer.ConfigNamespaces = want.ConfigNamespaces
+	layer.ConfigHostname = want.ConfigHostname
+	layer.ConfigPersonality = want.ConfigPersonality
+	layer.ConfigEmulation = want.ConfigEmulation
+	return ld.writeLayerFile(layer)
+}
+
+
+// Writes a site manifest describing the existing layers, or to standard output if 'filename'
+// is empty
+func (ld *Layerdefs) WriteManifest(filename string) error {
+	cursor, err := fs.NewTextOutputFileCursor(filename)
+	if nil != err {
+		return err
+	}
+	defer cursor.Close()
+	cursor.Printf("# Layercake site manifest\n")
+	for _, layer := range ld.Layers() {
+		cursor.Printf("\nlayer %s\n", layer.Name)
+		writeConfigDirectives(cursor, layer)
+	}
+	return nil
+}
+
+
+func describeBase(base string) string {
+	if len(base) == 0 {
+		return "(base level)"
+	}
+	return base
+}
+
+
+func sameNeededMounts(a, b []NeededMountType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"strings"
+
+	"testing"
+	"potano.layercake/config"
+	"potano.layercake/fs"
+)
+
+
+func TestApplyManifest(t *testing.T) {
+	td, err := NewTmpdir("layercake_manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	opts := &config.Opts{}
+	layers, err := FindLayers(cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, def := range []struct {name, base string} {
+		{"base", ""}, {"dev", "base"}, {"devchild", "dev"}, {"stale", "base"},
+	} {
+		if err = layers.AddLayer(def.name, def.base, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dumped := td.Path("dumped")
+	if err = layers.WriteManifest(dumped); err != nil {
+		t.Fatal(err)
+	}
+	steps, err := layers.PlanManifest(dumped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) > 0 {
+		t.Fatalf("expected no steps for dumped manifest, got %d", len(steps))
+	}
+
+	dumpedText, err := fs.ReadFile(dumped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseImports := dumpedText[strings.Index(dumpedText, "import"):
+		strings.Index(dumpedText, "\nlayer dev\n")]
+	manifest := td.Path("manifest")
+	err = fs.WriteTextFile(manifest, `# Site layers
+layer base
+` + baseImports + `
+env EDITOR=vi
+
+layer development
+formerly dev
+base base
+` + baseImports + `
+layer devchild
+base development
+` + baseImports + `
+layer other
+base base
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	describe := func (steps []ApplyStep) string {
+		var out []string
+		for _, step := range steps {
+			out = append(out, strings.TrimSpace(step.Description() + " " + step.Layer + " " +
+				step.Details))
+		}
+		return strings.Join(out, "\n")
+	}
+	expected := `rename dev to development
+reconfigure base environment
+create other derived from base
+retire stale`
+
+	var reported []string
+	savedWriteOK := fs.WriteOK
+	fs.WriteOK = func (msg string, parms...interface{}) bool {
+		reported = append(reported, fmt.Sprintf(msg, parms...))
+		return false
+	}
+	steps, err = layers.ApplyManifest(manifest)
+	fs.WriteOK = savedWriteOK
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := describe(steps); have != expected {
+		t.Fatalf("expected plan\n%s\ngot\n%s", expected, have)
+	}
+	for _, want := range []string{"rename " + td.Path("/var/lib/layercake/layers/dev"),
+		"write text file " + td.Path("/var/lib/layercake/layers/base/layerconfig"),
+		"mkdir " + td.Path("/var/lib/layercake/layers/other"),
+		"rename " + td.Path("/var/lib/layercake/layers/stale")} {
+		found := false
+		for _, msg := range reported {
+			found = found || strings.HasPrefix(msg, want)
+		}
+		if !found {
+			t.Errorf("pretend mode did not report %s; reported\n%s", want,
+				strings.Join(reported, "\n"))
+		}
+	}
+	layers, err = FindLayers(cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layers.Layer("dev") == nil || layers.Layer("other") != nil {
+		t.Fatalf("pretend mode changed layers")
+	}
+
+	steps, err = layers.ApplyManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := describe(steps); have != expected {
+		t.Fatalf("expected steps\n%s\ngot\n%s", expected, have)
+	}
+	steps, err = layers.PlanManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) > 0 {
+		t.Errorf("expected layers to match manifest, but plan has\n%s", describe(steps))
+	}
+	reread, err := FindLayers(cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, layer := range reread.Layers() {
+		names = append(names, layer.Name + "<" + layer.Base)
+	}
+	if have := strings.Join(names, " "); have != "base< development<base devchild<development other<base" {
+		t.Errorf("unexpected layers after apply: %s", have)
+	}
+	env := reread.Layer("base").ConfigEnv
+	if len(env) != 1 || env[0] != "EDITOR=vi" {
+		t.Errorf("unexpected environment of base layer: %v", env)
+	}
+
+	err = fs.WriteTextFile(manifest, "layer a\nbase b\n\nlayer b\nbase a\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = layers.PlanManifest(manifest)
+	if err == nil || !strings.Contains(err.Error(), "cycle of inheritance") {
+		t.Errorf("expected cycle error, got %v", err)
+	}
+}
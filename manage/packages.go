@@ -0,0 +1,38 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"path"
+
+	"potano.layercake/defaults"
+	"potano.layercake/portage/atom"
+	"potano.layercake/portage/vdb"
+)
+
+
+// Reads the installed-package database of a layer.  A derived layer's database is visible
+// only through its overlayfs mount, so the layer must be mounted.
+func (ld *Layerdefs) installedPackages(layer *Layerinfo) (*atom.AtomSet, error) {
+	if err := ld.errorIfBuildRootHidden(layer); err != nil {
+		return nil, err
+	}
+	return vdb.GetInstalledPackageList(ld.buildPath(layer))
+}
+
+
+// Finds the host directory holding a layer's binary packages.  Uses the source of the
+// import onto the Portage binary-package directory if there is one.
+func (ld *Layerdefs) binpkgPath(layer *Layerinfo) (string, error) {
+	mounts, err := ld.expandConfigMounts(layer)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range mounts {
+		if m.UnexpandedMount == defaults.PortageBinpkgDir {
+			return m.Source, nil
+		}
+	}
+	return path.Join(ld.buildPath(layer), defaults.PortageBinpkgDir), nil
+}
@@ -0,0 +1,62 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"strings"
+)
+
+
+// Personalities a layerconfig may give chroot sessions, with their personality(2) values
+var personalities = map[string]uintptr{
+	"linux32": 0x0008,
+}
+
+
+// Returns the CHOST setting of the layer, or the empty string if it cannot be determined, as in
+// a layer not yet populated
+func (ld *Layerdefs) layerChost(layer *Layerinfo) string {
+	vars, err := ld.readPortageSettings(layer, nil)
+	if err != nil {
+		return ""
+	}
+	return vars["CHOST"]
+}
+
+
+// Reports whether a CHOST names a 32-bit system which the linux32 personality suits:  one
+// which runs in the compatibility mode of a 64-bit host, such as i686 on x86_64
+func chostIs32Bit(chost string) bool {
+	machine := chost
+	if pos := strings.IndexByte(chost, '-'); pos > 0 {
+		machine = chost[:pos]
+	}
+	switch {
+	case len(machine) == 4 && machine[0] == 'i' && machine[1] >= '3' && machine[1] <= '6' &&
+		machine[2:] == "86":
+		return true
+	case strings.HasPrefix(machine, "arm"):
+		return true
+	case machine == "powerpc" || machine == "s390" || machine == "sparc":
+		return true
+	case machine == "mips" || machine == "mipsel":
+		return true
+	}
+	return false
+}
+
+
+// Checks that the layer's personality suits its CHOST
+func (ld *Layerdefs) checkPersonality(layer *Layerinfo) error {
+	if layer.ConfigPersonality != "linux32" {
+		return nil
+	}
+	chost := ld.layerChost(layer)
+	if len(chost) > 0 && !chostIs32Bit(chost) {
+		return fmt.Errorf("Layer %s has personality linux32, but its CHOST %s is not that " +
+			"of a 32-bit system", layer.Name, chost)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"testing"
+	"potano.layercake/config"
+)
+
+
+func TestPersonality(t *testing.T) {
+	td, err := NewTmpdir("layercake_personality")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.AddLayer("x86", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	layer := layers.Layer("x86")
+
+	err = td.WriteFile("/layerconfig", "personality linux32\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configured, err := ReadLayerFile(td.Path("/layerconfig"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.ConfigPersonality = configured.ConfigPersonality
+	if setup := layer.chrootSetup(); setup.Personality != 0x0008 || setup.Cloneflags != 0 {
+		t.Errorf("unexpected chroot setup %#v", setup)
+	}
+	if err = layers.checkPersonality(layer); err != nil {
+		t.Errorf("unpopulated layer: %s", err)
+	}
+
+	profile := "/var/lib/layercake/layers/x86/build/etc/portage/make.profile"
+	if err = td.Mkdir(profile); err != nil {
+		t.Fatal(err)
+	}
+	err = td.WriteFile(profile + "/make.defaults", "CHOST=\"i686-pc-linux-gnu\"\n" +
+		"FEATURES=\"buildpkg binpkg-multi-instance\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.checkPersonality(layer); err != nil {
+		t.Errorf("i686 layer: %s", err)
+	}
+	err = td.WriteFile("/var/lib/layercake/layers/x86/build/etc/portage/make.conf",
+		"CHOST=\"x86_64-pc-linux-gnu\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = layers.checkPersonality(layer)
+	checkErrorByMessage(t, err, "Layer x86 has personality linux32, but its CHOST " +
+		"x86_64-pc-linux-gnu is not that of a 32-bit system", "x86_64 layer")
+	status, err := layers.Status("x86")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Personality != "linux32" || len(status.Messages) != 1 {
+		t.Errorf("unexpected status %#v", status)
+	}
+
+	err = td.WriteFile("/bad_layerconfig", "personality linux64\npersonality\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadLayerFile(td.Path("/bad_layerconfig"), true)
+	bad := td.Path("/bad_layerconfig")
+	checkErrorByMessage(t, err, "Unknown personality 'linux64' in " + bad + " line 1\n" +
+		"Personality directive must name one personality in " + bad + " line 2",
+		"bad directives")
+
+	for chost, want := range map[string]bool{"i686-pc-linux-gnu": true,
+		"i486-pc-linux-gnu": true, "armv7a-unknown-linux-gnueabihf": true,
+		"powerpc-unknown-linux-gnu": true, "x86_64-pc-linux-gnu": false,
+		"aarch64-unknown-linux-gnu": false, "powerpc64le-unknown-linux-gnu": false,
+		"i786-pc-linux-gnu": false} {
+		if chostIs32Bit(chost) != want {
+			t.Errorf("CHOST %s: expected 32-bit=%t", chost, want)
+		}
+	}
+}
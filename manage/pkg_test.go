@@ -611,6 +611,89 @@ phase string) *Layerdefs {
 
 
 
+// Sets up layers whose build roots have the directories needed for mounting, with mounts
+// carried out in a mountNinja.  Since the mountNinja's overlay mounts do not show the
+// contents of lower directories, derived layers get the directories too.  Returns a function
+// which undoes the setup.
+func setUpMountableLayers(t *testing.T, patt string, defs []struct {name, base string}) (
+	*Tmpdir, *config.ConfigType, *Layerdefs, func ()) {
+	td, err := NewTmpdir(patt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := td.MakeConfigTypeObj()
+	if err == nil {
+		err = InitLayercakeBase(cfg)
+	}
+	if err == nil {
+		err = td.WriteFile("/var/lib/layercake/default_layerconfig.skel", fns.Template(
+`import rbind /dev /dev
+import proc /proc /proc
+import rbind /sys /sys
+import rbind {tmpdir}/var/db/repos /var/db/repos
+import rbind {tmpdir}/var/cache/distfiles /var/cache/distfiles
+import rbind $$base/packages /var/cache/binpkgs
+`, map[string]string{"tmpdir": td.rootdir}))
+	}
+	if err == nil {
+		err = td.Mkdirs("/", "var/db/repos/gentoo var/cache/distfiles")
+	}
+	if err != nil {
+		td.Cleanup()
+		t.Fatal(err)
+	}
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		td.Cleanup()
+		t.Fatal(err)
+	}
+	for _, def := range defs {
+		err = layers.AddLayer(def.name, def.base, "")
+		if err == nil {
+			err = td.Mkdirs("/var/lib/layercake/layers/" + def.name + "/build",
+				mountableLayerDirs)
+		}
+		if err != nil {
+			td.Cleanup()
+			t.Fatal(err)
+		}
+	}
+
+	m_ninja := newMountNinja()
+	savedSyscallMount := fs.SyscallMount
+	savedSyscallUnmount := fs.SyscallUnmount
+	fs.GetAlternateProbeMountsCursor = func () fs.LineReader {
+		return fs.NewTextInputCursor("mountNinja", strings.NewReader(m_ninja.mountinfo()))
+	}
+	fs.SyscallMount = func (src, targ, fstype string, flgs uintptr, o string) error {
+		return m_ninja.mount(src, targ, fstype, flgs, o)
+	}
+	fs.SyscallUnmount = func (mtpoint string, flags int) error {
+		return m_ninja.unmount(mtpoint, flags)
+	}
+	return td, cfg, layers, func () {
+		fs.GetAlternateProbeMountsCursor = nil
+		fs.SyscallMount = savedSyscallMount
+		fs.SyscallUnmount = savedSyscallUnmount
+		td.Cleanup()
+	}
+}
+
+const mountableLayerDirs = "bin etc lib opt root sbin usr dev proc sys var/db/repos " +
+	"var/cache/distfiles var/cache/binpkgs"
+
+
+// Mounts a layer set up by setUpMountableLayers and returns the layers probed afresh
+func mountForTest(t *testing.T, cfg *config.ConfigType, name string) *Layerdefs {
+	layers := getLayers(t, cfg, &config.Opts{}, fs.InUseLayerMap{}, "mount " + name)
+	if err := layers.Mount(name); err != nil {
+		t.Fatalf("mount %s: %s", name, err)
+	}
+	return getLayers(t, cfg, &config.Opts{}, fs.InUseLayerMap{}, "mount " + name)
+}
+
+
+
 func TestManage(t *testing.T) {
 	fs.MessageWriter = capturingMessageWriter
 	var emptyFsMounts []*fs.MountType
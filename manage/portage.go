@@ -0,0 +1,95 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+
+	"potano.layercake/fs"
+	"potano.layercake/defaults"
+	"potano.layercake/portage/profile"
+	"potano.layercake/portage/makeconf"
+	"potano.layercake/portage/useconfig"
+)
+
+
+/*
+  Reads the Portage configuration of a layer:  the make.defaults files of its profile and
+  its make.conf.  Returns the resulting variables.  When 'uc' is not nil, also collects the
+  layer's USE settings, including those of package.use, into it.
+*/
+func (ld *Layerdefs) readPortageSettings(layer *Layerinfo, uc *useconfig.UseConfig) (
+	makeconf.Variables, error) {
+	err := ld.errorIfBuildRootHidden(layer)
+	if err != nil {
+		return nil, err
+	}
+	profilePath, err := ld.hostPath(layer, defaults.PortageMakeProfile)
+	if err != nil {
+		return nil, err
+	}
+	env, err := profile.ReadProfileSettings(profilePath, ld.repoLocator(layer), uc)
+	if err != nil {
+		return nil, err
+	}
+	makeConf, err := ld.hostPath(layer, defaults.PortageMakeConf)
+	if err != nil {
+		return nil, err
+	}
+	if fs.Exists(makeConf) {
+		vars, err := makeconf.ReadPath(makeConf, env)
+		if err != nil {
+			return nil, err
+		}
+		if uc != nil {
+			uc.AddVariables(vars, true)
+		}
+		env.Merge(vars)
+	}
+	if uc != nil {
+		packageUse, err := ld.hostPath(layer, defaults.PortagePackageUse)
+		if err != nil {
+			return nil, err
+		}
+		if fs.Exists(packageUse) {
+			if err = uc.AddPackageUse(packageUse); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return env, nil
+}
+
+
+/*
+  Returns a function which finds the host directory of a repository of a layer, as set in the
+  layer's repos.conf.  The files are read when a profile first names a repository.
+*/
+func (ld *Layerdefs) repoLocator(layer *Layerinfo) profile.RepoLocator {
+	var locations map[string]string
+	return func (repo string) (string, error) {
+		if locations == nil {
+			var files []string
+			for _, name := range []string{defaults.PortageDefaultReposConf,
+				defaults.PortageReposConf} {
+				filename, err := ld.hostPath(layer, name)
+				if err != nil {
+					return "", err
+				}
+				files = append(files, filename)
+			}
+			var err error
+			locations, err = profile.ReadRepoLocations(files...)
+			if err != nil {
+				return "", err
+			}
+		}
+		location, ok := locations[repo]
+		if !ok {
+			return "", fmt.Errorf("repository %s is not set in %s", repo,
+				defaults.PortageReposConf)
+		}
+		return ld.hostPath(layer, location)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"potano.layercake/fs"
+	"potano.layercake/defaults"
+	"potano.layercake/portage/profile"
+	"potano.layercake/portage/makeconf"
+)
+
+
+// FEATURES each layer needs so that layers sharing a binary-package directory keep their own
+// builds of each package rather than overwriting those of the others
+var requiredFeatures = []string{"buildpkg", "binpkg-multi-instance"}
+
+
+/*
+  Works out the layer's FEATURES setting as Portage does:  FEATURES is incremental, so the
+  settings in make.globals, the make.defaults files of the profile, and make.conf each add to
+  those before, with -feature removing a feature and -* removing all.
+*/
+func (ld *Layerdefs) portageFeatures(layer *Layerinfo) (map[string]bool, error) {
+	var files []string
+	makeGlobals, err := ld.hostPath(layer, defaults.PortageMakeGlobals)
+	if err != nil {
+		return nil, err
+	}
+	if fs.IsFile(makeGlobals) {
+		files = append(files, makeGlobals)
+	}
+	profilePath, err := ld.hostPath(layer, defaults.PortageMakeProfile)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := profile.ProfileDirectories(profilePath, ld.repoLocator(layer))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if filename := path.Join(dir, "make.defaults"); fs.IsFile(filename) {
+			files = append(files, filename)
+		}
+	}
+	makeConf, err := ld.hostPath(layer, defaults.PortageMakeConf)
+	if err != nil {
+		return nil, err
+	}
+	if fs.Exists(makeConf) {
+		files = append(files, makeConf)
+	}
+	features := map[string]bool{}
+	for _, filename := range files {
+		vars, err := makeconf.ReadPath(filename, makeconf.Variables{})
+		if err != nil {
+			return nil, err
+		}
+		for _, feature := range strings.Fields(vars["FEATURES"]) {
+			switch {
+			case feature == "-*":
+				features = map[string]bool{}
+			case strings.HasPrefix(feature, "-"):
+				delete(features, feature[1:])
+			default:
+				features[feature] = true
+			}
+		}
+	}
+	return features, nil
+}
+
+
+/*
+  Checks the parts of the layer's Portage configuration on which layercake depends:  the
+  FEATURES which keep the builds of layers sharing binary packages apart, a PKGDIR where the
+  parent's binary-package directory is imported, and a DISTDIR in a directory imported from
+  outside the layer so that layers share downloaded sources.  Returns a description of each
+  problem found.  Layers whose configuration cannot be read, such as unmounted derived layers,
+  are not checked.
+*/
+func (ld *Layerdefs) portageConfigProblems(layer *Layerinfo) []string {
+	vars, err := ld.readPortageSettings(layer, nil)
+	if err != nil {
+		return nil
+	}
+	features, err := ld.portageFeatures(layer)
+	if err != nil {
+		return []string{err.Error() + " reading FEATURES"}
+	}
+	var problems []string
+	missing := []string{}
+	for _, feature := range requiredFeatures {
+		if !features[feature] {
+			missing = append(missing, feature)
+		}
+	}
+	if len(missing) > 0 {
+		problems = append(problems, "FEATURES lacks " + strings.Join(missing, " "))
+	}
+
+	mounts, err := ld.expandConfigMounts(layer)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	pkgdir := path.Clean(portageDirSetting(vars, "PKGDIR", defaults.PortageBinpkgDir))
+	distdir := path.Clean(portageDirSetting(vars, "DISTDIR", defaults.PortageDistDir))
+	packagesImport := path.Join("$$base", ld.cfg.LayerBinPkgdir)
+	pkgdirImported, distdirShared := false, false
+	var packagesMount string
+	for _, m := range mounts {
+		source, target := path.Clean(m.UnexpandedSource), path.Clean(m.UnexpandedMount)
+		if source == packagesImport {
+			packagesMount = target
+			pkgdirImported = pkgdirImported || target == pkgdir
+		}
+		if !strings.HasPrefix(source, "$$self") && isWithinDir(target, distdir) {
+			distdirShared = true
+		}
+	}
+	if len(packagesMount) == 0 {
+		problems = append(problems, "no import of " + packagesImport + " for PKGDIR")
+	} else if !pkgdirImported {
+		problems = append(problems, fmt.Sprintf("PKGDIR %s is not %s, where %s is imported",
+			pkgdir, packagesMount, packagesImport))
+	}
+	if !distdirShared {
+		problems = append(problems, fmt.Sprintf("DISTDIR %s is not in a shared import",
+			distdir))
+	}
+	return problems
+}
+
+
+// Returns a directory setting of the Portage configuration, or Portage's default
+func portageDirSetting(vars makeconf.Variables, key, fallback string) string {
+	if value := vars[key]; len(value) > 0 {
+		return value
+	}
+	return fallback
+}
+
+
+func isWithinDir(dir, pathname string) bool {
+	return pathname == dir || strings.HasPrefix(pathname, dir + "/")
+}
@@ -0,0 +1,102 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"strings"
+
+	"testing"
+	"potano.layercake/config"
+)
+
+
+func TestPortageConfigProblems(t *testing.T) {
+	td, err := NewTmpdir("layercake_portagecheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.AddLayer("base", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	layer := layers.Layer("base")
+	if problems := layers.portageConfigProblems(layer); len(problems) > 0 {
+		t.Errorf("unpopulated layer: unexpected problems %v", problems)
+	}
+
+	builddir := "/var/lib/layercake/layers/base/build"
+	err = td.Mkdir(builddir + "/usr/share/portage/config")
+	if err == nil {
+		err = td.WriteFile(builddir + "/usr/share/portage/config/make.globals",
+			"FEATURES=\"binpkg-multi-instance sandbox\"\nPKGDIR=\"/var/cache/binpkgs\"\n")
+	}
+	if err == nil {
+		err = td.Mkdir(builddir + "/etc/portage/make.profile")
+	}
+	if err == nil {
+		err = td.WriteFile(builddir + "/etc/portage/make.profile/make.defaults",
+			"FEATURES=\"userpriv\"\n")
+	}
+	if err == nil {
+		err = td.Mkdir(builddir + "/etc/portage/make.conf")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tst := range []struct {
+		makeConf, want string
+	} {
+		{"FEATURES=\"buildpkg\"\n", ""},
+		{"FEATURES=\"buildpkg -binpkg-multi-instance\"\n",
+			"FEATURES lacks binpkg-multi-instance"},
+		{"FEATURES=\"-* sandbox\"\n", "FEATURES lacks buildpkg binpkg-multi-instance"},
+		{"FEATURES=\"buildpkg\"\nPKGDIR=\"/usr/portage/packages\"\n" +
+			"DISTDIR=\"/var/cache/distfiles/\"\n",
+			"PKGDIR /usr/portage/packages is not /var/cache/binpkgs, where $$base/packages " +
+			"is imported"},
+		{"FEATURES=\"buildpkg\"\nDISTDIR=\"/home/distfiles\"\n",
+			"DISTDIR /home/distfiles is not in a shared import"},
+	} {
+		err = td.WriteFile(builddir + "/etc/portage/make.conf/00-layer", tst.makeConf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		problems := strings.Join(layers.portageConfigProblems(layer), "; ")
+		if problems != tst.want {
+			t.Errorf("make.conf %q: expected %q, got %q", tst.makeConf, tst.want, problems)
+		}
+	}
+
+	layer.ConfigMounts = []NeededMountType{
+		{"/var/cache/distfiles", "$$self/distfiles", "rbind"},
+		{"/var/cache/binpkgs", "$$self/packages", "rbind"},
+	}
+	err = td.WriteFile(builddir + "/etc/portage/make.conf/00-layer", "FEATURES=\"buildpkg\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "no import of $$base/packages for PKGDIR; " +
+		"DISTDIR /var/cache/distfiles is not in a shared import"
+	if problems := strings.Join(layers.portageConfigProblems(layer), "; "); problems != want {
+		t.Errorf("expected %q, got %q", want, problems)
+	}
+	diagnoses, err := layers.Diagnose("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diagnoses) != 2 || diagnoses[0].Problem != "Portage configuration" {
+		t.Errorf("unexpected diagnoses %#v", diagnoses)
+	}
+}
@@ -15,6 +15,14 @@ import (
 
 
 func FindLayers(cfg *config.ConfigType, opts *config.Opts) (*Layerdefs, error) {
+	return findLayers(cfg, opts, false)
+}
+
+
+// Like FindLayers, but first recovers an interrupted operation if 'recovering' is set, which
+// requires the lock to be held.  Commands which only look at layers do not recover, so that
+// they never write.
+func findLayers(cfg *config.ConfigType, opts *config.Opts, recovering bool) (*Layerdefs, error) {
 	layers := &Layerdefs{
 		layermap: map[string]*Layerinfo{},
 		cfg: cfg,
@@ -23,7 +31,16 @@ func FindLayers(cfg *config.ConfigType, opts *config.Opts) (*Layerdefs, error) {
 	if err := layers.readLayerFiles(); err != nil {
 		return nil, err
 	}
+	if recovering {
+		if err := layers.recoverJournal(); err != nil {
+			return nil, err
+		}
+	}
 	if err := layers.checkInheritance(); err != nil {
+		if !recovering && fs.Exists(layers.journalPath()) {
+			return nil, fmt.Errorf("%s; the next command which changes layers will recover " +
+				"the operation interrupted in %s", err, layers.journalPath())
+		}
 		return nil, err
 	}
 	layers.normalizeOrder()
@@ -67,12 +84,13 @@ func (layers *Layerdefs) checkInheritance() error {
 		for len(base) > 0 {
 			layer = layers.layermap[base]
 			if layer == nil {
-				return fmt.Errorf("Layer %s refers to non-existent base %s",
-					layername, base)
+				return layerErrorf(ErrNotFound, base,
+					"Layer %s refers to non-existent base %s", layername, base)
 			}
 			layername = layer.Name
 			if visited[layername] {
-				return fmt.Errorf("Layer %s is in cycle of inheritance", layername)
+				return layerErrorf(ErrCycle, layername,
+					"Layer %s is in cycle of inheritance", layername)
 			}
 			visited[layername] = true
 			base = layer.Base
@@ -164,6 +182,7 @@ func (ld *Layerdefs) ProbeAllLayerstate(inuse fs.InUseLayerMap) error {
 		}
 
 		users := inuse[name]
+		layer.Users = users
 		if users != nil {
 			mountdirs := []string{ld.cfg.LayerBuildRoot, ld.cfg.LayerOvfsWorkdir,
 				ld.cfg.LayerOvfsUpperdir}
@@ -0,0 +1,86 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"potano.layercake/fs"
+	"potano.layercake/defaults"
+)
+
+
+/*
+  A layer's activity stamp is the modification time of a file in its layer directory.  It is
+  set when the layer is mounted, when a chroot or command using the layer starts and ends,
+  and whenever Reap finds that the layer has users.
+*/
+func (ld *Layerdefs) activityPath(layer *Layerinfo) string {
+	return path.Join(layer.LayerPath, defaults.ActivityFile)
+}
+
+
+func (ld *Layerdefs) noteActivity(layer *Layerinfo) error {
+	return fs.Touch(ld.activityPath(layer))
+}
+
+
+func (ld *Layerdefs) lastActivity(layer *Layerinfo) (time.Time, bool) {
+	info, err := os.Stat(ld.activityPath(layer))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
+
+
+/*
+  Unmounts mounted layers which have had no users for at least the given time.  Derived
+  layers are visited before their bases so that a base left idle by the unmounting of its
+  children is unmounted in the same pass.  A layer overlain by a mounted child is never
+  touched.  A mounted layer which lacks an activity stamp gets one now, starting its clock.
+  Returns the names of the layers unmounted.
+*/
+func (ld *Layerdefs) Reap(idle time.Duration) ([]string, error) {
+	reaped := []string{}
+	for i := len(ld.normalizedOrder) - 1; i >= 0; i-- {
+		layer := ld.layermap[ld.normalizedOrder[i]]
+		if len(layer.Mounts) == 0 || layer.State == Layerstate_error {
+			continue
+		}
+		if layer.MountBusy || layer.NonMountBusy || layer.Chroot {
+			if err := ld.noteActivity(layer); err != nil {
+				return reaped, err
+			}
+			continue
+		}
+		if layer.Overlain {
+			continue
+		}
+		last, stamped := ld.lastActivity(layer)
+		if !stamped {
+			if err := ld.noteActivity(layer); err != nil {
+				return reaped, err
+			}
+			continue
+		}
+		if time.Since(last) < idle {
+			continue
+		}
+		status, err := ld.unmountLayer(layer.Name)
+		switch status {
+		case Unmount_status_ok:
+			reaped = append(reaped, layer.Name)
+			if ld.opts.Verbose {
+				fs.Printf("Unmounted layer %s, idle since %s\n", layer.Name,
+					last.Format("2006-01-02 15:04:05"))
+			}
+		case Unmount_status_error:
+			return reaped, err
+		}
+	}
+	return reaped, nil
+}
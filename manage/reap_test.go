@@ -0,0 +1,131 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"time"
+	"strings"
+
+	"testing"
+	"potano.layercake/config"
+	"potano.layercake/fs"
+	"potano.layercake/fns"
+)
+
+
+func TestReap(t *testing.T) {
+	td, err := NewTmpdir("layercake_reap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	err = td.WriteFile("/var/lib/layercake/default_layerconfig.skel", fns.Template(
+`import rbind /dev /dev
+import proc /proc /proc
+import rbind /sys /sys
+import rbind {tmpdir}/var/db/repos /var/db/repos
+import rbind {tmpdir}/var/cache/distfiles /var/cache/distfiles
+import rbind $$base/packages /var/cache/binpkgs
+`, map[string]string{"tmpdir": td.rootdir}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, def := range []struct {name, base string} {
+		{"base", ""}, {"derived", "base"}, {"other", "base"},
+	} {
+		if err = layers.AddLayer(def.name, def.base, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mountpoints := "bin etc lib opt root sbin usr dev proc sys var/db/repos " +
+		"var/cache/distfiles var/cache/binpkgs"
+	err = td.Mkdirs("/var/lib/layercake/layers/base/build", mountpoints)
+	if err == nil {
+		err = td.Mkdirs("/", "var/db/repos/gentoo var/cache/distfiles")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m_ninja := newMountNinja()
+	savedSyscallMount := fs.SyscallMount
+	savedSyscallUnmount := fs.SyscallUnmount
+	fs.GetAlternateProbeMountsCursor = func () fs.LineReader {
+		return fs.NewTextInputCursor("mountNinja", strings.NewReader(m_ninja.mountinfo()))
+	}
+	fs.SyscallMount = func (src, targ, fstype string, flgs uintptr, o string) error {
+		return m_ninja.mount(src, targ, fstype, flgs, o)
+	}
+	fs.SyscallUnmount = func (mtpoint string, flags int) error {
+		return m_ninja.unmount(mtpoint, flags)
+	}
+	defer func () {
+		fs.GetAlternateProbeMountsCursor = nil
+		fs.SyscallMount = savedSyscallMount
+		fs.SyscallUnmount = savedSyscallUnmount
+	}()
+
+	idle := fs.InUseLayerMap{}
+	for _, name := range []string{"derived", "other"} {
+		layers = getLayers(t, cfg, &config.Opts{}, idle, "mount " + name)
+		if err = layers.Mount(name); err != nil {
+			t.Fatalf("mount %s: %s", name, err)
+		}
+		err = td.Mkdirs("/var/lib/layercake/layers/" + name + "/build", mountpoints)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	age := func (names...string) {
+		past := time.Now().Add(-3 * time.Hour)
+		for _, name := range names {
+			err := os.Chtimes(layers.activityPath(layers.Layer(name)), past, past)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	reap := func (phase string, inuse fs.InUseLayerMap, want...string) {
+		layers = getLayers(t, cfg, &config.Opts{}, inuse, phase)
+		reaped, err := layers.Reap(2 * time.Hour)
+		if err != nil {
+			t.Fatalf("%s: %s", phase, err)
+		}
+		if strings.Join(reaped, " ") != strings.Join(want, " ") {
+			t.Fatalf("%s: expected to reap %v, reaped %v", phase, want, reaped)
+		}
+	}
+
+	reap("recently mounted", idle)
+
+	age("base", "derived", "other")
+	busy := fs.InUseLayerMap{"derived": []fs.InUseProc{
+		{Pid: 1, UsedAs: fs.UsedAs_cwd, File: "build/root"},
+	}}
+	reap("derived busy", busy, "other")
+	if last, _ := layers.lastActivity(layers.Layer("derived")); time.Since(last) > time.Hour {
+		t.Errorf("activity stamp of busy layer not refreshed")
+	}
+	if len(layers.Layer("base").Mounts) == 0 {
+		t.Errorf("base unmounted while overlain by busy layer")
+	}
+
+	reap("derived no longer busy", idle)
+
+	age("derived")
+	reap("all idle", idle, "derived", "base")
+}
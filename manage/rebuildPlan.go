@@ -0,0 +1,77 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"strings"
+
+	"potano.layercake/portage/atom"
+	"potano.layercake/portage/vdb"
+	"potano.layercake/portage/useconfig"
+)
+
+
+type RebuildItem struct {
+	Package string
+	Changes string
+	Rebuilt bool
+}
+
+
+/*
+  Predicts which packages a derived layer must rebuild.  Applies the layer's USE
+  configuration (profile, make.conf, and package.use) to each package installed in its base
+  layer and lists those whose resulting USE flags differ from the installed flags.  Flags of
+  the packages' effective IUSE are compared, so that implicit flags count too.  Changes
+  are given as +flag or -flag according to the derived layer's setting.  Marks packages which
+  the layer has already rebuilt with the predicted flags.
+*/
+func (ld *Layerdefs) PlanRebuild(name string) ([]RebuildItem, error) {
+	err := ld.testName(nametest{name, name_need, "Layer"})
+	if nil != err {
+		return nil, err
+	}
+	layer := ld.layermap[name]
+	err = layer.errorIfError()
+	if err != nil {
+		return nil, err
+	}
+	if len(layer.Base) == 0 {
+		return nil, fmt.Errorf("Layer %s is a base layer; it rebuilds nothing", name)
+	}
+	baseSet, err := ld.installedPackages(ld.layermap[layer.Base])
+	if err != nil {
+		return nil, err
+	}
+	uc := useconfig.New()
+	_, err = ld.readPortageSettings(layer, uc)
+	if err != nil {
+		return nil, err
+	}
+	layerSet, err := ld.installedPackages(layer)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []RebuildItem
+	for _, atm := range baseSet.SortedAtoms() {
+		iuse, err := atm.(*vdb.AvailableVersion).GetEffectiveIUSE()
+		if err != nil {
+			return nil, err
+		}
+		predicted := uc.EffectiveUse(atm, iuse)
+		diffs := atom.DiffUseFlagMaps(atm.GetUseFlagMap(), predicted)
+		if len(diffs) == 0 {
+			continue
+		}
+		item := RebuildItem{Package: atm.String(), Changes: strings.Join(diffs, " ")}
+		if own := layerSet.Get(atm); own != nil {
+			item.Rebuilt = own.ComparisonString() == atm.ComparisonString() &&
+				len(atom.DiffUseFlagMaps(own.GetUseFlagMap(), predicted)) == 0
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
@@ -0,0 +1,93 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"testing"
+	"potano.layercake/fs"
+)
+
+
+func TestPlanRebuild(t *testing.T) {
+	_, cfg, _, cleanup := setUpMountableLayers(t, "layercake_rebuild",
+		[]struct {name, base string} {{"base", ""}, {"derived", "base"}})
+	defer cleanup()
+	layers := mountForTest(t, cfg, "derived")
+	lower := layers.buildPath(layers.Layer("base"))
+	merged := layers.buildPath(layers.Layer("derived"))
+
+	// Each entry is cpv|IUSE|IUSE_EFFECTIVE|USE
+	populate := func (builddir string, entries []string) {
+		for _, entry := range entries {
+			fields := strings.Split(entry, "|")
+			dir := path.Join(builddir, "var/db/pkg", fields[0])
+			err := fs.Mkdir(dir)
+			for i, name := range []string{"IUSE", "IUSE_EFFECTIVE", "USE"} {
+				if err == nil {
+					err = fs.WriteTextFile(path.Join(dir, name), fields[i+1] + "\n")
+				}
+			}
+			if err == nil {
+				err = fs.WriteTextFile(path.Join(dir, "SLOT"), "0\n")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	populate(lower, []string{
+		"dev-libs/libfoo-1.0|ssl +static-libs|abi_x86_64 amd64 ssl static-libs|" +
+			"abi_x86_64 amd64 static-libs",
+		"sys-apps/bar-2.0|ssl|abi_x86_64 amd64 ssl|abi_x86_64 amd64",
+		"app-misc/baz-1.0||abi_x86_32 abi_x86_64 amd64|abi_x86_64 amd64",
+	})
+	populate(merged, []string{
+		"dev-libs/libfoo-1.0|ssl +static-libs|abi_x86_64 amd64 ssl static-libs|" +
+			"abi_x86_64 amd64 ssl static-libs",
+	})
+
+	// The package.use entry touches libfoo but not bar; ABI_X86 touches only baz's implicit
+	// IUSE; ARCH sets amd64 implicitly
+	err := fs.Mkdir(path.Join(merged, "etc/portage/make.profile"))
+	if err == nil {
+		err = fs.WriteTextFile(path.Join(merged, "etc/portage/make.profile/make.defaults"),
+			"USE_EXPAND=\"ABI_X86\"\nUSE_EXPAND_UNPREFIXED=\"ARCH\"\nARCH=\"amd64\"\n" +
+			"ABI_X86=\"64\"\n")
+	}
+	if err == nil {
+		err = fs.WriteTextFile(path.Join(merged, "etc/portage/make.conf"),
+			"ABI_X86=\"64 32\"\n")
+	}
+	if err == nil {
+		err = fs.WriteTextFile(path.Join(merged, "etc/portage/package.use"),
+			"dev-libs/libfoo ssl\n")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := layers.PlanRebuild("derived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, item := range items {
+		have = append(have, fmt.Sprintf("%s %s %v", item.Package, item.Changes, item.Rebuilt))
+	}
+	expected := []string{
+		"app-misc/baz-1.0 +abi_x86_32 false",
+		"dev-libs/libfoo-1.0 +ssl true",
+	}
+	if !stringSlicesEqual(expected, have) {
+		t.Errorf("expected rebuilds\n  %s\ngot\n  %s", strings.Join(expected, "\n  "),
+			strings.Join(have, "\n  "))
+	}
+
+	_, err = layers.PlanRebuild("base")
+	checkErrorByMessage(t, err, "Layer base is a base layer; it rebuilds nothing", "base layer")
+}
@@ -0,0 +1,153 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"strconv"
+
+	"potano.layercake/fs"
+)
+
+
+// How a chroot or exec session runs.  The zero value runs the session as root through the
+// configured chroot executable.
+type Session struct {
+	// Name or uid of the user to run as, looked up in the layer's /etc/passwd; root if empty
+	User string
+
+	// Run the session through the user's login shell so that it reads /etc/profile
+	Login bool
+
+	// The session changes nothing in the layer, so that the views of layers derived from it
+	// stay current when it ends.  Otherwise any session may have changed the layer.
+	ReadOnly bool
+}
+
+
+func (s Session) isDefault() bool {
+	return len(s.User) == 0 && !s.Login
+}
+
+
+// A user of the layer as described by its /etc/passwd and /etc/group
+type sessionUser struct {
+	name string
+	uid, gid uint32
+	groups []uint32
+	home, shell string
+}
+
+
+// Looks up a user by name or uid in the layer's build root; the empty string means root
+func (ld *Layerdefs) lookupSessionUser(layer *Layerinfo, spec string) (*sessionUser, error) {
+	if len(spec) == 0 {
+		spec = "root"
+	}
+	etcdir := path.Join(ld.buildPath(layer), "etc")
+	usr, err := readPasswdEntry(path.Join(etcdir, "passwd"), spec)
+	if nil != err {
+		return nil, err
+	}
+	if usr == nil {
+		return nil, fmt.Errorf("User %s not found in /etc/passwd of layer %s", spec, layer.Name)
+	}
+	usr.groups, err = readUserGroups(path.Join(etcdir, "group"), usr.name, usr.gid)
+	if nil != err {
+		return nil, err
+	}
+	return usr, nil
+}
+
+
+func readPasswdEntry(filename, spec string) (*sessionUser, error) {
+	cursor, err := fs.NewTextInputFileCursor(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var found *sessionUser
+	var line string
+	for found == nil && cursor.ReadNonBlankNonCommentLine(&line) {
+		fields := strings.Split(line, ":")
+		if len(fields) != 7 || (fields[0] != spec && fields[2] != spec) {
+			continue
+		}
+		uid, uidErr := strconv.ParseUint(fields[2], 10, 32)
+		gid, gidErr := strconv.ParseUint(fields[3], 10, 32)
+		if uidErr != nil || gidErr != nil {
+			cursor.LogError("Invalid uid or gid")
+			continue
+		}
+		found = &sessionUser{name: fields[0], uid: uint32(uid), gid: uint32(gid),
+			home: fields[5], shell: fields[6]}
+		if len(found.home) == 0 {
+			found.home = "/"
+		}
+		if len(found.shell) == 0 {
+			found.shell = "/bin/sh"
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+
+// Returns the primary group and the groups which list the user as a member
+func readUserGroups(filename, username string, gid uint32) ([]uint32, error) {
+	groups := []uint32{gid}
+	cursor, err := fs.NewTextInputFileCursor(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var line string
+	for cursor.ReadNonBlankNonCommentLine(&line) {
+		fields := strings.Split(line, ":")
+		if len(fields) != 4 {
+			continue
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member != username {
+				continue
+			}
+			id, err := strconv.ParseUint(fields[2], 10, 32)
+			if err != nil {
+				cursor.LogError("Invalid gid")
+			} else if uint32(id) != gid {
+				groups = append(groups, uint32(id))
+			}
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+
+// Returns the program and arguments to run for a session as the user.  A login session runs a
+// command through the login shell so that the shell reads the profile before starting it.
+func (usr *sessionUser) sessionArgs(command []string, login bool) []string {
+	switch {
+	case login && len(command) == 0:
+		return []string{usr.shell, "-l"}
+	case login:
+		return append([]string{usr.shell, "-l", "-c", `exec "$0" "$@"`}, command...)
+	case len(command) == 0:
+		return []string{usr.shell, "-i"}
+	}
+	return command
+}
+
+
+// Environment settings which describe the user
+func (usr *sessionUser) identity() []string {
+	return []string{"HOME=" + usr.home, "SHELL=" + usr.shell, "USER=" + usr.name,
+		"LOGNAME=" + usr.name}
+}
@@ -0,0 +1,110 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"strings"
+	"strconv"
+
+	"testing"
+	"potano.layercake/config"
+)
+
+
+func TestSessionUser(t *testing.T) {
+	td, err := NewTmpdir("layercake_session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.AddLayer("base", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	layer := layers.Layer("base")
+	if err = td.Mkdir("/var/lib/layercake/layers/base/build/etc"); err != nil {
+		t.Fatal(err)
+	}
+	err = td.WriteFile("/var/lib/layercake/layers/base/build/etc/passwd",
+		`root:x:0:0:root:/root:/bin/bash
+portage:x:250:250:portage:/var/lib/portage/home:/bin/false
+nobody:x:65534:65534:nobody:/var/empty:
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = td.WriteFile("/var/lib/layercake/layers/base/build/etc/group", `root:x:0:root
+wheel:x:10:root,portage
+portage:x:250:portage
+tty:x:5:
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tst := range []struct {
+		spec, name string
+		uid, gid uint32
+		groups, home, shell string
+	} {
+		{"", "root", 0, 0, "0 10", "/root", "/bin/bash"},
+		{"portage", "portage", 250, 250, "250 10", "/var/lib/portage/home", "/bin/false"},
+		{"65534", "nobody", 65534, 65534, "65534", "/var/empty", "/bin/sh"},
+	} {
+		usr, err := layers.lookupSessionUser(layer, tst.spec)
+		if err != nil {
+			t.Errorf("%s: %s", tst.spec, err)
+			continue
+		}
+		groups := []string{}
+		for _, gid := range usr.groups {
+			groups = append(groups, strconv.FormatUint(uint64(gid), 10))
+		}
+		if usr.name != tst.name || usr.uid != tst.uid || usr.gid != tst.gid ||
+			strings.Join(groups, " ") != tst.groups || usr.home != tst.home ||
+			usr.shell != tst.shell {
+			t.Errorf("%s: unexpected user %#v", tst.spec, usr)
+		}
+	}
+	_, err = layers.lookupSessionUser(layer, "nosuch")
+	checkErrorByMessage(t, err, "User nosuch not found in /etc/passwd of layer base",
+		"missing user")
+
+	usr, _ := layers.lookupSessionUser(layer, "portage")
+	env, err := layers.chrootEnvironment(layer, usr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin " +
+		"HOME=/var/lib/portage/home SHELL=/bin/false USER=portage LOGNAME=portage"
+	if have := strings.Join(env, " "); !strings.HasPrefix(have, want) {
+		t.Errorf("expected environment starting\n%s\ngot\n%s", want, have)
+	}
+
+	usr.shell = "/bin/bash"
+	for _, tst := range []struct {
+		command []string
+		login bool
+		want string
+	} {
+		{nil, false, "/bin/bash -i"},
+		{nil, true, "/bin/bash -l"},
+		{[]string{"make", "check"}, false, "make check"},
+		{[]string{"make", "check"}, true, `/bin/bash -l -c exec "$0" "$@" make check`},
+	} {
+		if have := strings.Join(usr.sessionArgs(tst.command, tst.login), " "); have != tst.want {
+			t.Errorf("%v login=%t: expected %s, got %s", tst.command, tst.login, tst.want, have)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+	"bufio"
+	"bytes"
+	"strings"
+
+	"potano.layercake/fs"
+	"potano.layercake/defaults"
+)
+
+
+/*
+  Each chroot or exec session's output is kept in a log in the logs subdirectory of the
+  layer's generated-files directory, which the export symlinks make available to the web
+  server.  A log consists of a header giving the command, a transcript of the output, and a
+  trailer giving the outcome:
+
+    # layercake session log
+    # layer: <name>
+    # user: <user>
+    # command: <command line, or "chroot" for an interactive session>
+    # started: <time>
+    <output>
+    # ended: <time>: <ok, or the error>
+
+  Logs are named for the starting time so that they sort in order; a sequence number follows
+  the time of a session started in the same second as another.
+*/
+const (
+	sessionLogTimeFormat = "20060102-150405"
+	sessionLogSuffix = ".log"
+	sessionLogHeader = "# layercake session log"
+	sessionLogEndPrefix = "# ended: "
+)
+
+
+type SessionLog struct {
+	Name, Path string
+	Size int64
+	Command, Started, Outcome string
+}
+
+
+func (ld *Layerdefs) sessionLogPath(layer *Layerinfo) string {
+	return path.Join(layer.LayerPath, ld.cfg.LayerGeneratedir, defaults.SessionLogDir)
+}
+
+
+// Opens a new session log for a command run in the layer; returns nil when pretending
+func (ld *Layerdefs) startSessionLog(layer *Layerinfo, command []string) (*os.File, error) {
+	if !fs.WriteOK("write session log for layer %s", layer.Name) {
+		return nil, nil
+	}
+	dir := ld.sessionLogPath(layer)
+	if !fs.IsDir(dir) {
+		if err := fs.Mkdir(dir); err != nil {
+			return nil, err
+		}
+		if err := ld.makeExportSymlinks(layer); err != nil {
+			return nil, err
+		}
+	}
+	kind, cmdline := "exec", strings.Join(command, " ")
+	if len(command) == 0 {
+		kind, cmdline = "chroot", "chroot"
+	}
+	now := time.Now()
+	stamp := now.Format(sessionLogTimeFormat)
+	var file *os.File
+	var err error
+	for seq := 1; file == nil; seq++ {
+		name := stamp + "-" + kind + sessionLogSuffix
+		if seq > 1 {
+			name = fmt.Sprintf("%s.%03d-%s%s", stamp, seq, kind, sessionLogSuffix)
+		}
+		file, err = os.OpenFile(path.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+			0644)
+		if err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	}
+	_, err = fmt.Fprintf(file, "%s\n# layer: %s\n# user: %s\n# command: %s\n# started: %s\n",
+		sessionLogHeader, layer.Name, fs.InvokingUser(), cmdline,
+		now.Format(time.RFC3339))
+	if err == nil {
+		err = ld.pruneSessionLogs(layer)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+
+func endSessionLog(file *os.File, sessionErr error) error {
+	outcome := "ok"
+	if sessionErr != nil {
+		outcome = sessionErr.Error()
+	}
+	_, err := fmt.Fprintf(file, "\n%s%s: %s\n", sessionLogEndPrefix,
+		time.Now().Format(time.RFC3339), outcome)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+
+func (ld *Layerdefs) sessionLogNames(layer *Layerinfo) ([]string, error) {
+	dir := ld.sessionLogPath(layer)
+	if !fs.IsDir(dir) {
+		return nil, nil
+	}
+	names, err := fs.Readdirnames(dir)
+	if err != nil {
+		return nil, err
+	}
+	logs := []string{}
+	for _, name := range names {
+		if strings.HasSuffix(name, sessionLogSuffix) {
+			logs = append(logs, name)
+		}
+	}
+	sort.Strings(logs)
+	return logs, nil
+}
+
+
+// Removes the oldest logs beyond the configured number to retain
+func (ld *Layerdefs) pruneSessionLogs(layer *Layerinfo) error {
+	if ld.cfg.LogRetention < 1 {
+		return nil
+	}
+	names, err := ld.sessionLogNames(layer)
+	if err != nil {
+		return err
+	}
+	for len(names) > ld.cfg.LogRetention {
+		err = fs.Remove(path.Join(ld.sessionLogPath(layer), names[0]))
+		if err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+
+// Lists the layer's session logs, oldest first
+func (ld *Layerdefs) SessionLogs(name string) ([]SessionLog, error) {
+	err := ld.testName(nametest{name, name_need, "Layer"})
+	if nil != err {
+		return nil, err
+	}
+	layer := ld.layermap[name]
+	names, err := ld.sessionLogNames(layer)
+	if err != nil {
+		return nil, err
+	}
+	logs := make([]SessionLog, 0, len(names))
+	for _, logname := range names {
+		log := SessionLog{Name: logname, Path: path.Join(ld.sessionLogPath(layer), logname)}
+		if err = readSessionLogSummary(&log); err != nil {
+			return nil, err
+		}
+		logs = append(logs, log)
+	}
+	return logs, nil
+}
+
+
+func readSessionLogSummary(log *SessionLog) error {
+	file, err := os.Open(log.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	log.Size = info.Size()
+	scanner := bufio.NewScanner(file)
+	for lines := 0; lines < 5 && scanner.Scan(); lines++ {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# command: ") {
+			log.Command = line[len("# command: "):]
+		} else if strings.HasPrefix(line, "# started: ") {
+			log.Started = line[len("# started: "):]
+		}
+	}
+	log.Outcome = "in progress"
+	tail := make([]byte, 1024)
+	offset := log.Size - int64(len(tail))
+	if offset < 0 {
+		offset = 0
+	}
+	n, _ := file.ReadAt(tail, offset)
+	lines := strings.Split(strings.TrimRight(string(tail[:n]), "\n"), "\n")
+	last := lines[len(lines) - 1]
+	if strings.HasPrefix(last, sessionLogEndPrefix) {
+		// The outcome follows the time, which itself contains colons
+		ended := last[len(sessionLogEndPrefix):]
+		if pos := strings.Index(ended, ": "); pos > 0 {
+			log.Outcome = ended[pos + 2:]
+		}
+	}
+	return nil
+}
+
+
+/*
+  Writes the named session log of the layer, or its latest log if the name is empty.  When
+  following, keeps writing what is added to the log until the session ends.
+*/
+func (ld *Layerdefs) ShowSessionLog(name, logname string, follow bool, w io.Writer) error {
+	file, err := ld.openSessionLog(name, logname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return copySessionLog(file, follow, nil, w)
+}
+
+
+// Opens the named session log of the layer, or its latest log if the name is empty
+func (ld *Layerdefs) openSessionLog(name, logname string) (*os.File, error) {
+	err := ld.testName(nametest{name, name_need, "Layer"})
+	if nil != err {
+		return nil, err
+	}
+	layer := ld.layermap[name]
+	names, err := ld.sessionLogNames(layer)
+	if err != nil {
+		return nil, err
+	}
+	if len(logname) == 0 {
+		if len(names) == 0 {
+			return nil, fmt.Errorf("Layer %s has no session logs", name)
+		}
+		logname = names[len(names) - 1]
+	} else if !strings.HasSuffix(logname, sessionLogSuffix) {
+		logname += sessionLogSuffix
+	}
+	if strings.Contains(logname, "/") {
+		return nil, fmt.Errorf("Invalid log name %s", logname)
+	}
+	file, err := os.Open(path.Join(ld.sessionLogPath(layer), logname))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("Layer %s has no session log %s", name, logname)
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+
+// Copies a session log to the writer, following it as for ShowSessionLog until the session
+// ends or the done channel is closed
+func copySessionLog(file *os.File, follow bool, done <-chan struct{}, w io.Writer) error {
+	buf := make([]byte, 32 * 1024)
+	var recent []byte
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			recent = append(recent, buf[:n]...)
+			if len(recent) > 1024 {
+				recent = recent[len(recent) - 1024:]
+			}
+		}
+		if err == io.EOF {
+			if !follow || sessionLogEnded(recent) {
+				return nil
+			}
+			select {
+			case <-done:
+				return nil
+			case <-time.After(250 * time.Millisecond):
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+
+func sessionLogEnded(recent []byte) bool {
+	trimmed := bytes.TrimRight(recent, "\n")
+	lastLine := trimmed[bytes.LastIndexByte(trimmed, '\n') + 1:]
+	return bytes.HasPrefix(lastLine, []byte(sessionLogEndPrefix)) &&
+		bytes.HasSuffix(recent, []byte("\n"))
+}
@@ -0,0 +1,99 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"bytes"
+	"strings"
+
+	"testing"
+	"potano.layercake/fs"
+)
+
+
+func TestSessionLogs(t *testing.T) {
+	td, cfg, layers, cleanup := setUpMountableLayers(t, "layercake_sessionlog",
+		[]struct {name, base string} {{"base", ""}})
+	defer cleanup()
+	err := td.WriteFile("/chroot", `#!/bin/sh
+shift
+echo "running $*"
+[ "$1" != fail ]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ChrootExec = td.Path("/chroot")
+	cfg.LogRetention = 2
+	if err = os.Chmod(cfg.ChrootExec, 0755); err != nil {
+		t.Fatal(err)
+	}
+	layers = mountForTest(t, cfg, "base")
+
+	for _, command := range [][]string{{"first"}, {"emerge", "-u", "gcc"}, {"fail"}} {
+		output, err := layers.ExecOutput("base", command, Session{})
+		if want := "running " + strings.Join(command, " ") + "\n"; string(output) != want {
+			t.Errorf("expected output %q, got %q", want, output)
+		}
+		if (command[0] == "fail") != (err != nil) {
+			t.Errorf("%v: unexpected result %v", command, err)
+		}
+	}
+
+	logs, err := layers.SessionLogs("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("expected 2 logs to be retained, got %#v", logs)
+	}
+	if logs[0].Command != "emerge -u gcc" || logs[0].Outcome != "ok" ||
+		!strings.HasSuffix(logs[0].Name, "-exec.log") {
+		t.Errorf("unexpected first log %#v", logs[0])
+	}
+	if logs[1].Command != "fail" || logs[1].Outcome != "exit status 1" {
+		t.Errorf("unexpected second log %#v", logs[1])
+	}
+
+	var shown bytes.Buffer
+	if err = layers.ShowSessionLog("base", "", true, &shown); err != nil {
+		t.Fatal(err)
+	}
+	text := shown.String()
+	if !strings.HasPrefix(text, sessionLogHeader + "\n# layer: base\n") ||
+		!strings.Contains(text, "# command: fail\n") ||
+		!strings.Contains(text, "\nrunning fail\n") ||
+		!strings.HasSuffix(text, ": exit status 1\n") {
+		t.Errorf("unexpected log contents:\n%s", text)
+	}
+	// Pruning goes through the pretender as other removals do
+	var reported []string
+	savedWriteOK := fs.WriteOK
+	fs.WriteOK = func (msg string, parms...interface{}) bool {
+		reported = append(reported, fmt.Sprintf(msg, parms...))
+		return false
+	}
+	cfg.LogRetention = 1
+	err = layers.pruneSessionLogs(layers.Layer("base"))
+	fs.WriteOK = savedWriteOK
+	cfg.LogRetention = 2
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldest := path.Join(layers.sessionLogPath(layers.Layer("base")), logs[0].Name)
+	if len(reported) != 1 || reported[0] != "remove " + oldest || !fs.IsFile(oldest) {
+		t.Errorf("pretended pruning: reported %v", reported)
+	}
+
+	err = layers.ShowSessionLog("base", "nosuch", false, &shown)
+	checkErrorByMessage(t, err, "Layer base has no session log nosuch.log", "missing log")
+
+	exported := path.Join(cfg.Exportdirs, cfg.ExportGeneratedir, "base")
+	if !fs.IsSymlink(exported) || !fs.IsDir(path.Join(exported, "logs")) {
+		t.Errorf("logs not exported through %s", exported)
+	}
+}
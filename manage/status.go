@@ -0,0 +1,87 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"potano.layercake/fs"
+)
+
+
+// Snapshot of a layer's state as found by the most recent probe
+type LayerStatus struct {
+	Name string `json:"name"`
+	Base string `json:"base,omitempty"`
+	State int `json:"state"`
+	StateDescription string `json:"state_description"`
+	Usage string `json:"usage"`
+	MountBusy bool `json:"mount_busy"`
+	NonMountBusy bool `json:"nonmount_busy"`
+	Overlain bool `json:"overlain"`
+	Chroot bool `json:"chroot"`
+	Stale bool `json:"stale"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Personality string `json:"personality,omitempty"`
+	EmulatedArch string `json:"emulated_arch,omitempty"`
+	Interpreter string `json:"interpreter,omitempty"`
+	Messages []string `json:"messages,omitempty"`
+	RequiredMounts []string `json:"required_mounts,omitempty"`
+	Overlayfs bool `json:"overlayfs"`
+	OtherMounts []string `json:"other_mounts,omitempty"`
+	Users []fs.InUseProc `json:"users,omitempty"`
+}
+
+
+func (ld *Layerdefs) Status(name string) (*LayerStatus, error) {
+	err := ld.testName(nametest{name, name_need, "Layer"})
+	if nil != err {
+		return nil, err
+	}
+	layer := ld.layermap[name]
+	status := ld.layerStatus(layer)
+	if err = ld.checkPersonality(layer); nil != err {
+		status.Messages = append(status.Messages, err.Error())
+	}
+	status.Messages = append(status.Messages, ld.hostCompatibilityProblems(layer)...)
+	status.Messages = append(status.Messages, ld.portageConfigProblems(layer)...)
+	return status, nil
+}
+
+
+// Returns the status of all layers, parents before children
+func (ld *Layerdefs) StatusAll() []*LayerStatus {
+	out := []*LayerStatus{}
+	for _, layer := range ld.Layers() {
+		out = append(out, ld.layerStatus(layer))
+	}
+	return out
+}
+
+
+func (ld *Layerdefs) layerStatus(layer *Layerinfo) *LayerStatus {
+	required, overlayfs, other := ld.classifyMounts(layer)
+	emu := ld.layerEmulation(layer)
+	return &LayerStatus{
+		Name: layer.Name,
+		Base: layer.Base,
+		State: layer.State,
+		StateDescription: layer.StateDescription(),
+		Usage: layer.DescribeUsage(),
+		MountBusy: layer.MountBusy,
+		NonMountBusy: layer.NonMountBusy,
+		Overlain: layer.Overlain,
+		Chroot: layer.Chroot,
+		Stale: ld.ViewIsStale(layer),
+		Namespaces: layer.ConfigNamespaces,
+		Hostname: layer.ConfigHostname,
+		Personality: layer.ConfigPersonality,
+		EmulatedArch: emu.Arch,
+		Interpreter: emu.Interpreter,
+		Messages: append([]string{}, layer.Messages...),
+		RequiredMounts: required,
+		Overlayfs: overlayfs,
+		OtherMounts: other,
+		Users: layer.Users,
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"potano.layercake/fs"
+	"potano.layercake/defaults"
+	"potano.layercake/stage"
+)
+
+
+/*
+  Writes a layer to a tarball, compressed according to the filename extension.  Entry names
+  are relative to the layers directory:  the tarball holds the layer directory with its
+  layerconfig file and either the build root of a base layer or the overlayfs upper
+  directory of a derived layer.  Overlayfs whiteouts and opaque-directory attributes in the
+  upper directory are preserved as device nodes and extended attributes.
+*/
+func (ld *Layerdefs) ExportLayer(name, filename string) error {
+	err := ld.testName(nametest{name, name_need, "Layer"})
+	if nil != err {
+		return err
+	}
+	if len(filename) == 0 {
+		return fmt.Errorf("Specify an output file with -o")
+	}
+	layer := ld.layermap[name]
+	err = layer.errorIfError()
+	if err != nil {
+		return err
+	}
+	err = layer.errorIfBusy("export", false)
+	if err != nil {
+		return err
+	}
+	tree := ld.cfg.LayerBuildRoot
+	if len(layer.Base) > 0 {
+		tree = ld.cfg.LayerOvfsUpperdir
+	}
+	treePath := path.Join(layer.LayerPath, tree)
+	if !fs.IsDir(treePath) {
+		return fmt.Errorf("Layer %s has no directory %s", name, treePath)
+	}
+
+	listing := []string{"dir /" + name, "file /" + path.Join(name, defaults.LayerconfigFile)}
+	for dir := path.Dir(tree); dir != "."; dir = path.Dir(dir) {
+		listing = append(listing, "dir /" + path.Join(name, dir))
+	}
+	listing = append(listing, "dir /" + path.Join(name, tree))
+	names, err := fs.Readdirnames(treePath)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		listing = append(listing, "dir /" + path.Join(name, tree, "*"))
+	}
+	fileList, err := stage.GenerateFileList(nil, ld.cfg.Layerdirs)
+	if err != nil {
+		return err
+	}
+	cursor := fs.NewTextInputCursor("export of " + name,
+		strings.NewReader(strings.Join(listing, "\n")))
+	if err = fileList.ReadUserFileList(cursor); err != nil {
+		return err
+	}
+	fileList.Finalize()
+
+	if !fs.WriteOK("write layer %s to %s", name, filename) {
+		return nil
+	}
+	writer, err := fs.CreateCompressed(filename)
+	if err != nil {
+		return err
+	}
+	err = fileList.MakeTar(writer)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+
+/*
+  Reconstructs a layer from a tarball written by ExportLayer.  The layer takes the name it
+  had when exported unless 'name' is given.  The parent layer is the one declared in the
+  tarball's layerconfig unless 'base' is given; it must exist.
+*/
+func (ld *Layerdefs) ImportLayer(filename, name, base string) error {
+	contents, err := scanLayerTarball(filename, ld.cfg.LayerBuildRoot,
+		ld.cfg.LayerOvfsUpperdir)
+	if err != nil {
+		return err
+	}
+	cursor := fs.NewTextInputCursor(filename + ": " + defaults.LayerconfigFile,
+		strings.NewReader(contents.layerconfig))
+	layer, err := readLayerConfig(cursor, true)
+	if err != nil {
+		return err
+	}
+	if len(name) == 0 {
+		name = contents.name
+	}
+	if len(base) == 0 {
+		base = layer.Base
+	}
+	if contents.derived && len(base) == 0 {
+		return fmt.Errorf("%s holds a derived layer; specify its parent with -base", filename)
+	}
+	if !contents.derived && len(base) > 0 {
+		return fmt.Errorf("%s holds a base layer; it cannot have parent layer %s", filename,
+			base)
+	}
+	err = ld.testName(nametest{name, name_free, "Layer"},
+		nametest{base, name_optional | name_need, "Parent layer"})
+	if nil != err {
+		return err
+	}
+
+	layer.Name = name
+	layer.Base = base
+	layer.LayerPath = ld.layerPath(name)
+	layer.Mounts = []*fs.MountType{}
+	tmpdir := layer.LayerPath + defaults.ImportingLayerSuffix
+	if fs.Exists(tmpdir) {
+		return fmt.Errorf("Directory %s is in the way", tmpdir)
+	}
+	if err = fs.Mkdir(tmpdir); err != nil {
+		return err
+	}
+	err = fs.ExtractTarball(filename, tmpdir)
+	if err == nil {
+		err = fs.Rename(path.Join(tmpdir, contents.name), layer.LayerPath)
+	}
+	if removeErr := fs.Remove(tmpdir); err == nil {
+		err = removeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = ld.writeLayerFile(layer); err != nil {
+		return err
+	}
+	needDirs := []string{ld.buildPath(layer)}
+	if len(base) > 0 {
+		needDirs = append(needDirs, ld.ovfsWorkPath(layer))
+	}
+	for _, dir := range needDirs {
+		if !fs.IsDir(dir) {
+			if err = fs.Mkdir(dir); err != nil {
+				return err
+			}
+		}
+	}
+	ld.layermap[name] = layer
+	ld.normalizeOrder()
+	return nil
+}
+
+
+type layerTarballContents struct {
+	name, layerconfig string
+	derived bool
+}
+
+
+// Checks that a tarball holds a single exported layer and reads its layerconfig
+func scanLayerTarball(filename, buildRoot, upperdir string) (*layerTarballContents, error) {
+	reader, err := fs.OpenDecompressed(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	contents := &layerTarballContents{}
+	haveBuild, haveUpper, haveLayerconfig := false, false, false
+	isUnder := func (name, dir string) bool {
+		return name == dir || strings.HasPrefix(name, dir + "/")
+	}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s reading %s", err, filename)
+		}
+		entry := path.Clean(hdr.Name)
+		if entry == "." {
+			continue
+		}
+		if path.IsAbs(entry) || isUnder(entry, "..") {
+			return nil, fmt.Errorf("%s has entry %s outside of layer", filename, hdr.Name)
+		}
+		parts := strings.SplitN(entry, "/", 2)
+		if len(contents.name) == 0 {
+			contents.name = parts[0]
+			if !isLegalLayerName(contents.name) {
+				return nil, fmt.Errorf("%s has illegal layer name %s", filename,
+					contents.name)
+			}
+		} else if parts[0] != contents.name {
+			return nil, fmt.Errorf("%s holds more than one layer", filename)
+		}
+		if len(parts) == 1 {
+			continue
+		}
+		rest := parts[1]
+		switch {
+		case rest == defaults.LayerconfigFile:
+			blob, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			contents.layerconfig = string(blob)
+			haveLayerconfig = true
+		case isUnder(rest, buildRoot):
+			haveBuild = true
+		case isUnder(rest, upperdir):
+			haveUpper = true
+		case isUnder(upperdir, rest) && hdr.Typeflag == tar.TypeDir:
+		default:
+			return nil, fmt.Errorf("%s has unexpected entry %s", filename, hdr.Name)
+		}
+	}
+	if !haveLayerconfig {
+		return nil, fmt.Errorf("%s has no %s file", filename, defaults.LayerconfigFile)
+	}
+	if haveBuild == haveUpper {
+		return nil, fmt.Errorf("%s must hold either a build root or an upper directory",
+			filename)
+	}
+	contents.derived = haveUpper
+	return contents, nil
+}
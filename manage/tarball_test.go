@@ -0,0 +1,114 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"path"
+
+	"testing"
+	"potano.layercake/config"
+	"potano.layercake/fs"
+)
+
+
+func TestExportImportLayer(t *testing.T) {
+	td, err := NewTmpdir("layercake_tarball")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.AddLayer("base", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.AddLayer("derived", "base", ""); err != nil {
+		t.Fatal(err)
+	}
+	base := layers.Layer("base")
+	derived := layers.Layer("derived")
+	basefile := path.Join(layers.buildPath(base), "etc/hostname")
+	if err = fs.Mkdir(path.Dir(basefile)); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.WriteTextFile(basefile, "builder\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Link(basefile, basefile + ".bak"); err != nil {
+		t.Fatal(err)
+	}
+	upperfile := path.Join(layers.ovfsUpperPath(derived), "etc/motd")
+	if err = fs.Mkdir(path.Dir(upperfile)); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.WriteTextFile(upperfile, "derived\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	baseTar := td.Path("base.tar")
+	derivedTar := td.Path("derived.tar.gz")
+	if err = layers.ExportLayer("base", baseTar); err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.ExportLayer("derived", derivedTar); err != nil {
+		t.Fatal(err)
+	}
+
+	err = layers.ImportLayer(baseTar, "", "")
+	checkErrorByMessage(t, err, "Layer name 'base' already exists", "import over existing layer")
+	err = layers.ImportLayer(derivedTar, "derived2", "nosuch")
+	checkErrorByMessage(t, err, "Parent layer name 'nosuch' does not exist", "import with bad base")
+	err = layers.ImportLayer(baseTar, "base2", "base")
+	checkErrorByMessage(t, err, baseTar + " holds a base layer; it cannot have parent layer base",
+		"base layer with parent")
+
+	if err = layers.ImportLayer(baseTar, "base2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.ImportLayer(derivedTar, "derived2", "base2"); err != nil {
+		t.Fatal(err)
+	}
+	base2 := layers.Layer("base2")
+	derived2 := layers.Layer("derived2")
+	if base2 == nil || derived2 == nil || derived2.Base != "base2" {
+		t.Fatalf("imported layers not registered as expected")
+	}
+	reread, err := ReadLayerFile(layers.layerconfigFilePath(derived2), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reread.Base != "base2" || len(reread.ConfigMounts) != len(derived.ConfigMounts) {
+		t.Errorf("unexpected layerconfig of imported layer: base %s, %d imports",
+			reread.Base, len(reread.ConfigMounts))
+	}
+	var st1, st2 os.FileInfo
+	hostname := path.Join(layers.buildPath(base2), "etc/hostname")
+	if st1, err = os.Stat(hostname); err != nil {
+		t.Fatal(err)
+	}
+	if st2, err = os.Stat(hostname + ".bak"); err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(st1, st2) {
+		t.Errorf("hard link not preserved")
+	}
+	if !fs.IsFile(path.Join(layers.ovfsUpperPath(derived2), "etc/motd")) {
+		t.Errorf("upper directory of derived layer not imported")
+	}
+	for _, dir := range []string{layers.buildPath(derived2), layers.ovfsWorkPath(derived2)} {
+		if !fs.IsDir(dir) {
+			t.Errorf("directory %s not created", dir)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"fmt"
+	"time"
+	"strings"
+
+	"potano.layercake/fs"
+)
+
+
+const (
+	Update_updated = iota
+	Update_failed
+	Update_skipped
+)
+
+var updateResultDescriptions []string = []string{"updated", "FAILED", "skipped"}
+
+
+type UpdateResult struct {
+	Layer string
+	Result int
+	Elapsed time.Duration
+	Err error
+}
+
+
+func (ur UpdateResult) Description() string {
+	return updateResultDescriptions[ur.Result]
+}
+
+
+/*
+  Updates every layer, parents before children, by running the command in a chroot of each.
+  Mounts each layer's stack as needed and remounts a layer whose base changed since it was
+  mounted before updating it.  When a layer fails to update, its descendants are skipped
+  while other layers proceed.  Returns the outcome for each layer in order.
+*/
+func (ld *Layerdefs) UpdateAll(command []string) []UpdateResult {
+	return ld.updateAll(command, nil, func (cs *chrootSession) error {
+		return cs.run(nil, nil)
+	})
+}
+
+
+// Carries out UpdateAll, running each layer's session by way of the given function.  Stops
+// before the next layer once the done channel is closed.
+func (ld *Layerdefs) updateAll(command []string, done <-chan struct{},
+	run func (*chrootSession) error) []UpdateResult {
+	results := make([]UpdateResult, 0, len(ld.normalizedOrder))
+	succeeded := map[string]bool{}
+	for _, name := range ld.normalizedOrder {
+		select {
+		case <-done:
+			return results
+		default:
+		}
+		layer := ld.layermap[name]
+		result := UpdateResult{Layer: name}
+		if len(layer.Base) > 0 && !succeeded[layer.Base] {
+			result.Result = Update_skipped
+			result.Err = fmt.Errorf("base layer %s was not updated", layer.Base)
+		} else {
+			fs.Printf("Updating layer %s\n", name)
+			start := time.Now()
+			result.Err = ld.updateLayer(layer, command, run)
+			result.Elapsed = time.Since(start).Round(time.Second)
+			if result.Err == nil {
+				succeeded[name] = true
+			} else {
+				result.Result = Update_failed
+				fs.Printf("Update of layer %s failed: %s\n", name, result.Err)
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+
+func (ld *Layerdefs) updateLayer(layer *Layerinfo, command []string,
+	run func (*chrootSession) error) error {
+	err := layer.errorIfError()
+	if err != nil {
+		return err
+	}
+	if err = ld.readyForSession(layer, true); nil != err {
+		return err
+	}
+	if !fs.WriteOK("run %s in layer %s", strings.Join(command, " "), layer.Name) {
+		return nil
+	}
+	cs, err := ld.startSession(layer.Name, command, Session{})
+	if nil != err {
+		return err
+	}
+	return cs.finish(run(cs))
+}
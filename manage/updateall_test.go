@@ -0,0 +1,79 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"os"
+	"io/ioutil"
+	"strings"
+
+	"testing"
+)
+
+
+func TestUpdateAll(t *testing.T) {
+	td, cfg, layers, cleanup := setUpMountableLayers(t, "layercake_updateall",
+		[]struct {name, base string} {
+			{"base", ""}, {"derived", "base"}, {"grandchild", "derived"},
+			{"fails", "base"}, {"failchild", "fails"},
+		})
+	defer cleanup()
+	layers = mountForTest(t, cfg, "grandchild")
+
+	err := td.WriteFile("/chroot", `#!/bin/sh
+echo "$@" >>` + td.Path("/chroot.log") + `
+case "$1" in
+*/fails/build) exit 3;;
+esac
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ChrootExec = td.Path("/chroot")
+	if err = os.Chmod(cfg.ChrootExec, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	results := layers.UpdateAll([]string{"emerge", "-uDN", "@world"})
+	want := []struct {name string; result int} {
+		{"base", Update_updated}, {"derived", Update_updated}, {"fails", Update_failed},
+		{"failchild", Update_skipped}, {"grandchild", Update_updated},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("expected %d results, got %#v", len(want), results)
+	}
+	have := map[string]UpdateResult{}
+	for _, result := range results {
+		have[result.Layer] = result
+	}
+	for _, w := range want {
+		if result := have[w.name]; result.Result != w.result {
+			t.Errorf("layer %s: expected %s, got %s (%v)", w.name,
+				updateResultDescriptions[w.result], result.Description(), result.Err)
+		}
+	}
+	for i, result := range results {
+		if base := layers.Layer(result.Layer).Base; len(base) > 0 {
+			for _, earlier := range results[i:] {
+				if earlier.Layer == base {
+					t.Errorf("layer %s updated before its base %s", result.Layer, base)
+				}
+			}
+		}
+	}
+
+	log, err := ioutil.ReadFile(td.Path("/chroot.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(log)), "\n"); len(lines) != 4 ||
+		!strings.HasSuffix(lines[0], "/base/build emerge -uDN @world") {
+		t.Errorf("unexpected chroot invocations:\n%s", log)
+	}
+	for _, name := range []string{"derived", "grandchild"} {
+		if layers.ViewIsStale(layers.Layer(name)) {
+			t.Errorf("layer %s not remounted after update of its base", name)
+		}
+	}
+}
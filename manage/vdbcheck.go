@@ -0,0 +1,124 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"potano.layercake/fs"
+	"potano.layercake/portage/vdb"
+)
+
+
+// Two or more installed-package database entries in the same slot of a derived layer
+type VdbDuplicate struct {
+	Package, Slot string
+	Versions []string
+	Stale []string
+	staleDirs []string
+}
+
+
+/*
+  Finds slots having more than one entry in the merged installed-package database of a
+  derived layer.  This happens when a parent layer upgrades a package the derived layer had
+  rebuilt:  the derived layer's upperdir keeps the entry for the old version while the entry
+  for the new version shows through from the parent.  An entry is considered stale if it
+  exists only in the upperdir and the parent supplies another entry for the same slot.  Base
+  layers and unmounted derived layers yield no duplicates.
+*/
+func (ld *Layerdefs) FindVdbDuplicates(name string) ([]VdbDuplicate, error) {
+	err := ld.testName(nametest{name, name_need, "Layer"})
+	if nil != err {
+		return nil, err
+	}
+	layer := ld.layermap[name]
+	if err = layer.errorIfError(); err != nil {
+		return nil, err
+	}
+	if len(layer.Base) == 0 || ld.errorIfBuildRootHidden(layer) != nil {
+		return nil, nil
+	}
+	pkgDbPath := path.Join(ld.buildPath(layer), vdb.PackageDatabasePath)
+	if !fs.IsDir(pkgDbPath) {
+		return nil, nil
+	}
+	entries, err := vdb.ListPackageDatabase(pkgDbPath)
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string][]*vdb.AvailableVersion{}
+	keys := []string{}
+	for _, av := range entries {
+		key := av.PackageName() + ":" + av.SlotName
+		if groups[key] == nil {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], av)
+	}
+	sort.Strings(keys)
+
+	upperDbPath := path.Join(ld.ovfsUpperPath(layer), vdb.PackageDatabasePath)
+	lowerDbPath := path.Join(ld.buildPath(ld.layermap[layer.Base]), vdb.PackageDatabasePath)
+	var dups []VdbDuplicate
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+		sort.Slice(group, func (i, j int) bool {
+			return group[i].ComparisonString() < group[j].ComparisonString()
+		})
+		dup := VdbDuplicate{Package: group[0].PackageName(), Slot: group[0].SlotName}
+		var upperOnly []*vdb.AvailableVersion
+		haveLower := false
+		for _, av := range group {
+			dup.Versions = append(dup.Versions, av.String())
+			entryPath := strings.TrimPrefix(av.Directory, pkgDbPath)
+			if fs.Exists(path.Join(lowerDbPath, entryPath)) {
+				haveLower = true
+			} else if fs.IsDir(path.Join(upperDbPath, entryPath)) {
+				upperOnly = append(upperOnly, av)
+			}
+		}
+		if haveLower {
+			for _, av := range upperOnly {
+				dup.Stale = append(dup.Stale, av.String())
+				dup.staleDirs = append(dup.staleDirs, av.Directory)
+			}
+		}
+		dups = append(dups, dup)
+	}
+	return dups, nil
+}
+
+
+// Removes the stale upperdir entries found by FindVdbDuplicates.  Returns the number removed.
+func (ld *Layerdefs) RemoveStaleVdbEntries(name string) (int, error) {
+	dups, err := ld.FindVdbDuplicates(name)
+	if err != nil {
+		return 0, err
+	}
+	var staleDirs []string
+	for _, dup := range dups {
+		staleDirs = append(staleDirs, dup.staleDirs...)
+	}
+	if len(staleDirs) == 0 {
+		return 0, nil
+	}
+	err = ld.layermap[name].errorIfBusy("remove stale package entries", false)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, dir := range staleDirs {
+		if err = fs.Remove(dir); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,119 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package manage
+
+import (
+	"path"
+	"strings"
+
+	"testing"
+	"potano.layercake/config"
+	"potano.layercake/fs"
+)
+
+
+func TestFindVdbDuplicates(t *testing.T) {
+	td, err := NewTmpdir("layercake_vdbcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer td.Cleanup()
+	cfg, err := td.MakeConfigTypeObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitLayercakeBase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := FindLayers(cfg, &config.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.AddLayer("base", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.AddLayer("derived", "base", ""); err != nil {
+		t.Fatal(err)
+	}
+	base := layers.Layer("base")
+	derived := layers.Layer("derived")
+
+	// The overlay is simulated:  the merged view is populated by hand
+	addEntry := func (root, cpv, slot string) {
+		dir := path.Join(root, "var/db/pkg", cpv)
+		if err := fs.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.WriteTextFile(path.Join(dir, "SLOT"), slot + "\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lower := layers.buildPath(base)
+	upper := layers.ovfsUpperPath(derived)
+	merged := layers.buildPath(derived)
+	addEntry(lower, "dev-libs/libfoo-1.1", "0")
+	addEntry(upper, "dev-libs/libfoo-1.0", "0")
+	addEntry(merged, "dev-libs/libfoo-1.0", "0")
+	addEntry(merged, "dev-libs/libfoo-1.1", "0")
+	addEntry(lower, "sys-devel/gcc-11.2.0", "11")
+	addEntry(merged, "sys-devel/gcc-11.2.0", "11")
+	addEntry(merged, "sys-devel/gcc-12.1.0", "12")
+	addEntry(upper, "app-misc/bar-2.0", "0")
+	addEntry(upper, "app-misc/bar-2.1", "0")
+	addEntry(merged, "app-misc/bar-2.0", "0")
+	addEntry(merged, "app-misc/bar-2.1", "0")
+
+	dups, err := layers.FindVdbDuplicates("derived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dups) != 0 {
+		t.Fatalf("expected no duplicates in unmounted layer, got %d", len(dups))
+	}
+
+	m_ninja := newMountNinja()
+	fs.GetAlternateProbeMountsCursor = func () fs.LineReader {
+		return fs.NewTextInputCursor("mountNinja", strings.NewReader(m_ninja.mountinfo()))
+	}
+	defer func () {
+		fs.GetAlternateProbeMountsCursor = nil
+	}()
+	err = m_ninja.mount("overlay", merged, "overlay", 0, "lowerdir=" + lower + ",upperdir=" +
+		upper + ",workdir=" + layers.ovfsWorkPath(derived))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = layers.refreshMountInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	dups, err = layers.FindVdbDuplicates("derived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, dup := range dups {
+		have = append(have, dup.Package + ":" + dup.Slot + " " +
+			strings.Join(dup.Versions, ",") + " stale=" + strings.Join(dup.Stale, ","))
+	}
+	want := []string{
+		"app-misc/bar:0 app-misc/bar-2.0,app-misc/bar-2.1 stale=",
+		"dev-libs/libfoo:0 dev-libs/libfoo-1.0,dev-libs/libfoo-1.1 stale=dev-libs/libfoo-1.0",
+	}
+	if !stringSlicesEqual(want, have) {
+		t.Fatalf("expected duplicates\n  %s\ngot\n  %s", strings.Join(want, "\n  "),
+			strings.Join(have, "\n  "))
+	}
+
+	removed, err := layers.RemoveStaleVdbEntries("derived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || fs.Exists(path.Join(merged, "var/db/pkg/dev-libs/libfoo-1.0")) {
+		t.Errorf("expected stale entry to be removed; %d removed", removed)
+	}
+	if !fs.Exists(path.Join(merged, "var/db/pkg/app-misc/bar-2.0")) {
+		t.Errorf("entry without counterpart in parent should not be removed")
+	}
+}
@@ -3,7 +3,10 @@
 
 package atom
 
-import "strings"
+import (
+	"sort"
+	"strings"
+)
 
 
 type UseFlagSet []useFlagIndexType
@@ -132,6 +135,28 @@ func (f UseFlagSet) GetMap() UseFlagMap {
 }
 
 
+// Lists the flags set differently in two maps, prefixing each with + or - to show its setting
+// in the second map.  Flags missing from either map are not compared.
+func DiffUseFlagMaps(from, to UseFlagMap) []string {
+	names := []string{}
+	for name, state := range to {
+		if fromState, have := from[name]; have && fromState != state {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	out := make([]string, len(names))
+	for i, name := range names {
+		if to[name] {
+			out[i] = "+" + name
+		} else {
+			out[i] = "-" + name
+		}
+	}
+	return out
+}
+
+
 func useFlagIndex(name string) useFlagIndexType {
 	index, have := useFlagNameToIndexMap[name]
 	if !have {
@@ -3,7 +3,10 @@
 
 package atom
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 
 func TestUseAllocation(t *testing.T) {
@@ -158,3 +161,23 @@ func TestGetMap(t *testing.T) {
 	}
 }
 
+
+
+func TestDiffUseFlagMaps(t *testing.T) {
+	for _, tst := range []struct {from, to, expected string} {
+		{"", "", ""},
+		{"doc gcc", "doc gcc", ""},
+		{"doc -gcc", "doc gcc", "+gcc"},
+		{"-doc gcc", "+doc -gcc", "+doc -gcc"},
+		{"doc", "-doc -gcc", "-doc"},
+		{"-zlib doc", "-doc", "-doc"},
+	} {
+		from := NewUseFlagSetFromPrefixes(tst.from, true).GetMap()
+		to := NewUseFlagSetFromPrefixes(tst.to, true).GetMap()
+		got := strings.Join(DiffUseFlagMaps(from, to), " ")
+		if got != tst.expected {
+			t.Errorf("From [%s] to [%s], expected [%s], got [%s]", tst.from, tst.to,
+				tst.expected, got)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package binpkg
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"potano.layercake/fs"
+	"potano.layercake/portage/atom"
+)
+
+
+const PackagesIndexFile = "Packages"
+
+
+type BinaryPackage struct {
+	atom.ConcreteAtom
+	BuildID string
+	Path string
+}
+
+
+type PackageIndex struct {
+	Packages map[string][]*BinaryPackage
+}
+
+
+/*
+  Reads the Packages index which Portage maintains at the top of a PKGDIR.  The file is a
+  series of stanzas of "KEY: value" lines separated by blank lines.  The first stanza is a
+  header and has no CPV key.  With the binpkg-multi-instance feature, a single CPV may appear
+  in several stanzas, each with its own BUILD_ID and USE settings.
+*/
+func ReadPackagesIndex(pkgdir string) (*PackageIndex, error) {
+	filename := path.Join(pkgdir, PackagesIndexFile)
+	cursor, err := fs.NewTextInputFileCursor(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	index := &PackageIndex{Packages: map[string][]*BinaryPackage{}}
+	stanza := map[string]string{}
+	var line string
+	for {
+		more := cursor.ReadLine(&line)
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || !more {
+			if len(stanza) > 0 {
+				if err := index.addStanza(stanza); err != nil {
+					cursor.LogError(err.Error())
+				}
+				stanza = map[string]string{}
+			}
+			if !more {
+				break
+			}
+			continue
+		}
+		pos := strings.Index(line, ":")
+		if pos < 1 {
+			cursor.LogError("malformed line")
+			continue
+		}
+		stanza[line[:pos]] = strings.TrimSpace(line[pos+1:])
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+
+func (index *PackageIndex) addStanza(stanza map[string]string) error {
+	cpv := stanza["CPV"]
+	if len(cpv) == 0 {
+		return nil
+	}
+	ca, err := atom.NewUnprefixedConcreteAtom(cpv)
+	if err != nil {
+		return fmt.Errorf("%s parsing CPV %s", err, cpv)
+	}
+	ca.UseFlags = atom.NewUseFlagSetFromIUSE(stanza["IUSE"])
+	ca.UseFlags.SetFlagsFromUSE(stanza["USE"])
+	slot := stanza["SLOT"]
+	if ind := strings.Index(slot, "/"); ind >= 0 {
+		slot = slot[:ind]
+	}
+	ca.SetSlotAndSubslot(slot, "")
+	bp := &BinaryPackage{ConcreteAtom: *ca, BuildID: stanza["BUILD_ID"], Path: stanza["PATH"]}
+	name := bp.PackageName()
+	index.Packages[name] = append(index.Packages[name], bp)
+	return nil
+}
+
+
+// Returns the binary packages built from the same version as the given atom
+func (index *PackageIndex) GetVersions(atm atom.Atom) []*BinaryPackage {
+	var out []*BinaryPackage
+	for _, bp := range index.Packages[atm.PackageName()] {
+		if bp.ComparisonString() == atm.ComparisonString() {
+			out = append(out, bp)
+		}
+	}
+	return out
+}
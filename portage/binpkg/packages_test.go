@@ -0,0 +1,86 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package binpkg
+
+import (
+	"os"
+	"path"
+	"strings"
+	"io/ioutil"
+
+	"testing"
+	"potano.layercake/portage/atom"
+)
+
+
+const packagesBlob = `ARCH: amd64
+PACKAGES: 3
+VERSION: 0
+
+BUILD_ID: 1
+CPV: app-arch/bzip2-1.0.8-r4
+IUSE: static static-libs verify-sig
+PATH: app-arch/bzip2/bzip2-1.0.8-r4-1.gpkg.tar
+SLOT: 0/1
+USE: abi_x86_64 amd64 static-libs
+
+BUILD_ID: 2
+CPV: app-arch/bzip2-1.0.8-r4
+IUSE: static static-libs verify-sig
+PATH: app-arch/bzip2/bzip2-1.0.8-r4-2.gpkg.tar
+SLOT: 0/1
+USE: abi_x86_64 amd64
+
+CPV: sys-libs/zlib-1.2.13-r1
+IUSE: minizip static-libs
+SLOT: 0/1
+USE: amd64 static-libs
+`
+
+
+func TestReadPackagesIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layercake_binpkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(path.Join(dir, PackagesIndexFile), []byte(packagesBlob), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := ReadPackagesIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Packages) != 2 {
+		t.Fatalf("Expected 2 package names, got %d", len(index.Packages))
+	}
+	bzip2 := index.Packages["app-arch/bzip2"]
+	if len(bzip2) != 2 {
+		t.Fatalf("Expected 2 builds of app-arch/bzip2, got %d", len(bzip2))
+	}
+	if bzip2[0].BuildID != "1" || bzip2[1].BuildID != "2" {
+		t.Errorf("Unexpected build IDs %s and %s", bzip2[0].BuildID, bzip2[1].BuildID)
+	}
+	if !bzip2[0].GetUseFlagMap()["static-libs"] || bzip2[1].GetUseFlagMap()["static-libs"] {
+		t.Errorf("Unexpected static-libs settings in builds of app-arch/bzip2")
+	}
+
+	want, err := atom.NewUnprefixedConcreteAtom("sys-libs/zlib-1.2.13-r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builds := index.GetVersions(want)
+	if len(builds) != 1 || builds[0].String() != "sys-libs/zlib-1.2.13-r1" {
+		t.Errorf("Expected to find sys-libs/zlib-1.2.13-r1")
+	}
+	other, _ := atom.NewUnprefixedConcreteAtom("sys-libs/zlib-1.2.12")
+	if builds = index.GetVersions(other); len(builds) != 0 {
+		t.Errorf("Expected no builds of sys-libs/zlib-1.2.12, got %d", len(builds))
+	}
+	if strings.Join(atom.DiffUseFlagMaps(bzip2[0].GetUseFlagMap(),
+		bzip2[1].GetUseFlagMap()), " ") != "-static-libs" {
+		t.Errorf("Expected builds of app-arch/bzip2 to differ in static-libs")
+	}
+}
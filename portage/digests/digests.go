@@ -0,0 +1,152 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package digests
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	"potano.layercake/fs"
+	"potano.layercake/defaults"
+)
+
+
+// Maps file names to hash types to hexadecimal digests
+type Digests map[string]map[string]string
+
+
+/*
+  Reads a Gentoo release .DIGESTS file.  Each group of digests follows a header line of the
+  form "# SHA512 HASH" and consists of lines holding a hexadecimal digest and a file name.
+  The file may be PGP clear-signed; the signature block is ignored.
+*/
+func ReadDigestsFile(filename string) (Digests, error) {
+	cursor, err := fs.NewTextInputFileCursor(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	out := Digests{}
+	var hashType, line string
+	inSignature := false
+	for cursor.ReadLine(&line) {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if strings.HasPrefix(line, "-----BEGIN PGP SIGNATURE") {
+			inSignature = true
+		} else if strings.HasPrefix(line, "-----END PGP SIGNATURE") {
+			inSignature = false
+		}
+		if inSignature || strings.HasPrefix(line, "-----") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] == "#" {
+			hashType = ""
+			if len(fields) == 3 && fields[2] == "HASH" {
+				hashType = fields[1]
+			}
+			continue
+		}
+		if len(hashType) == 0 || len(fields) != 2 {
+			continue
+		}
+		name := path.Base(fields[1])
+		if out[name] == nil {
+			out[name] = map[string]string{}
+		}
+		out[name][hashType] = strings.ToLower(fields[0])
+	}
+	return out, cursor.Err()
+}
+
+
+/*
+  Checks a file against the digests listed for it in a .DIGESTS file.  Verifies the SHA512
+  digest and, if the b2sum executable is available, the BLAKE2B digest.  Returns the hash
+  types verified.  Fails if any digest does not match or if no digest could be checked.
+*/
+func Verify(filename, digestsFile string) ([]string, error) {
+	digests, err := ReadDigestsFile(digestsFile)
+	if err != nil {
+		return nil, err
+	}
+	want := digests[path.Base(filename)]
+	if len(want) == 0 {
+		return nil, fmt.Errorf("%s lists no digests for %s", digestsFile, path.Base(filename))
+	}
+	var verified []string
+	for _, hashType := range sortedKeys(want) {
+		var have string
+		switch hashType {
+		case "SHA512":
+			have, err = sha512Digest(filename)
+		case "BLAKE2B":
+			if _, lookErr := exec.LookPath(defaults.B2sumExecutable); lookErr != nil {
+				continue
+			}
+			have, err = b2sumDigest(filename)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if have != want[hashType] {
+			return nil, fmt.Errorf("%s digest mismatch for %s", hashType, filename)
+		}
+		verified = append(verified, hashType)
+	}
+	if len(verified) == 0 {
+		return nil, fmt.Errorf("%s has no supported digests for %s", digestsFile,
+			path.Base(filename))
+	}
+	return verified, nil
+}
+
+
+func sha512Digest(filename string) (string, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	hasher := sha512.New()
+	if _, err = io.Copy(hasher, fh); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+
+func b2sumDigest(filename string) (string, error) {
+	out, err := exec.Command(defaults.B2sumExecutable, filename).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s running %s", err, defaults.B2sumExecutable)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("no output from %s", defaults.B2sumExecutable)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,74 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package digests
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"testing"
+)
+
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tarball := path.Join(dir, "stage3-amd64-openrc-20221016T170545Z.tar.xz")
+	contents := "not really a stage tarball\n"
+	if err = ioutil.WriteFile(tarball, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha512.Sum512([]byte(contents))
+	good := hex.EncodeToString(sum[:])
+	bad := strings.Repeat("0", len(good))
+
+	writeDigests := func (sha512Hex string) string {
+		filename := tarball + ".DIGESTS"
+		blob := `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA512
+
+# BLAKE2B HASH
+` + strings.Repeat("1", 128) + `  stage3-amd64-openrc-20221016T170545Z.tar.xz.CONTENTS.gz
+# SHA512 HASH
+` + sha512Hex + `  stage3-amd64-openrc-20221016T170545Z.tar.xz
+# SHA512 HASH
+` + bad + `  stage3-amd64-openrc-20221016T170545Z.tar.xz.CONTENTS.gz
+-----BEGIN PGP SIGNATURE-----
+
+iQIzBAEBCgAdFiEE
+# SHA512 HASH
+` + bad + `  stage3-amd64-openrc-20221016T170545Z.tar.xz
+-----END PGP SIGNATURE-----
+`
+		if err := ioutil.WriteFile(filename, []byte(blob), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	verified, err := Verify(tarball, writeDigests(good))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(verified, " ") != "SHA512" {
+		t.Errorf("expected SHA512 to be verified, got %v", verified)
+	}
+
+	_, err = Verify(tarball, writeDigests(bad))
+	if err == nil || !strings.Contains(err.Error(), "SHA512 digest mismatch") {
+		t.Errorf("expected digest mismatch, got %v", err)
+	}
+
+	_, err = Verify(path.Join(dir, "other.tar.xz"), writeDigests(good))
+	if err == nil || !strings.Contains(err.Error(), "lists no digests for other.tar.xz") {
+		t.Errorf("expected missing-digest error, got %v", err)
+	}
+}
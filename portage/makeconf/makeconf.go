@@ -0,0 +1,278 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package makeconf
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"potano.layercake/fs"
+)
+
+
+type Variables map[string]string
+
+
+/*
+  Reads variable assignments from a Portage make.conf or make.defaults file.  These files use
+  a subset of Bash syntax:  one KEY=value assignment per logical line, optionally preceded by
+  "export".  Values may be unquoted, single-quoted, or double-quoted; double-quoted values may
+  span lines.  References of the form $KEY or ${KEY} in unquoted and double-quoted values
+  expand to previous assignments in the same file or, failing that, to values in 'env'.
+  Returns only the variables assigned in this file.
+*/
+func ReadFile(filename string, env Variables) (Variables, error) {
+	blob, err := fs.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(filename, blob, env)
+}
+
+
+/*
+  Reads a make.conf which may be either a file or a directory.  Portage reads the files of
+  a directory in lexical order, skipping hidden files and backups.  Later files see the
+  assignments of earlier ones.
+*/
+func ReadPath(pathname string, env Variables) (Variables, error) {
+	if !fs.IsDir(pathname) {
+		return ReadFile(pathname, env)
+	}
+	names, err := fs.Readdirnames(pathname)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	out := Variables{}
+	scope := env.Copy()
+	for _, name := range names {
+		filename := path.Join(pathname, name)
+		if name[0] == '.' || strings.HasSuffix(name, "~") || !fs.IsFile(filename) {
+			continue
+		}
+		vars, err := ReadFile(filename, scope)
+		if err != nil {
+			return nil, err
+		}
+		out.Merge(vars)
+		scope.Merge(vars)
+	}
+	return out, nil
+}
+
+
+func (v Variables) Copy() Variables {
+	out := make(Variables, len(v))
+	for key, val := range v {
+		out[key] = val
+	}
+	return out
+}
+
+
+func (v Variables) Merge(other Variables) {
+	for key, val := range other {
+		v[key] = val
+	}
+}
+
+
+func Parse(filename, blob string, env Variables) (Variables, error) {
+	p := &parser{filename: filename, buf: blob, lineno: 1, env: env, vars: Variables{}}
+	for p.pos < len(p.buf) {
+		if err := p.parseStatement(); err != nil {
+			return nil, err
+		}
+	}
+	return p.vars, nil
+}
+
+
+type parser struct {
+	filename, buf string
+	pos, lineno int
+	env, vars Variables
+}
+
+
+func (p *parser) errorf(format string, parms...interface{}) error {
+	return fmt.Errorf(format + " in %s line %d", append(parms, p.filename, p.lineno)...)
+}
+
+
+func (p *parser) lookup(key string) string {
+	if val, have := p.vars[key]; have {
+		return val
+	}
+	return p.env[key]
+}
+
+
+func (p *parser) skipBlanks() {
+	for p.pos < len(p.buf) {
+		c := p.buf[p.pos]
+		if c == '\\' && p.pos + 1 < len(p.buf) && p.buf[p.pos + 1] == '\n' {
+			p.pos += 2
+			p.lineno++
+		} else if c == ' ' || c == '\t' {
+			p.pos++
+		} else {
+			break
+		}
+	}
+}
+
+
+func (p *parser) skipRestOfLine() {
+	for p.pos < len(p.buf) && p.buf[p.pos] != '\n' {
+		p.pos++
+	}
+	if p.pos < len(p.buf) {
+		p.pos++
+		p.lineno++
+	}
+}
+
+
+func (p *parser) parseStatement() error {
+	p.skipBlanks()
+	if p.pos >= len(p.buf) {
+		return nil
+	}
+	c := p.buf[p.pos]
+	if c == '\n' || c == '#' {
+		p.skipRestOfLine()
+		return nil
+	}
+	key := p.parseName()
+	if key == "export" {
+		p.skipBlanks()
+		key = p.parseName()
+	}
+	if len(key) == 0 || p.pos >= len(p.buf) || p.buf[p.pos] != '=' {
+		if key == "source" {
+			p.skipRestOfLine()
+			return nil
+		}
+		return p.errorf("expected variable assignment")
+	}
+	p.pos++
+	val, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+	p.vars[key] = val
+	p.skipBlanks()
+	if p.pos < len(p.buf) && p.buf[p.pos] != '\n' && p.buf[p.pos] != '#' {
+		return p.errorf("unexpected text after value of %s", key)
+	}
+	p.skipRestOfLine()
+	return nil
+}
+
+
+func (p *parser) parseName() string {
+	start := p.pos
+	for p.pos < len(p.buf) && isNameChar(p.buf[p.pos], p.pos == start) {
+		p.pos++
+	}
+	return p.buf[start:p.pos]
+}
+
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') ||
+		(!first && c >= '0' && c <= '9')
+}
+
+
+func (p *parser) parseValue() (string, error) {
+	var out strings.Builder
+	for p.pos < len(p.buf) {
+		c := p.buf[p.pos]
+		switch c {
+		case ' ', '\t', '\n', '#':
+			return out.String(), nil
+		case '\'':
+			end := strings.IndexByte(p.buf[p.pos+1:], '\'')
+			if end < 0 {
+				return "", p.errorf("unterminated single quote")
+			}
+			str := p.buf[p.pos+1:p.pos+1+end]
+			p.lineno += strings.Count(str, "\n")
+			out.WriteString(str)
+			p.pos += end + 2
+		case '"':
+			p.pos++
+			for {
+				if p.pos >= len(p.buf) {
+					return "", p.errorf("unterminated double quote")
+				}
+				c = p.buf[p.pos]
+				if c == '"' {
+					p.pos++
+					break
+				}
+				if err := p.parseCharacter(&out, true); err != nil {
+					return "", err
+				}
+			}
+		default:
+			if err := p.parseCharacter(&out, false); err != nil {
+				return "", err
+			}
+		}
+	}
+	return out.String(), nil
+}
+
+
+func (p *parser) parseCharacter(out *strings.Builder, quoted bool) error {
+	c := p.buf[p.pos]
+	switch c {
+	case '\\':
+		p.pos++
+		if p.pos < len(p.buf) {
+			c = p.buf[p.pos]
+			p.pos++
+			if c == '\n' {
+				p.lineno++
+			} else if quoted && c != '"' && c != '\\' && c != '$' {
+				out.WriteByte('\\')
+				out.WriteByte(c)
+			} else {
+				out.WriteByte(c)
+			}
+		}
+	case '$':
+		p.pos++
+		var key string
+		if p.pos < len(p.buf) && p.buf[p.pos] == '{' {
+			end := strings.IndexByte(p.buf[p.pos:], '}')
+			if end < 0 {
+				return p.errorf("unterminated variable reference")
+			}
+			key = p.buf[p.pos+1:p.pos+end]
+			p.pos += end + 1
+		} else {
+			key = p.parseName()
+			if len(key) == 0 {
+				out.WriteByte('$')
+				return nil
+			}
+		}
+		out.WriteString(p.lookup(key))
+	case '\n':
+		p.lineno++
+		p.pos++
+		out.WriteByte(c)
+	default:
+		p.pos++
+		out.WriteByte(c)
+	}
+	return nil
+}
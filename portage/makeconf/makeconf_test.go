@@ -0,0 +1,64 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package makeconf
+
+import "testing"
+
+
+func checkVariables(t *testing.T, desc string, expected, have Variables) {
+	for key, val := range expected {
+		if got, ok := have[key]; !ok {
+			t.Errorf("%s: expected variable %s", desc, key)
+		} else if got != val {
+			t.Errorf("%s: expected %s=[%s], got [%s]", desc, key, val, got)
+		}
+	}
+	for key := range have {
+		if _, ok := expected[key]; !ok {
+			t.Errorf("%s: unexpected variable %s", desc, key)
+		}
+	}
+}
+
+
+func TestParse(t *testing.T) {
+	env := Variables{"USE": "profile", "ARCH": "amd64"}
+	for _, tst := range []struct {desc, blob string; expected Variables} {
+		{"empty", "", Variables{}},
+		{"comments", "# comment\n\n   # another\n", Variables{}},
+		{"unquoted", "CHOST=x86_64-pc-linux-gnu\n",
+			Variables{"CHOST": "x86_64-pc-linux-gnu"}},
+		{"export", "export LC_MESSAGES=C", Variables{"LC_MESSAGES": "C"}},
+		{"double quotes", `COMMON_FLAGS="-O2 -pipe -march=native"`,
+			Variables{"COMMON_FLAGS": "-O2 -pipe -march=native"}},
+		{"single quotes", `X='${ARCH} $ARCH'`, Variables{"X": "${ARCH} $ARCH"}},
+		{"expansion", "COMMON_FLAGS=\"-O2\"\nCFLAGS=\"${COMMON_FLAGS} -g\"\nK=$ARCH",
+			Variables{"COMMON_FLAGS": "-O2", "CFLAGS": "-O2 -g", "K": "amd64"}},
+		{"incremental", `USE="${USE} -X"`, Variables{"USE": "profile -X"}},
+		{"multi-line", "FEATURES=\"buildpkg\n   binpkg-multi-instance\"  # trailing",
+			Variables{"FEATURES": "buildpkg\n   binpkg-multi-instance"}},
+		{"continuation", "A=one\\\ntwo", Variables{"A": "onetwo"}},
+		{"escapes", `A="a \"b\" \$c"`, Variables{"A": `a "b" $c`}},
+		{"undefined", `A="x${NOPE}y"`, Variables{"A": "xy"}},
+	} {
+		vars, err := Parse(tst.desc, tst.blob, env)
+		if err != nil {
+			t.Errorf("%s: %s", tst.desc, err)
+			continue
+		}
+		checkVariables(t, tst.desc, tst.expected, vars)
+	}
+	for _, tst := range []struct {desc, blob, msg string} {
+		{"unterminated", `A="abc`, "unterminated double quote in bad line 1"},
+		{"no assignment", "A=1\nfoo bar", "expected variable assignment in bad line 2"},
+		{"extra text", `A="1" 2`, "unexpected text after value of A in bad line 1"},
+	} {
+		_, err := Parse("bad", tst.blob, env)
+		if err == nil {
+			t.Errorf("%s: expected error", tst.desc)
+		} else if err.Error() != tst.msg {
+			t.Errorf("%s: got error %s", tst.desc, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package profile
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"potano.layercake/fs"
+)
+
+
+// Maps the name of a repository to the directory holding it
+type RepoLocator func (repo string) (string, error)
+
+
+/*
+  Reads the repository locations set in repos.conf files, each of which may be a file or a
+  directory of files.  Settings in later files override those in earlier ones.  Missing files
+  are skipped.
+*/
+func ReadRepoLocations(pathnames ...string) (map[string]string, error) {
+	locations := map[string]string{}
+	for _, pathname := range pathnames {
+		if err := readRepoLocations(locations, pathname); err != nil {
+			return nil, err
+		}
+	}
+	return locations, nil
+}
+
+
+func readRepoLocations(locations map[string]string, pathname string) error {
+	if !fs.Exists(pathname) {
+		return nil
+	}
+	if fs.IsDir(pathname) {
+		names, err := fs.Readdirnames(pathname)
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			filename := path.Join(pathname, name)
+			if name[0] == '.' || strings.HasSuffix(name, "~") || !fs.IsFile(filename) {
+				continue
+			}
+			if err = readRepoLocations(locations, filename); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	cursor, err := fs.NewTextInputFileCursor(pathname)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var line, section string
+	for cursor.ReadNonBlankNonCommentLine(&line) {
+		line = strings.TrimSpace(line)
+		if line[0] == '[' && line[len(line) - 1] == ']' {
+			section = strings.TrimSpace(line[1:len(line) - 1])
+			continue
+		}
+		pos := strings.Index(line, "=")
+		if pos < 0 {
+			return fmt.Errorf("%s: expected key = value in line '%s'", pathname, line)
+		}
+		key := strings.TrimSpace(line[:pos])
+		if key == "location" && len(section) > 0 && section != "DEFAULT" {
+			locations[section] = strings.TrimSpace(line[pos+1:])
+		}
+	}
+	return cursor.Err()
+}
@@ -0,0 +1,123 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package profile
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"potano.layercake/fs"
+	"potano.layercake/portage/makeconf"
+	"potano.layercake/portage/useconfig"
+)
+
+
+/*
+  Lists the directories making up a profile, most distant parents first.  A parent entry of the
+  form repo:path names a directory under the profiles directory of a repository, which 'locate'
+  finds; such entries are an error when 'locate' is nil.
+*/
+func ProfileDirectories(profilePath string, locate RepoLocator) ([]string, error) {
+	var dirs []string
+	visited := map[string]bool{}
+	var visit func (dirPath string) error
+	visit = func (dirPath string) error {
+		if !fs.IsDir(dirPath) {
+			return fmt.Errorf("profile directory %s does not exist", dirPath)
+		}
+		if visited[dirPath] {
+			return nil
+		}
+		visited[dirPath] = true
+		parentFile := path.Join(dirPath, "parent")
+		if fs.IsFile(parentFile) {
+			cursor, err := fs.NewTextInputFileCursor(parentFile)
+			if err != nil {
+				return err
+			}
+			defer cursor.Close()
+			var line string
+			for cursor.ReadNonBlankNonCommentLine(&line) {
+				parent, err := parentPath(dirPath, strings.TrimSpace(line), locate)
+				if err != nil {
+					return err
+				}
+				if err := visit(parent); err != nil {
+					return err
+				}
+			}
+			if err := cursor.Err(); err != nil {
+				return err
+			}
+		}
+		dirs = append(dirs, dirPath)
+		return nil
+	}
+	if err := visit(profilePath); err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+
+func parentPath(dirPath, parent string, locate RepoLocator) (string, error) {
+	if path.IsAbs(parent) {
+		return parent, nil
+	}
+	pos := strings.Index(parent, ":")
+	if pos < 0 {
+		return path.Join(dirPath, parent), nil
+	}
+	repo := parent[:pos]
+	if locate == nil {
+		return "", fmt.Errorf("profile %s: cannot locate repository %s of parent %s", dirPath,
+			repo, parent)
+	}
+	location, err := locate(repo)
+	if err != nil {
+		return "", fmt.Errorf("profile %s: parent %s: %s", dirPath, parent, err)
+	}
+	return path.Join(location, "profiles", parent[pos+1:]), nil
+}
+
+
+/*
+  Reads the make.defaults files of a profile, returning the variables they set.  When 'uc' is
+  not nil, also adds the profile's USE settings and package.use entries to it.  'locate' finds
+  the repositories named by repo:path parent entries.
+*/
+func ReadProfileSettings(profilePath string, locate RepoLocator, uc *useconfig.UseConfig) (
+	makeconf.Variables, error) {
+	dirs, err := ProfileDirectories(profilePath, locate)
+	if err != nil {
+		return nil, err
+	}
+	env := makeconf.Variables{}
+	for _, dir := range dirs {
+		filename := path.Join(dir, "make.defaults")
+		if !fs.IsFile(filename) {
+			continue
+		}
+		vars, err := makeconf.ReadFile(filename, env)
+		if err != nil {
+			return nil, err
+		}
+		if uc != nil {
+			uc.AddVariables(vars, false)
+		}
+		env.Merge(vars)
+	}
+	if uc != nil {
+		for _, dir := range dirs {
+			filename := path.Join(dir, "package.use")
+			if fs.Exists(filename) {
+				if err = uc.AddPackageUse(filename); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return env, nil
+}
@@ -0,0 +1,164 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package profile
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"io/ioutil"
+
+	"testing"
+)
+
+
+func writeProfileFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		filename := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+
+func setUpProfiles(t *testing.T) (string, RepoLocator) {
+	dir, err := ioutil.TempDir("", "layercake_profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeProfileFiles(t, dir, map[string]string{
+		"gentoo/profiles/base/make.defaults": "USE=\"base\"\nARCH=\"amd64\"\n",
+		"gentoo/profiles/arch/parent": "../base\n",
+		"gentoo/profiles/arch/make.defaults": "USE=\"${USE} arch\"\nCHOST=\"x86_64\"\n",
+		"gentoo/profiles/default/parent": "# comment\n\n../arch\n",
+		"gentoo/profiles/diamond/parent": "../arch\n../base\n",
+		"gentoo/profiles/absolute/parent": path.Join(dir, "gentoo/profiles/base") + "\n",
+		"gentoo/profiles/missing/parent": "../nonesuch\n",
+		"overlay/profiles/custom/parent": "gentoo:default\n",
+		"overlay/profiles/custom/make.defaults": "USE=\"${USE} -base\"\n",
+		"overlay/profiles/unknown/parent": "other:default\n",
+	})
+	locate := func (repo string) (string, error) {
+		if repo == "gentoo" {
+			return path.Join(dir, "gentoo"), nil
+		}
+		return "", fmt.Errorf("repository %s is not known", repo)
+	}
+	return dir, locate
+}
+
+
+func TestProfileDirectories(t *testing.T) {
+	dir, locate := setUpProfiles(t)
+	defer os.RemoveAll(dir)
+	gentoo := path.Join(dir, "gentoo/profiles")
+	overlay := path.Join(dir, "overlay/profiles")
+
+	for _, tst := range []struct {
+		desc, profile string
+		locate RepoLocator
+		expected []string
+		errMsg string
+	} {
+		{"no parent", "gentoo/profiles/base", locate, []string{"base"}, ""},
+		{"relative parents", "gentoo/profiles/default", locate,
+			[]string{"base", "arch", "default"}, ""},
+		{"parent visited once", "gentoo/profiles/diamond", locate,
+			[]string{"base", "arch", "diamond"}, ""},
+		{"absolute parent", "gentoo/profiles/absolute", locate, []string{"base", "absolute"}, ""},
+		{"repo:path parent", "overlay/profiles/custom", locate,
+			[]string{"base", "arch", "default", "custom"}, ""},
+		{"repo:path without locator", "overlay/profiles/custom", nil, nil,
+			"profile " + overlay + "/custom: cannot locate repository gentoo of parent " +
+			"gentoo:default"},
+		{"unknown repository", "overlay/profiles/unknown", locate, nil,
+			"profile " + overlay + "/unknown: parent other:default: repository other is not known"},
+		{"missing parent", "gentoo/profiles/missing", locate, nil,
+			"profile directory " + gentoo + "/nonesuch does not exist"},
+	} {
+		dirs, err := ProfileDirectories(path.Join(dir, tst.profile), tst.locate)
+		if len(tst.errMsg) > 0 {
+			if err == nil {
+				t.Errorf("%s: expected error %s", tst.desc, tst.errMsg)
+			} else if err.Error() != tst.errMsg {
+				t.Errorf("%s: expected error\n  %s\ngot\n  %s", tst.desc, tst.errMsg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tst.desc, err)
+			continue
+		}
+		var have []string
+		for _, d := range dirs {
+			have = append(have, path.Base(d))
+		}
+		if strings.Join(have, " ") != strings.Join(tst.expected, " ") {
+			t.Errorf("%s: expected %v, got %v", tst.desc, tst.expected, have)
+		}
+	}
+}
+
+
+func TestReadProfileSettings(t *testing.T) {
+	dir, locate := setUpProfiles(t)
+	defer os.RemoveAll(dir)
+	env, err := ReadProfileSettings(path.Join(dir, "overlay/profiles/custom"), locate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, val := range map[string]string{
+		"USE": "base arch -base",
+		"ARCH": "amd64",
+		"CHOST": "x86_64",
+	} {
+		if env[key] != val {
+			t.Errorf("expected %s=[%s], got [%s]", key, val, env[key])
+		}
+	}
+}
+
+
+func TestReadRepoLocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layercake_repos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeProfileFiles(t, dir, map[string]string{
+		"default.conf": "[DEFAULT]\nmain-repo = gentoo\n\n[gentoo]\nlocation = /usr/portage\n" +
+			"sync-type = rsync\n",
+		"repos.conf/gentoo.conf": "# moved\n[gentoo]\nlocation = /var/db/repos/gentoo\n",
+		"repos.conf/local.conf": "[local]\n  location=/var/db/repos/local\n",
+		"repos.conf/local.conf~": "[local]\nlocation = /backup\n",
+		"bad.conf": "[gentoo]\nlocation\n",
+	})
+	locations, err := ReadRepoLocations(path.Join(dir, "default.conf"),
+		path.Join(dir, "repos.conf"), path.Join(dir, "nonesuch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"gentoo": "/var/db/repos/gentoo",
+		"local": "/var/db/repos/local",
+	}
+	if len(locations) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, locations)
+	}
+	for repo, location := range expected {
+		if locations[repo] != location {
+			t.Errorf("expected %s at %s, got %s", repo, location, locations[repo])
+		}
+	}
+
+	_, err = ReadRepoLocations(path.Join(dir, "bad.conf"))
+	if err == nil || !strings.Contains(err.Error(), "expected key = value") {
+		t.Errorf("expected error for malformed line, got %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package useconfig
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"potano.layercake/fs"
+	"potano.layercake/portage/atom"
+	"potano.layercake/portage/depend"
+	"potano.layercake/portage/makeconf"
+)
+
+
+/*
+  Accumulates the USE settings of a Portage configuration.  Callers add settings in order of
+  increasing precedence:  profile make.defaults files from the most distant parent onward,
+  the profiles' package.use files, make.conf, and finally /etc/portage/package.use.  Computes
+  the USE flags a package would receive if built under that configuration.
+*/
+type UseConfig struct {
+	settings []useSetting
+	useExpand []string
+	useExpandUnprefixed []string
+}
+
+
+// Either a group of global USE tokens or, if 'pkg' is set, a package.use entry
+type useSetting struct {
+	tokens []string
+	pkg *packageMatcher
+}
+
+
+type packageMatcher struct {
+	category string
+	atm *depend.DependAtom
+}
+
+
+func New() *UseConfig {
+	return &UseConfig{}
+}
+
+
+/*
+  Adds the USE and USE_EXPAND settings of a make.defaults or make.conf file.  USE_EXPAND
+  variables such as PYTHON_TARGETS accumulate across profile levels but a setting in
+  make.conf replaces the profile's setting; set 'replaceExpanded' for make.conf.  Variables
+  listed in USE_EXPAND_UNPREFIXED, such as ARCH, give flags named by their values alone.
+*/
+func (uc *UseConfig) AddVariables(vars makeconf.Variables, replaceExpanded bool) {
+	if val, have := vars["USE_EXPAND"]; have {
+		uc.useExpand = applyToList(uc.useExpand, strings.Fields(val))
+	}
+	if val, have := vars["USE_EXPAND_UNPREFIXED"]; have {
+		uc.useExpandUnprefixed = applyToList(uc.useExpandUnprefixed, strings.Fields(val))
+	}
+	if val, have := vars["USE"]; have {
+		uc.settings = append(uc.settings, useSetting{tokens: strings.Fields(val)})
+	}
+	for _, name := range uc.useExpandUnprefixed {
+		if val, have := vars[name]; have {
+			uc.settings = append(uc.settings, useSetting{tokens: strings.Fields(val)})
+		}
+	}
+	for _, name := range uc.useExpand {
+		val, have := vars[name]
+		if !have {
+			continue
+		}
+		prefix := strings.ToLower(name) + "_"
+		var group []string
+		if replaceExpanded {
+			group = append(group, "-" + prefix + "*")
+		}
+		for _, tok := range strings.Fields(val) {
+			group = append(group, prefixToken(prefix, tok))
+		}
+		uc.settings = append(uc.settings, useSetting{tokens: group})
+	}
+}
+
+
+// Reads a package.use file or directory of such files.  Entries take precedence over all
+// settings added before.
+func (uc *UseConfig) AddPackageUse(pathname string) error {
+	if fs.IsDir(pathname) {
+		names, err := fs.Readdirnames(pathname)
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if name[0] == '.' || strings.HasSuffix(name, "~") {
+				continue
+			}
+			if err = uc.AddPackageUse(path.Join(pathname, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	cursor, err := fs.NewTextInputFileCursor(pathname)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var line string
+	for cursor.ReadNonBlankNonCommentLine(&line) {
+		if pos := strings.Index(line, "#"); pos >= 0 {
+			line = line[:pos]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		pkg := &packageMatcher{}
+		spec := fields[0]
+		if strings.HasSuffix(spec, "/*") {
+			pkg.category = spec[:len(spec)-2]
+		} else {
+			pkg.atm, err = depend.NewDependencyAtom(spec)
+			if err != nil {
+				cursor.LogError(err.Error())
+				continue
+			}
+		}
+		uc.settings = append(uc.settings, useSetting{tokens: fields[1:], pkg: pkg})
+	}
+	return cursor.Err()
+}
+
+
+/*
+  Computes the USE settings the configuration gives a package having the given IUSE.  Only
+  flags in IUSE appear in the result.  Defaults marked with + in IUSE have the lowest
+  precedence.
+*/
+func (uc *UseConfig) EffectiveUse(atm atom.Atom, iuse string) atom.UseFlagMap {
+	flags := atom.UseFlagMap{}
+	for _, name := range strings.Fields(iuse) {
+		switch name[0] {
+		case '+':
+			flags[name[1:]] = true
+		case '-':
+			flags[name[1:]] = false
+		default:
+			flags[name] = false
+		}
+	}
+	for _, setting := range uc.settings {
+		if setting.pkg == nil {
+			applyTokens(flags, setting.tokens)
+			continue
+		}
+		if !setting.pkg.matches(atm) {
+			continue
+		}
+		var prefix string
+		for _, tok := range setting.tokens {
+			if strings.HasSuffix(tok, ":") {
+				prefix = strings.ToLower(tok[:len(tok)-1]) + "_"
+				continue
+			}
+			applyTokens(flags, []string{prefixToken(prefix, tok)})
+		}
+	}
+	return flags
+}
+
+
+func (pm *packageMatcher) matches(atm atom.Atom) bool {
+	if pm.atm == nil {
+		category := strings.Split(atm.PackageName(), "/")[0]
+		return pm.category == "*" || pm.category == category
+	}
+	return pm.atm.PackageName() == atm.PackageName() && pm.atm.VersionAndSlotMatch(atm)
+}
+
+
+func prefixToken(prefix, tok string) string {
+	if len(prefix) == 0 {
+		return tok
+	}
+	if tok[0] == '-' {
+		return "-" + prefix + tok[1:]
+	}
+	return prefix + strings.TrimPrefix(tok, "+")
+}
+
+
+func applyTokens(flags atom.UseFlagMap, tokens []string) {
+	for _, tok := range tokens {
+		if tok[0] == '-' {
+			name := tok[1:]
+			if strings.HasSuffix(name, "*") {
+				prefix := name[:len(name)-1]
+				for flag := range flags {
+					if strings.HasPrefix(flag, prefix) {
+						flags[flag] = false
+					}
+				}
+			} else if _, have := flags[name]; have {
+				flags[name] = false
+			}
+		} else {
+			name := strings.TrimPrefix(tok, "+")
+			if _, have := flags[name]; have {
+				flags[name] = true
+			}
+		}
+	}
+}
+
+
+// Applies incremental tokens to a list of names, as for USE_EXPAND
+func applyToList(list []string, tokens []string) []string {
+	for _, tok := range tokens {
+		if tok == "-*" {
+			list = nil
+			continue
+		}
+		name := strings.TrimPrefix(tok, "-")
+		out := list[:0]
+		for _, item := range list {
+			if item != name {
+				out = append(out, item)
+			}
+		}
+		list = out
+		if tok[0] != '-' {
+			list = append(list, name)
+		}
+	}
+	return list
+}
@@ -0,0 +1,80 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package useconfig
+
+import (
+	"os"
+	"path"
+	"strings"
+	"io/ioutil"
+
+	"testing"
+	"potano.layercake/portage/atom"
+	"potano.layercake/portage/makeconf"
+)
+
+
+func TestEffectiveUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layercake_useconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	packageUse := path.Join(dir, "package.use")
+	err = ioutil.WriteFile(packageUse, []byte(`# comment
+dev-lang/python sqlite -tk
+>=sys-libs/zlib-1.3 minizip
+media-libs/* -X
+dev-python/pip PYTHON_TARGETS: -* python3_12
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uc := New()
+	uc.AddVariables(makeconf.Variables{
+		"USE": "X tk ssl",
+		"USE_EXPAND": "PYTHON_TARGETS VIDEO_CARDS",
+		"PYTHON_TARGETS": "python3_10 python3_11",
+	}, false)
+	uc.AddVariables(makeconf.Variables{"USE": "-ssl"}, false)
+	uc.AddVariables(makeconf.Variables{"PYTHON_TARGETS": "python3_11"}, true)
+	if err = uc.AddPackageUse(packageUse); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tst := range []struct {pkg, iuse, expected string} {
+		{"dev-lang/python-3.11.4", "+ssl sqlite tk X", "+X +sqlite -ssl -tk"},
+		{"sys-libs/zlib-1.2.13", "minizip static-libs", "-minizip -static-libs"},
+		{"sys-libs/zlib-1.3", "minizip static-libs", "+minizip -static-libs"},
+		{"media-libs/libpng-1.6", "X +apng", "-X +apng"},
+		{"dev-python/pip-23.1", "python_targets_python3_10 python_targets_python3_11 " +
+			"python_targets_python3_12", "-python_targets_python3_10 " +
+			"-python_targets_python3_11 +python_targets_python3_12"},
+		{"dev-python/six-1.16", "python_targets_python3_10 python_targets_python3_11",
+			"-python_targets_python3_10 +python_targets_python3_11"},
+	} {
+		atm, err := atom.NewUnprefixedConcreteAtom(tst.pkg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have := uc.EffectiveUse(atm, tst.iuse)
+		var got []string
+		for _, name := range strings.Fields(tst.expected) {
+			want := name[0] == '+'
+			name = name[1:]
+			if state, ok := have[name]; !ok {
+				got = append(got, "missing " + name)
+			} else if state != want {
+				got = append(got, name)
+			}
+		}
+		if len(have) != len(strings.Fields(tst.expected)) {
+			got = append(got, "wrong flag count")
+		}
+		if len(got) > 0 {
+			t.Errorf("%s [%s]: problems with %s", tst.pkg, tst.iuse, strings.Join(got, ", "))
+		}
+	}
+}
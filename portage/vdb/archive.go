@@ -0,0 +1,99 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package vdb
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"path"
+	"strings"
+	"io/ioutil"
+	"archive/tar"
+
+	"potano.layercake/fs"
+	"potano.layercake/portage/atom"
+)
+
+
+// Files of each VDB entry needed to build the installed-package list
+var archivedMetadataFiles = map[string]bool{
+	"IUSE": true,
+	"IUSE_EFFECTIVE": true,
+	"USE": true,
+	"SLOT": true,
+}
+
+
+/*
+  Reads the installed-package list of a system other than a layer.  The source may be a
+  directory holding a copy of the system's /var/db/pkg, a directory standing for the root of
+  such a system, or a tarball (compressed or not) of either.  Tarballs are unpacked into a
+  temporary directory only as far as needed to read each package's USE flags and slot.
+*/
+func GetArchivedPackageList(source string) (*atom.AtomSet, error) {
+	if fs.IsDir(source) {
+		if fs.IsDir(path.Join(source, PackageDatabasePath)) {
+			return GetInstalledPackageList(source)
+		}
+		return ReadPackageDatabase(source)
+	}
+	if !fs.IsFile(source) {
+		return nil, fmt.Errorf("installed-package archive %s not found", source)
+	}
+	tmpdir, err := ioutil.TempDir("", "layercake_vdb")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+	err = extractArchivedMetadata(source, tmpdir)
+	if err != nil {
+		return nil, err
+	}
+	return ReadPackageDatabase(tmpdir)
+}
+
+
+func extractArchivedMetadata(source, tmpdir string) error {
+	reader, err := fs.OpenDecompressed(source)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	vdbPrefix := strings.TrimPrefix(PackageDatabasePath, "/") + "/"
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s reading %s", err, source)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean("/" + hdr.Name), "/")
+		if pos := strings.Index(name, vdbPrefix); pos >= 0 {
+			name = name[pos + len(vdbPrefix):]
+		}
+		parts := strings.Split(name, "/")
+		if len(parts) != 3 || !archivedMetadataFiles[parts[2]] {
+			continue
+		}
+		dir := path.Join(tmpdir, parts[0], parts[1])
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		blob, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("%s reading %s from %s", err, hdr.Name, source)
+		}
+		err = ioutil.WriteFile(path.Join(dir, parts[2]), blob, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
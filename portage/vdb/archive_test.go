@@ -0,0 +1,135 @@
+// Copyright © 2022 Michael Thompson
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package vdb
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"io/ioutil"
+	"archive/tar"
+	"compress/gzip"
+
+	"testing"
+)
+
+
+// Files of a small package database, relative to its directory
+var archiveTestFiles = map[string]string{
+	"app-arch/bzip2-1.0.8/SLOT": "0/1\n",
+	"app-arch/bzip2-1.0.8/IUSE": "static +static-libs\n",
+	"app-arch/bzip2-1.0.8/USE": "amd64 static-libs\n",
+	"app-arch/bzip2-1.0.8/CONTENTS": "obj /bin/bzip2 0123456789abcdef 1666000000\n",
+	"sys-libs/zlib-1.3/SLOT": "0\n",
+	"sys-libs/zlib-1.3/IUSE": "minizip\n",
+	"sys-libs/zlib-1.3/IUSE_EFFECTIVE": "minizip static-libs\n",
+	"sys-libs/zlib-1.3/USE": "static-libs\n",
+}
+
+var archiveTestPackages = []string{
+	"app-arch/bzip2-1.0.8:0 -static +static-libs",
+	"sys-libs/zlib-1.3:0 -minizip +static-libs",
+}
+
+
+func writeArchiveTestDirectory(t *testing.T, dir string) {
+	for name, contents := range archiveTestFiles {
+		filename := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+
+// Writes a tarball of the package database with each name under the given prefix
+func writeArchiveTestTarball(t *testing.T, filename, prefix string, compress bool) {
+	fh, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	var out io.Writer = fh
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(fh)
+		out = gz
+	}
+	tw := tar.NewWriter(out)
+	for name, contents := range archiveTestFiles {
+		err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: prefix + name,
+			Mode: 0644, Size: int64(len(contents))})
+		if err == nil {
+			_, err = tw.Write([]byte(contents))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tw.Close(); err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+
+func TestGetArchivedPackageList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layercake_vdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeArchiveTestDirectory(t, path.Join(dir, "pkgdb"))
+	writeArchiveTestDirectory(t, path.Join(dir, "root", PackageDatabasePath))
+	writeArchiveTestTarball(t, path.Join(dir, "pkgdb.tar"), "", false)
+	writeArchiveTestTarball(t, path.Join(dir, "root.tar"), "./var/db/pkg/", false)
+	writeArchiveTestTarball(t, path.Join(dir, "root.tar.gz"), "var/db/pkg/", true)
+
+	for _, tst := range []struct {desc, source, errMsg string} {
+		{"package database directory", "pkgdb", ""},
+		{"root directory", "root", ""},
+		{"package database tarball", "pkgdb.tar", ""},
+		{"root tarball", "root.tar", ""},
+		{"compressed root tarball", "root.tar.gz", ""},
+		{"missing archive", "nonesuch.tar",
+			"installed-package archive " + dir + "/nonesuch.tar not found"},
+	} {
+		set, err := GetArchivedPackageList(path.Join(dir, tst.source))
+		if len(tst.errMsg) > 0 {
+			if err == nil || err.Error() != tst.errMsg {
+				t.Errorf("%s: expected error %s, got %v", tst.desc, tst.errMsg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tst.desc, err)
+			continue
+		}
+		var have []string
+		for _, atm := range set.SortedAtoms() {
+			var flags []string
+			for name, state := range atm.GetUseFlagMap() {
+				if state {
+					flags = append(flags, "+" + name)
+				} else {
+					flags = append(flags, "-" + name)
+				}
+			}
+			sort.Slice(flags, func (i, j int) bool { return flags[i][1:] < flags[j][1:] })
+			have = append(have, atm.String() + ":" + atm.(*AvailableVersion).SlotName + " " +
+				strings.Join(flags, " "))
+		}
+		if strings.Join(have, "\n") != strings.Join(archiveTestPackages, "\n") {
+			t.Errorf("%s: expected\n  %s\ngot\n  %s", tst.desc,
+				strings.Join(archiveTestPackages, "\n  "), strings.Join(have, "\n  "))
+		}
+	}
+}
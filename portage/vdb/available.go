@@ -12,6 +12,7 @@ import (
 type AvailableVersion struct {
 	atom.ConcreteAtom
 	Directory string
+	SlotName string
 	Deps []depend.PackageDependency
 	Blocked bool
 	Added bool
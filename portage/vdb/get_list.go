@@ -12,12 +12,35 @@ import (
 )
 
 
+const PackageDatabasePath = "/var/db/pkg"
+
+
 func GetInstalledPackageList(rootdir string) (*atom.AtomSet, error) {
-	ps := atom.NewAtomSet(atom.GroupBySlot)
-	pkgDbPath := path.Join(rootdir, "/var/db/pkg")
+	pkgDbPath := path.Join(rootdir, PackageDatabasePath)
 	if !fs.IsDir(pkgDbPath) {
 		return nil, fmt.Errorf("installed package database %s not found", pkgDbPath)
 	}
+	return ReadPackageDatabase(pkgDbPath)
+}
+
+
+func ReadPackageDatabase(pkgDbPath string) (*atom.AtomSet, error) {
+	entries, err := ListPackageDatabase(pkgDbPath)
+	if err != nil {
+		return nil, err
+	}
+	ps := atom.NewAtomSet(atom.GroupBySlot)
+	for _, av := range entries {
+		ps.Add(av)
+	}
+	return ps, nil
+}
+
+
+// Lists every entry of a package database, including entries an AtomSet would discard
+// because they occupy the same slot as an earlier entry
+func ListPackageDatabase(pkgDbPath string) ([]*AvailableVersion, error) {
+	var entries []*AvailableVersion
 	cats, err := fs.Readdirnames(pkgDbPath)
 	if err != nil {
 		return nil, err
@@ -34,10 +57,10 @@ func GetInstalledPackageList(rootdir string) (*atom.AtomSet, error) {
 			if err != nil {
 				return nil, err
 			}
-			ps.Add(av)
+			entries = append(entries, av)
 		}
 	}
-	return ps, nil
+	return entries, nil
 }
 
 
@@ -62,10 +85,43 @@ func (av *AvailableVersion) setAtom(category, namever string) error {
 	}
 	ca.SetSlotAndSubslot(slot, "")
 	av.ConcreteAtom = *ca
+	av.SlotName = slot
 	return nil
 }
 
 
+// Returns the package's IUSE setting with its +/- default indicators
+func (av *AvailableVersion) GetIUSE() (string, error) {
+	line, _, err := av.readFileIfExists("IUSE")
+	return line, err
+}
+
+
+// Returns the package's IUSE setting followed by the flags of IUSE_EFFECTIVE which it lacks,
+// those the profile adds implicitly such as the architecture and USE_EXPAND flags
+func (av *AvailableVersion) GetEffectiveIUSE() (string, error) {
+	iuse, err := av.GetIUSE()
+	if err != nil {
+		return "", err
+	}
+	effective, _, err := av.readFileIfExists("IUSE_EFFECTIVE")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(iuse)
+	have := map[string]bool{}
+	for _, name := range fields {
+		have[strings.TrimLeft(name, "+-")] = true
+	}
+	for _, name := range strings.Fields(effective) {
+		if !have[name] {
+			fields = append(fields, name)
+		}
+	}
+	return strings.Join(fields, " "), nil
+}
+
+
 func (av *AvailableVersion) readFile(name string) (string, error) {
 	line, err := fs.ReadFile(path.Join(av.Directory, name))
 	if err != nil {